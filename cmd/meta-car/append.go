@@ -1 +1,30 @@
 package main
+
+import (
+	"fmt"
+
+	meta_car "github.com/FogMeta/meta-lib/module/ipfs"
+	"github.com/urfave/cli/v2"
+)
+
+// AppendCar adds files to the root directory of an existing car
+func AppendCar(c *cli.Context) error {
+	if c.Args().Len() == 0 {
+		return fmt.Errorf("the files to append must be specified")
+	}
+	if !c.IsSet("file") {
+		return fmt.Errorf("the car file to append to must be specified")
+	}
+
+	opts, err := buildOptions(c)
+	if err != nil {
+		return err
+	}
+	oldRoot, newRoot, err := meta_car.AppendCarFile(c.Context, c.String("file"), c.Args().Slice(), opts...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("old root: %s\n", oldRoot)
+	fmt.Printf("new root: %s\n", newRoot)
+	return nil
+}
@@ -2,37 +2,14 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	log "github.com/FogMeta/meta-lib/logs"
+	meta_car "github.com/FogMeta/meta-lib/module/ipfs"
 	"github.com/FogMeta/meta-lib/util"
-	"github.com/ipfs/go-blockservice"
-	"github.com/ipfs/go-cid"
-	"github.com/ipfs/go-datastore"
-	dss "github.com/ipfs/go-datastore/sync"
-	bstore "github.com/ipfs/go-ipfs-blockstore"
-	chunker "github.com/ipfs/go-ipfs-chunker"
-	offline "github.com/ipfs/go-ipfs-exchange-offline"
-	format "github.com/ipfs/go-ipld-format"
-	ipld "github.com/ipfs/go-ipld-format"
-	"github.com/ipfs/go-merkledag"
-	dag "github.com/ipfs/go-merkledag"
-	"github.com/ipfs/go-unixfs"
-	"github.com/ipfs/go-unixfs/importer/balanced"
-	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
-	"github.com/ipld/go-car"
-	ipldprime "github.com/ipld/go-ipld-prime"
-	basicnode "github.com/ipld/go-ipld-prime/node/basic"
-	"github.com/ipld/go-ipld-prime/traversal/selector"
-	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/xerrors"
-	"io"
-	"os"
-	"path"
-	"runtime"
+	"path/filepath"
 	"strings"
-	"sync"
 )
 
 func CarBuild(c *cli.Context) error {
@@ -48,14 +25,160 @@ func CarBuild(c *cli.Context) error {
 	if sliceSize == 0 {
 		return xerrors.Errorf("Unexpected! Slice size has been set as 0")
 	}
+	if isUuid && c.Bool("deterministic") {
+		return xerrors.Errorf("random UUIDs can not be used with --deterministic")
+	}
 	targetPath := c.Args().First()
 
-	doChunk(int64(sliceSize), parentPath, targetPath, carDir, graphName, int(parallel), isUuid)
+	opts, err := buildOptions(c)
+	if err != nil {
+		return err
+	}
+	if c.Bool("save-manifest") {
+		opts = append(opts, meta_car.WithManifest(meta_car.ManifestFormat(c.String("manifest-format"))))
+	}
+	if c.IsSet("from-manifest") {
+		return buildFromManifest(c.String("from-manifest"), carDir, int64(sliceSize), c.Bool("resume"), opts...)
+	}
+	if c.Bool("archive") {
+		opts = append(opts, meta_car.WithResume(c.Bool("resume")))
+		result, err := meta_car.GenerateCarFromArchive(context.Background(), carDir, targetPath, int64(sliceSize), isUuid, nil, opts...)
+		printBuildResult(result)
+		return err
+	}
 
-	return nil
+	var journal *meta_car.Journal
+	if c.Bool("resume") {
+		// a build is resumed with the same target and flags
+		flags := make(map[string]string)
+		for _, name := range c.FlagNames() {
+			if name != "resume" {
+				flags[name] = fmt.Sprint(c.Value(name))
+			}
+		}
+		var err error
+		journal, err = meta_car.OpenJournal(carDir, struct {
+			Target string            `json:"target"`
+			Flags  map[string]string `json:"flags"`
+		}{targetPath, flags})
+		if err != nil {
+			return err
+		}
+		defer journal.Close()
+		opts = append(opts, meta_car.WithJournal(journal))
+	}
+	return doChunk(int64(sliceSize), parentPath, targetPath, carDir, graphName, int(parallel), isUuid, journal, opts...)
+}
+
+// buildFromManifest builds the CARs of the files listed in a source manifest,
+// whose format is told by its extension.
+func buildFromManifest(manifestPath, carDir string, sliceSize int64, resume bool, opts ...meta_car.Option) error {
+	var format meta_car.ManifestFormat
+	switch strings.ToLower(filepath.Ext(manifestPath)) {
+	case ".csv":
+		format = meta_car.ManifestCSV
+	case ".json":
+		format = meta_car.ManifestJSON
+	case ".ndjson", ".jsonl":
+		format = meta_car.ManifestNDJSON
+	default:
+		return xerrors.Errorf("unknown source manifest format of %s, use .csv, .json or .ndjson", manifestPath)
+	}
+	opts = append(opts, meta_car.WithResume(resume))
+	result, err := meta_car.GenerateCarFromManifest(context.Background(), carDir, manifestPath, format, sliceSize, nil, opts...)
+	printBuildResult(result)
+	return err
+}
+
+func printBuildResult(result meta_car.BuildResult) {
+	for _, car := range result.Cars {
+		fmt.Printf("%s: %d files\n", car.CarFileName, len(car.Details))
+	}
+	for _, skipped := range result.Skipped {
+		fmt.Printf("skipped %s: %s %s\n", skipped.Path, skipped.Reason, skipped.Err)
+	}
+}
+
+// buildOptions turns the DAG construction flags into options, a preset first
+// so that the single flags can override it.
+func buildOptions(c *cli.Context) ([]meta_car.Option, error) {
+	var opts []meta_car.Option
+	if c.IsSet("preset") {
+		opts = append(opts, meta_car.WithPreset(c.String("preset")))
+	}
+	if c.IsSet("cid-version") {
+		opts = append(opts, meta_car.WithCidVersion(c.Int("cid-version")))
+	}
+	if c.IsSet("hash") {
+		opts = append(opts, meta_car.WithHashFunc(c.String("hash")))
+	}
+	if c.IsSet("chunker") {
+		opts = append(opts, meta_car.WithChunker(c.String("chunker")))
+	}
+	if c.IsSet("chunk-size") {
+		opts = append(opts, meta_car.WithChunkSize(c.Int64("chunk-size")))
+	}
+	if c.IsSet("max-links") {
+		opts = append(opts, meta_car.WithMaxLinks(c.Int("max-links")))
+	}
+	if c.IsSet("min-chunk-size") || c.IsSet("max-chunk-size") {
+		var avg int64
+		if c.IsSet("chunk-size") {
+			avg = c.Int64("chunk-size")
+		}
+		opts = append(opts, meta_car.WithChunkSizes(c.Int64("min-chunk-size"), avg, c.Int64("max-chunk-size")))
+	}
+	if c.IsSet("raw-leaves") {
+		opts = append(opts, meta_car.WithRawLeaves(c.Bool("raw-leaves")))
+	}
+	if c.IsSet("layout") {
+		opts = append(opts, meta_car.WithLayout(c.String("layout")))
+	}
+	if c.IsSet("shard-size") {
+		opts = append(opts, meta_car.WithShardSize(c.Int("shard-size")))
+	}
+	if c.IsSet("preserve-mode") {
+		opts = append(opts, meta_car.WithPreserveMode(c.Bool("preserve-mode")))
+	}
+	if c.IsSet("preserve-mtime") {
+		opts = append(opts, meta_car.WithPreserveMtime(c.Bool("preserve-mtime")))
+	}
+	if c.IsSet("symlinks") {
+		opts = append(opts, meta_car.WithSymlinks(util.SymlinkPolicy(c.String("symlinks"))))
+	}
+	if c.IsSet("include") {
+		opts = append(opts, meta_car.WithInclude(c.StringSlice("include")...))
+	}
+	if c.IsSet("exclude") {
+		opts = append(opts, meta_car.WithExclude(c.StringSlice("exclude")...))
+	}
+	if c.IsSet("hidden") {
+		opts = append(opts, meta_car.WithHidden(c.Bool("hidden")))
+	}
+	if c.IsSet("deterministic") {
+		opts = append(opts, meta_car.WithDeterministic(c.Bool("deterministic")))
+	}
+	if c.IsSet("path-layout") {
+		opts = append(opts, meta_car.WithPathLayout(c.String("path-layout")))
+	}
+	if c.IsSet("strip-prefix") {
+		opts = append(opts, meta_car.WithStripPrefix(c.String("strip-prefix")))
+	}
+	if c.IsSet("path-map") {
+		m := make(map[string]string)
+		for _, pair := range c.StringSlice("path-map") {
+			src, dest, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, xerrors.Errorf("path map %q is not of the form source=destination", pair)
+			}
+			m[src] = dest
+		}
+		opts = append(opts, meta_car.WithPathMap(m))
+	}
+	return opts, nil
 }
 
-func doChunk(sliceSize int64, parentPath, targetPath, carDir, graphName string, parallel int, isUuid bool) error {
+func doChunk(sliceSize int64, parentPath, targetPath, carDir, graphName string, parallel int, isUuid bool, journal *meta_car.Journal, opts ...meta_car.Option) error {
 	var cumuSize int64 = 0
 	graphSliceCount := 0
 	graphFiles := make([]util.Finfo, 0)
@@ -70,14 +193,41 @@ func doChunk(sliceSize int64, parentPath, targetPath, carDir, graphName string,
 	}
 
 	args := []string{targetPath}
-	sliceTotal := GetGraphCount(args, sliceSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	files, err := meta_car.ScanFiles(ctx, args, isUuid, opts...)
+	if err != nil {
+		return err
+	}
+	sliceTotal, err := meta_car.GetGraphCount(args, sliceSize, opts...)
+	if err != nil {
+		return err
+	}
 	if sliceTotal == 0 {
 		log.GetLog().Warn("Empty folder or file!")
 		return nil
 	}
-	files := util.GetFileListAsync(args, isUuid)
+	// buildGraph builds the CAR of files, unless the journal has it already
+	buildGraph := func(files []util.Finfo, name string) error {
+		if journal != nil {
+			carInfo, done, err := journal.Done(name, files)
+			if err != nil {
+				return err
+			}
+			if done {
+				fmt.Printf("%s: already built\n", carInfo.CarFileName)
+				return nil
+			}
+		}
+		carInfo, err := meta_car.BuildIpldGraph(files, name, parentPath, carDir, parallel, opts...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: piece-cid: %s, dedup-saved: %d bytes\n", carInfo.CarFileName, carInfo.PieceCID, carInfo.DedupSize)
+		return nil
+	}
 	for item := range files {
-		fileSize := item.Info.Size()
+		fileSize := item.Size()
 		switch {
 		case cumuSize+fileSize < sliceSize:
 			cumuSize += fileSize
@@ -86,7 +236,9 @@ func doChunk(sliceSize int64, parentPath, targetPath, carDir, graphName string,
 			cumuSize += fileSize
 			graphFiles = append(graphFiles, item)
 			// todo build ipld from graphFiles
-			BuildIpldGraph(graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel)
+			if err := buildGraph(graphFiles, meta_car.GenGraphName(graphName, graphSliceCount, sliceTotal)); err != nil {
+				return err
+			}
 			fmt.Printf("cumu-size: %d\n", cumuSize)
 			// fmt.Printf(GenGraphName(graphName, graphSliceCount, sliceTotal))
 			// fmt.Printf("=================\n")
@@ -112,7 +264,9 @@ func doChunk(sliceSize int64, parentPath, targetPath, carDir, graphName string,
 			})
 			fileSliceCount++
 			// todo build ipld from graphFiles
-			BuildIpldGraph(graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel)
+			if err := buildGraph(graphFiles, meta_car.GenGraphName(graphName, graphSliceCount, sliceTotal)); err != nil {
+				return err
+			}
 			fmt.Printf("cumu-size: %d\n", cumuSize+firstCut)
 			// fmt.Printf(GenGraphName(graphName, graphSliceCount, sliceTotal))
 			// fmt.Printf("=================\n")
@@ -138,7 +292,9 @@ func doChunk(sliceSize int64, parentPath, targetPath, carDir, graphName string,
 				fileSliceCount++
 				if seekEnd-seekStart == sliceSize-1 {
 					// todo build ipld from graphFiles
-					BuildIpldGraph(graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel)
+					if err := buildGraph(graphFiles, meta_car.GenGraphName(graphName, graphSliceCount, sliceTotal)); err != nil {
+						return err
+					}
 					fmt.Printf("cumu-size: %d\n", sliceSize)
 					// fmt.Printf(GenGraphName(graphName, graphSliceCount, sliceTotal))
 					// fmt.Printf("=================\n")
@@ -150,449 +306,14 @@ func doChunk(sliceSize int64, parentPath, targetPath, carDir, graphName string,
 
 		}
 	}
-	if cumuSize > 0 {
+	if len(graphFiles) > 0 {
 		// todo build ipld from graphFiles
-		BuildIpldGraph(graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel)
+		if err := buildGraph(graphFiles, meta_car.GenGraphName(graphName, graphSliceCount, sliceTotal)); err != nil {
+			return err
+		}
 		fmt.Printf("cumu-size: %d\n", cumuSize)
 		// fmt.Printf(GenGraphName(graphName, graphSliceCount, sliceTotal))
 		// fmt.Printf("=================\n")
 	}
 	return nil
 }
-
-// 1K 1024
-const UnixfsLinksPerLevel = 1 << 10
-
-// 1M 1024*1024
-const UnixfsChunkSize uint64 = 1 << 20
-
-// file system tree node
-type fsNode struct {
-	Name string
-	Hash string
-	Size uint64
-	Link []fsNode
-}
-
-type FSBuilder struct {
-	root *dag.ProtoNode
-	ds   ipld.DAGService
-}
-
-func NewFSBuilder(root *dag.ProtoNode, ds ipld.DAGService) *FSBuilder {
-	return &FSBuilder{root, ds}
-}
-
-func (b *FSBuilder) Build() (*fsNode, error) {
-	fsn, err := unixfs.FSNodeFromBytes(b.root.Data())
-	if err != nil {
-		return nil, xerrors.Errorf("input dag is not a unixfs node: %s", err)
-	}
-
-	rootn := &fsNode{
-		Hash: b.root.Cid().String(),
-		Size: fsn.FileSize(),
-		Link: []fsNode{},
-	}
-	if !fsn.IsDir() {
-		return rootn, nil
-	}
-	for _, ln := range b.root.Links() {
-		fn, err := b.getNodeByLink(ln)
-		if err != nil {
-			return nil, err
-		}
-		rootn.Link = append(rootn.Link, fn)
-	}
-
-	return rootn, nil
-}
-
-func (b *FSBuilder) getNodeByLink(ln *format.Link) (fn fsNode, err error) {
-	ctx := context.Background()
-	fn = fsNode{
-		Name: ln.Name,
-		Hash: ln.Cid.String(),
-		Size: ln.Size,
-	}
-	nd, err := b.ds.Get(ctx, ln.Cid)
-	if err != nil {
-
-		log.GetLog().Warn(err)
-		return
-	}
-
-	nnd, ok := nd.(*dag.ProtoNode)
-	if !ok {
-		err = xerrors.Errorf("failed to transformed to dag.ProtoNode")
-		return
-	}
-	fsn, err := unixfs.FSNodeFromBytes(nnd.Data())
-	if err != nil {
-		log.GetLog().Warnf("input dag is not a unixfs node: %s", err)
-		return
-	}
-	if !fsn.IsDir() {
-		return
-	}
-	for _, ln := range nnd.Links() {
-		node, err := b.getNodeByLink(ln)
-		if err != nil {
-			return node, err
-		}
-		fn.Link = append(fn.Link, node)
-	}
-	return
-}
-
-func GenGraphName(graphName string, sliceCount, sliceTotal int) string {
-	if sliceTotal == 1 {
-		return fmt.Sprintf("%s.car", graphName)
-	}
-	return fmt.Sprintf("%s-total-%d-part-%d.car", graphName, sliceTotal, sliceCount+1)
-}
-
-func GetGraphCount(args []string, sliceSize int64) int {
-	list, err := util.GetFileList(args)
-	if err != nil {
-		panic(err)
-	}
-	var totalSize int64 = 0
-	for _, path := range list {
-		finfo, err := os.Stat(path)
-		if err != nil {
-			panic(err)
-		}
-		totalSize += finfo.Size()
-	}
-	if totalSize == 0 {
-		return 0
-	}
-	count := (totalSize / sliceSize) + 1
-	return int(count)
-}
-
-func BuildIpldGraph(fileList []util.Finfo, graphName, parentPath, carDir string, parallel int) {
-	node, fsDetail, err := buildIpldGraph(fileList, parentPath, carDir, parallel)
-	if err != nil {
-		log.GetLog().Fatal(err)
-		return
-	}
-	SaveToCsv(carDir, node, graphName, fsDetail)
-	//log.GetLog().Info("Build ipld graph result:", "Cid=", node.Cid().String(), " Detail=", fsDetail)
-}
-
-func buildIpldGraph(fileList []util.Finfo, parentPath, carDir string, parallel int) (ipld.Node, string, error) {
-
-	ctx := context.Background()
-
-	bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
-	dagServ := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
-
-	cidBuilder, err := merkledag.PrefixForCidVersion(0)
-	if err != nil {
-		return nil, "", err
-	}
-	fileNodeMap := make(map[string]*dag.ProtoNode)
-	dirNodeMap := make(map[string]*dag.ProtoNode)
-
-	var rootNode *dag.ProtoNode
-	rootNode = unixfs.EmptyDirNode()
-	rootNode.SetCidBuilder(cidBuilder)
-	var rootKey = "root"
-	dirNodeMap[rootKey] = rootNode
-
-	// fmt.Println("************ start to build **************")
-	// build file node
-	// parallel build
-	cpun := runtime.NumCPU()
-	if parallel > cpun {
-		parallel = cpun
-	}
-	pchan := make(chan struct{}, parallel)
-	wg := sync.WaitGroup{}
-	lock := sync.Mutex{}
-	for i, item := range fileList {
-		wg.Add(1)
-		go func(i int, item util.Finfo) {
-			defer func() {
-				<-pchan
-				wg.Done()
-			}()
-			pchan <- struct{}{}
-			fileNode, err := BuildFileNode(item, dagServ, cidBuilder)
-			if err != nil {
-				log.GetLog().Warn(err)
-				return
-			}
-			fn, ok := fileNode.(*dag.ProtoNode)
-			if !ok {
-				emsg := "file node should be *dag.ProtoNode"
-				log.GetLog().Warn(emsg)
-				return
-			}
-			lock.Lock()
-			fileNodeMap[item.Path] = fn
-			lock.Unlock()
-			// fmt.Println(item.Path)
-			stat, _ := fileNode.Stat()
-			log.GetLog().Infof("FILE:%s    CID:%s    UUID:%s      SIZE:%d\n", item.Path, fileNode, item.Uuid, stat.CumulativeSize)
-		}(i, item)
-	}
-	wg.Wait()
-
-	// build dir tree
-	for _, item := range fileList {
-		// log.GetLog().Info(item.Path)
-		// log.Infof("file name: %s, file size: %d, item size: %d, seek-start:%d, seek-end:%d", item.Name, item.Info.Size(), item.SeekEnd-item.SeekStart, item.SeekStart, item.SeekEnd)
-		dirStr := path.Dir(item.Path)
-		parentPath = path.Clean(parentPath)
-		// when parent path equal target path, and the parent path is also a file path
-		if parentPath == path.Clean(item.Path) {
-			dirStr = ""
-		} else if parentPath != "" && strings.HasPrefix(dirStr, parentPath) {
-			dirStr = dirStr[len(parentPath):]
-		}
-
-		if strings.HasPrefix(dirStr, "/") {
-			dirStr = dirStr[1:]
-		}
-		var dirList []string
-		if dirStr == "" {
-			dirList = []string{}
-		} else {
-			dirList = strings.Split(dirStr, "/")
-		}
-		fileNode, ok := fileNodeMap[item.Path]
-		if !ok {
-			panic("unexpected, missing file node")
-		}
-		if len(dirList) == 0 {
-			dirNodeMap[rootKey].AddNodeLink(item.Name+item.Uuid, fileNode)
-			continue
-		}
-		//log.Info(item.Path)
-		//log.GetLog().Info(dirList)
-		i := len(dirList) - 1
-		for ; i >= 0; i-- {
-			// get dirNodeMap by index
-			var ok bool
-			var dirNode *dag.ProtoNode
-			var parentNode *dag.ProtoNode
-			var parentKey string
-			dir := dirList[i]
-			dirKey := getDirKey(dirList, i)
-			//log.GetLog().Info(dirList)
-			//log.GetLog().Infof("dirKey: %s", dirKey)
-			dirNode, ok = dirNodeMap[dirKey]
-			if !ok {
-				dirNode = unixfs.EmptyDirNode()
-				dirNode.SetCidBuilder(cidBuilder)
-				dirNodeMap[dirKey] = dirNode
-			}
-			// add file node to its nearest parent node
-			if i == len(dirList)-1 {
-				dirNode.AddNodeLink(item.Name+item.Uuid, fileNode)
-			}
-			if i == 0 {
-				parentKey = rootKey
-			} else {
-				parentKey = getDirKey(dirList, i-1)
-			}
-			//log.GetLog().Infof("parentKey: %s", parentKey)
-			parentNode, ok = dirNodeMap[parentKey]
-			if !ok {
-				parentNode = unixfs.EmptyDirNode()
-				parentNode.SetCidBuilder(cidBuilder)
-				dirNodeMap[parentKey] = parentNode
-			}
-			if isLinked(parentNode, dir) {
-				parentNode, err = parentNode.UpdateNodeLink(dir, dirNode)
-				if err != nil {
-					return nil, "", err
-				}
-				dirNodeMap[parentKey] = parentNode
-			} else {
-				parentNode.AddNodeLink(dir, dirNode)
-			}
-		}
-	}
-
-	for _, node := range dirNodeMap {
-		// fmt.Printf("add node to store: %v\n", node)
-		// fmt.Printf("key: %s, links: %v\n", key, len(node.Links()))
-		dagServ.Add(ctx, node)
-	}
-
-	rootNode = dirNodeMap[rootKey]
-	//fmt.Printf("root node cid: %s\n", rootNode.Cid())
-	// log.GetLog().Infof("start to generate car for %s", rootNode.Cid())
-	// genCarStartTime := time.Now()
-	//car
-	carF, err := os.Create(path.Join(carDir, rootNode.Cid().String()+".car"))
-	if err != nil {
-		return nil, "", err
-	}
-	defer carF.Close()
-	selector := allSelector()
-	sc := car.NewSelectiveCar(ctx, bs2, []car.Dag{{Root: rootNode.Cid(), Selector: selector}})
-	err = sc.Write(carF)
-	// cario := cario.NewCarIO()
-	// err = cario.WriteCar(context.Background(), bs2, rootNode.Cid(), selector, carF)
-	if err != nil {
-		return nil, "", err
-	}
-	//log.GetLog().Infof("generate car file completed, time elapsed: %s", time.Now().Sub(genCarStartTime))
-
-	fsBuilder := NewFSBuilder(rootNode, dagServ)
-	fsNode, err := fsBuilder.Build()
-	if err != nil {
-		return nil, "", err
-	}
-	fsNodeBytes, err := json.Marshal(fsNode)
-	if err != nil {
-		return nil, "", err
-	}
-	// log.GetLog().Info("File Node Map:", fileNodeMap)
-	// log.GetLog().Info("Dir  Node Map:", dirNodeMap)
-	// fmt.Println("++++++++++++ finished to build +++++++++++++")
-	return rootNode, fmt.Sprintf("%s", fsNodeBytes), nil
-}
-
-func allSelector() ipldprime.Node {
-	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
-	return ssb.ExploreRecursive(selector.RecursionLimitNone(),
-		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).
-		Node()
-}
-
-func getDirKey(dirList []string, i int) (key string) {
-	for j := 0; j <= i; j++ {
-		key += dirList[j]
-		if j < i {
-			key += "."
-		}
-	}
-	return
-}
-
-func isLinked(node *dag.ProtoNode, name string) bool {
-	for _, lk := range node.Links() {
-		if lk.Name == name {
-			return true
-		}
-	}
-	return false
-}
-
-type fileSlice struct {
-	r        *os.File
-	offset   int64
-	start    int64
-	end      int64
-	fileSize int64
-}
-
-func (fs *fileSlice) Read(p []byte) (n int, err error) {
-	if fs.end == 0 {
-		fs.end = fs.fileSize - 1
-	}
-	if fs.offset == 0 && fs.start > 0 {
-		_, err = fs.r.Seek(fs.start, 0)
-		if err != nil {
-			log.GetLog().Warn(err)
-			return 0, err
-		}
-		fs.offset = fs.start
-	}
-	//fmt.Printf("offset: %d, end: %d, start: %d, size: %d\n", fs.offset, fs.end, fs.start, fs.fileSize)
-	if fs.end-fs.offset+1 == 0 {
-		return 0, io.EOF
-	}
-	if fs.end-fs.offset+1 < 0 {
-		return 0, xerrors.Errorf("read data out bound of the slice")
-	}
-	plen := len(p)
-	leftLen := fs.end - fs.offset + 1
-	if leftLen > int64(plen) {
-		n, err = fs.r.Read(p)
-		if err != nil {
-			log.GetLog().Warn(err)
-			return
-		}
-		//fmt.Printf("read num: %d\n", n)
-		fs.offset += int64(n)
-		return
-	}
-	b := make([]byte, leftLen)
-	n, err = fs.r.Read(b)
-	if err != nil {
-		return
-	}
-	//fmt.Printf("read num: %d\n", n)
-	fs.offset += int64(n)
-
-	return copy(p, b), io.EOF
-}
-
-func BuildFileNode(item util.Finfo, bufDs ipld.DAGService, cidBuilder cid.Builder) (node ipld.Node, err error) {
-	var r io.Reader
-	f, err := os.Open(item.Path)
-	if err != nil {
-		return nil, err
-	}
-	r = f
-
-	// read all data of item
-	if item.SeekStart > 0 || item.SeekEnd > 0 {
-		r = &fileSlice{
-			r:        f,
-			start:    item.SeekStart,
-			end:      item.SeekEnd,
-			fileSize: item.Info.Size(),
-		}
-	}
-
-	params := ihelper.DagBuilderParams{
-		Maxlinks:   UnixfsLinksPerLevel,
-		RawLeaves:  false,
-		CidBuilder: cidBuilder,
-		Dagserv:    bufDs,
-		NoCopy:     false,
-	}
-	db, err := params.New(chunker.NewSizeSplitter(r, int64(UnixfsChunkSize)))
-	if err != nil {
-		return nil, err
-	}
-	node, err = balanced.Layout(db)
-	if err != nil {
-		return nil, err
-	}
-	return
-}
-
-func SaveToCsv(carDir string, node ipld.Node, graphName, fsDetail string) {
-	// Add node inof to manifest.csv
-	manifestPath := path.Join(carDir, "manifest.csv")
-	_, err := os.Stat(manifestPath)
-	if err != nil && !os.IsNotExist(err) {
-		log.GetLog().Fatal(err)
-	}
-	var isCreateAction bool
-	if err != nil && os.IsNotExist(err) {
-		isCreateAction = true
-	}
-	f, err := os.OpenFile(manifestPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.GetLog().Fatal(err)
-	}
-	defer f.Close()
-	if isCreateAction {
-		if _, err := f.Write([]byte("playload_cid,filename,detail\n")); err != nil {
-			log.GetLog().Fatal(err)
-		}
-	}
-	if _, err := f.Write([]byte(fmt.Sprintf("%s,%s,%s\n", node.Cid(), graphName, fsDetail))); err != nil {
-		log.GetLog().Fatal(err)
-	}
-}
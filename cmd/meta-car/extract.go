@@ -9,6 +9,7 @@ import (
 	"path"
 	"path/filepath"
 
+	meta_car "github.com/FogMeta/meta-lib/module/ipfs"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-unixfsnode"
 	"github.com/ipfs/go-unixfsnode/data"
@@ -58,7 +59,11 @@ func ExtractCar(c *cli.Context) error {
 	}
 
 	for _, root := range roots {
-		if err := extractRoot(c, &ls, root, outputDir); err != nil {
+		_, uuidMap, err := meta_car.ReadUuidMap(c.Context, bs, root)
+		if err != nil {
+			return err
+		}
+		if err := extractRoot(c, &ls, root, uuidMap, outputDir); err != nil {
 			return err
 		}
 	}
@@ -66,7 +71,8 @@ func ExtractCar(c *cli.Context) error {
 	return nil
 }
 
-func extractRoot(c *cli.Context, ls *ipld.LinkSystem, root cid.Cid, outputDir string) error {
+// extractRoot extracts the DAG of root, without the UUID map it links.
+func extractRoot(c *cli.Context, ls *ipld.LinkSystem, root, uuidMap cid.Cid, outputDir string) error {
 	if root.Prefix().Codec == cid.Raw {
 		if c.IsSet("verbose") {
 			fmt.Fprintf(c.App.ErrWriter, "skipping raw root %s\n", root)
@@ -94,7 +100,7 @@ func extractRoot(c *cli.Context, ls *ipld.LinkSystem, root cid.Cid, outputDir st
 			return err
 		}
 	}
-	if err := extractDir(c, ls, ufn, outputResolvedDir, "/"); err != nil {
+	if err := extractDir(c, ls, ufn, uuidMap, outputResolvedDir, "/"); err != nil {
 		if !errors.Is(err, ErrNotDir) {
 			return fmt.Errorf("%s: %w", root, err)
 		}
@@ -139,7 +145,7 @@ func resolvePath(root, pth string) (string, error) {
 	return joined, nil
 }
 
-func extractDir(c *cli.Context, ls *ipld.LinkSystem, n ipld.Node, outputRoot, outputPath string) error {
+func extractDir(c *cli.Context, ls *ipld.LinkSystem, n ipld.Node, skip cid.Cid, outputRoot, outputPath string) error {
 	dirPath, err := resolvePath(outputRoot, outputPath)
 	if err != nil {
 		return err
@@ -160,6 +166,10 @@ func extractDir(c *cli.Context, ls *ipld.LinkSystem, n ipld.Node, outputRoot, ou
 			if err != nil {
 				return err
 			}
+			// the UUID map of the CAR is no file
+			if l, err := val.AsLink(); err == nil && skip.Defined() && l == (cidlink.Link{Cid: skip}) {
+				continue
+			}
 			nextRes, err := resolvePath(outputRoot, path.Join(outputPath, ks))
 			if err != nil {
 				return err
@@ -215,7 +225,7 @@ func extractDir(c *cli.Context, ls *ipld.LinkSystem, n ipld.Node, outputRoot, ou
 					return err
 				}
 
-				if err := extractDir(c, ls, ufn, outputRoot, path.Join(outputPath, ks)); err != nil {
+				if err := extractDir(c, ls, ufn, cid.Undef, outputRoot, path.Join(outputPath, ks)); err != nil {
 					return err
 				}
 			} else if ufsNode.DataType.Int() == data.Data_File || ufsNode.DataType.Int() == data.Data_Raw {
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 
+	meta_car "github.com/FogMeta/meta-lib/module/ipfs"
 	"github.com/dustin/go-humanize"
 	"github.com/ipfs/go-cid"
 	data "github.com/ipfs/go-unixfsnode/data"
@@ -154,14 +155,18 @@ func listUnixfs(c *cli.Context, outStream io.Writer) error {
 		return err
 	}
 	for _, r := range roots {
-		if err := printUnixFSNode(c, "", r, &ls, outStream); err != nil {
+		_, uuidMap, err := meta_car.ReadUuidMap(c.Context, bs, r)
+		if err != nil {
+			return err
+		}
+		if err := printUnixFSNode(c, "", r, &ls, uuidMap, outStream); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func printUnixFSNode(c *cli.Context, prefix string, node cid.Cid, ls *ipld.LinkSystem, outStream io.Writer) error {
+func printUnixFSNode(c *cli.Context, prefix string, node cid.Cid, ls *ipld.LinkSystem, uuidMap cid.Cid, outStream io.Writer) error {
 	// it might be a raw file (bytes) node. if so, not actually an error.
 	if node.Prefix().Codec == cid.Raw {
 		return nil
@@ -184,14 +189,17 @@ func printUnixFSNode(c *cli.Context, prefix string, node cid.Cid, ls *ipld.LinkS
 		for !i.Done() {
 			_, l := i.Next()
 			name := path.Join(prefix, l.Name.Must().String())
-			fmt.Fprintf(outStream, "%s\n", name)
 			// recurse into the file/directory
 			cl, err := l.Hash.AsLink()
 			if err != nil {
 				return err
 			}
 			if cidl, ok := cl.(cidlink.Link); ok {
-				if err := printUnixFSNode(c, name, cidl.Cid, ls, outStream); err != nil {
+				if cidl.Cid == uuidMap {
+					continue
+				}
+				fmt.Fprintf(outStream, "%s\n", name)
+				if err := printUnixFSNode(c, name, cidl.Cid, ls, cid.Undef, outStream); err != nil {
 					return err
 				}
 			}
@@ -205,14 +213,17 @@ func printUnixFSNode(c *cli.Context, prefix string, node cid.Cid, ls *ipld.LinkS
 		i := hn.Iterator()
 		for !i.Done() {
 			n, l := i.Next()
-			fmt.Fprintf(outStream, "%s\n", path.Join(prefix, n.String()))
 			// recurse into the file/directory
 			cl, err := l.AsLink()
 			if err != nil {
 				return err
 			}
 			if cidl, ok := cl.(cidlink.Link); ok {
-				if err := printUnixFSNode(c, path.Join(prefix, n.String()), cidl.Cid, ls, outStream); err != nil {
+				if cidl.Cid == uuidMap {
+					continue
+				}
+				fmt.Fprintf(outStream, "%s\n", path.Join(prefix, n.String()))
+				if err := printUnixFSNode(c, path.Join(prefix, n.String()), cidl.Cid, ls, cid.Undef, outStream); err != nil {
 					return err
 				}
 			}
@@ -253,14 +264,18 @@ func listLinks(c *cli.Context, outStream io.Writer) error {
 		return err
 	}
 	for _, r := range roots {
-		if err := printLinksNode(c, "", r, &ls, outStream); err != nil {
+		uuids, uuidMap, err := meta_car.ReadUuidMap(c.Context, bs, r)
+		if err != nil {
+			return err
+		}
+		if err := printLinksNode(c, "", r, &ls, uuids, uuidMap, outStream); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func printLinksNode(c *cli.Context, prefix string, node cid.Cid, ls *ipld.LinkSystem, outStream io.Writer) error {
+func printLinksNode(c *cli.Context, prefix string, node cid.Cid, ls *ipld.LinkSystem, uuids map[string]string, uuidMap cid.Cid, outStream io.Writer) error {
 	// it might be a raw file (bytes) node. if so, not actually an error.
 	if node.Prefix().Codec == cid.Raw {
 		return nil
@@ -284,13 +299,9 @@ func printLinksNode(c *cli.Context, prefix string, node cid.Cid, ls *ipld.LinkSy
 			_, l := i.Next()
 			name := path.Join(prefix, l.Name.Must().String())
 			size := l.Tsize.Must().Int()
-			nameLen := len(name)
-			uuid := ""
-			uuidLen := len("ce547c40-acf9-11e6-80f5-76304dec7eb7")
-			// TODO: split uuid string and check it
-			if nameLen > uuidLen {
-				uuid = name[nameLen-uuidLen:]
-				name = name[:nameLen-uuidLen]
+			uuid := uuids[name]
+			if len(uuids) == 0 {
+				name, uuid = meta_car.SplitLegacyUuid(name)
 			}
 
 			// recurse into the file/directory
@@ -299,8 +310,11 @@ func printLinksNode(c *cli.Context, prefix string, node cid.Cid, ls *ipld.LinkSy
 				return err
 			}
 			if cidl, ok := cl.(cidlink.Link); ok {
+				if cidl.Cid == uuidMap {
+					continue
+				}
 				fmt.Fprintf(outStream, "%s     CID:%s     UUID:%s     SIZE:%d\n", name, cidl.Cid, uuid, size)
-				if err := printLinksNode(c, name, cidl.Cid, ls, outStream); err != nil {
+				if err := printLinksNode(c, name, cidl.Cid, ls, uuids, cid.Undef, outStream); err != nil {
 					return err
 				}
 			}
@@ -314,14 +328,17 @@ func printLinksNode(c *cli.Context, prefix string, node cid.Cid, ls *ipld.LinkSy
 		i := hn.Iterator()
 		for !i.Done() {
 			n, l := i.Next()
-			fmt.Fprintf(outStream, "HAMT: %s\n", path.Join(prefix, n.String()))
 			// recurse into the file/directory
 			cl, err := l.AsLink()
 			if err != nil {
 				return err
 			}
 			if cidl, ok := cl.(cidlink.Link); ok {
-				if err := printLinksNode(c, path.Join(prefix, n.String()), cidl.Cid, ls, outStream); err != nil {
+				if cidl.Cid == uuidMap {
+					continue
+				}
+				fmt.Fprintf(outStream, "HAMT: %s\n", path.Join(prefix, n.String()))
+				if err := printLinksNode(c, path.Join(prefix, n.String()), cidl.Cid, ls, uuids, cid.Undef, outStream); err != nil {
 					return err
 				}
 			}
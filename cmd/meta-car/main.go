@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	meta_car "github.com/FogMeta/meta-lib/module/ipfs"
 	"github.com/multiformats/go-multicodec"
 	"github.com/urfave/cli/v2"
 	"os"
+	"strings"
 )
 
 func main() {
@@ -46,20 +48,28 @@ func main() {
 			},
 			{
 				Name:    "append",
-				Usage:   "Append files to a car file",
-				Aliases: []string{"c"},
-				Action:  CreateCar,
+				Usage:   "Append files to the root directory of a car file",
+				Aliases: []string{"a"},
+				Action:  AppendCar,
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:      "file",
 						Aliases:   []string{"f", "output", "o"},
-						Usage:     "The car file to write to",
+						Usage:     "The car file to append to",
 						TakesFile: true,
 					},
+					&cli.StringFlag{
+						Name:  "preset",
+						Usage: "use the DAG settings of another tool for the new files: " + strings.Join(meta_car.Presets(), ", "),
+					},
 					&cli.IntFlag{
-						Name:  "version",
-						Value: 2,
-						Usage: "Write output as a v1 or v2 format car",
+						Name:  "cid-version",
+						Value: 0,
+						Usage: "specify CID version of the new files, 0 or 1",
+					},
+					&cli.BoolFlag{
+						Name:  "raw-leaves",
+						Usage: "use raw leaves for the new files",
 					},
 				},
 			},
@@ -256,7 +266,124 @@ func main() {
 					&cli.BoolFlag{
 						Name:  "save-manifest",
 						Value: true,
-						Usage: "create a mainfest.csv in car-dir to save mapping of data-cids and slice names",
+						Usage: "create a manifest in car-dir to save mapping of data-cids and slice names",
+					},
+					&cli.StringFlag{
+						Name:  "manifest-format",
+						Value: string(meta_car.ManifestCSV),
+						Usage: "specify the format of the manifest: csv, json or ndjson",
+					},
+					&cli.StringFlag{
+						Name:  "preset",
+						Usage: "use the DAG settings of another tool: " + strings.Join(meta_car.Presets(), ", "),
+					},
+					&cli.IntFlag{
+						Name:  "cid-version",
+						Value: 0,
+						Usage: "specify CID version, 0 or 1",
+					},
+					&cli.StringFlag{
+						Name:  "hash",
+						Value: "sha2-256",
+						Usage: "specify multihash function, e.g. sha2-256, sha2-512, blake2b-256",
+					},
+					&cli.StringFlag{
+						Name:  "chunker",
+						Value: meta_car.ChunkerFixed,
+						Usage: "specify chunker, size, rabin or buzhash",
+					},
+					&cli.Int64Flag{
+						Name:  "chunk-size",
+						Value: int64(meta_car.UnixfsChunkSize),
+						Usage: "specify chunk size of file data in bytes, for rabin the average size which defaults to 256KiB",
+					},
+					&cli.Int64Flag{
+						Name:  "min-chunk-size",
+						Usage: "specify min chunk size for rabin, default chunk-size/3",
+					},
+					&cli.Int64Flag{
+						Name:  "max-chunk-size",
+						Usage: "specify max chunk size for rabin, default chunk-size*1.5",
+					},
+					&cli.IntFlag{
+						Name:  "max-links",
+						Value: meta_car.UnixfsLinksPerLevel,
+						Usage: "specify max links per DAG node",
+					},
+					&cli.BoolFlag{
+						Name:  "raw-leaves",
+						Value: false,
+						Usage: "store file data in raw leaf blocks",
+					},
+					&cli.StringFlag{
+						Name:  "layout",
+						Value: meta_car.LayoutBalanced,
+						Usage: "specify file DAG layout, balanced or trickle",
+					},
+					&cli.IntFlag{
+						Name:  "shard-size",
+						Value: meta_car.DefaultShardSize,
+						Usage: "specify estimated directory size in bytes at which it becomes a HAMT shard, 0 disables sharding",
+					},
+					&cli.BoolFlag{
+						Name:  "preserve-mode",
+						Value: false,
+						Usage: "store the permissions of files and directories",
+					},
+					&cli.BoolFlag{
+						Name:  "preserve-mtime",
+						Value: false,
+						Usage: "store the modification time of files and directories",
+					},
+					&cli.StringFlag{
+						Name:  "symlinks",
+						Value: string(meta_car.SymlinkFollow),
+						Usage: "specify what to do with symbolic links: follow, skip or store",
+					},
+					&cli.StringSliceFlag{
+						Name:  "include",
+						Usage: "only pack files matching this gitignore style pattern, can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "exclude",
+						Usage: "leave out files matching this gitignore style pattern, can be repeated",
+					},
+					&cli.BoolFlag{
+						Name:  "hidden",
+						Value: false,
+						Usage: "also pack files and directories whose name starts with a dot",
+					},
+					&cli.BoolFlag{
+						Name:  "deterministic",
+						Value: false,
+						Usage: "build byte identical CARs from the same input, one file after the other",
+					},
+					&cli.StringFlag{
+						Name:  "path-layout",
+						Value: meta_car.PathLayoutFull,
+						Usage: "specify the paths of the files in the CARs: full, relative or flat",
+					},
+					&cli.StringFlag{
+						Name:  "strip-prefix",
+						Usage: "cut a prefix from the source paths of the files in the full path layout",
+					},
+					&cli.StringSliceFlag{
+						Name:  "path-map",
+						Usage: "put the files at or below a source path at a path in the CARs, as source=destination",
+					},
+					&cli.BoolFlag{
+						Name:  "resume",
+						Value: false,
+						Usage: "keep a journal of the finished CARs in car-dir and continue the build it records",
+					},
+					&cli.BoolFlag{
+						Name:  "archive",
+						Value: false,
+						Usage: "read the target as a tar, tar.gz or zip archive and build its entries without extracting it",
+					},
+					&cli.StringFlag{
+						Name:  "from-manifest",
+						Usage: "build the files listed in a csv, json or ndjson manifest with path, dest, uuid and sha256 columns instead of a target path",
 					},
 				},
 				Action: CarBuild,
@@ -12,6 +12,7 @@ import (
 	"sync"
 
 	log "github.com/FogMeta/meta-lib/logs"
+	meta_car "github.com/FogMeta/meta-lib/module/ipfs"
 	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
@@ -137,6 +138,10 @@ func CarTo(carPath, outputDir string, parallel int) {
 					log.GetLog().Error("dagService.Get error, ", err)
 					return
 				}
+				if nd, err = meta_car.StripUuidMap(ctx, rdag, nd); err != nil {
+					log.GetLog().Error("StripUuidMap error, ", err)
+					return
+				}
 				file, err := unixfile.NewUnixfsFile(ctx, rdag, nd)
 				if err != nil {
 					log.GetLog().Error("NewUnixfsFile error, ", err)
@@ -145,6 +150,10 @@ func CarTo(carPath, outputDir string, parallel int) {
 				err = NodeWriteTo(file, outputDir)
 				if err != nil {
 					log.GetLog().Error("NodeWriteTo error, ", err)
+					return
+				}
+				if err := meta_car.RestoreMetadata(ctx, rdag, nd, outputDir); err != nil {
+					log.GetLog().Error("RestoreMetadata error, ", err)
 				}
 			}
 			return nil
@@ -231,6 +240,8 @@ func Merge(dir string, parallel int) {
 			}
 		}
 	}()
+	// find the files first, merging removes the parts from the walked tree
+	var fpaths []string
 	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -243,13 +254,16 @@ func Merge(dir string, parallel int) {
 			log.GetLog().Error("filepath.Match failed, ", err)
 			return nil
 		} else if matched {
-			mergeCh <- strings.TrimSuffix(path, ".00000000")
+			fpaths = append(fpaths, strings.TrimSuffix(path, ".00000000"))
 		}
 		return nil
 	})
 	if err != nil {
 		log.GetLog().Error("Walk path failed, ", err)
 	}
+	for _, fpath := range fpaths {
+		mergeCh <- fpath
+	}
 	close(mergeCh)
 	wg.Wait()
 }
@@ -0,0 +1,246 @@
+package commp
+
+import (
+	"crypto/sha256"
+	"math/bits"
+
+	"github.com/FogMeta/meta-lib/module/commp/calunseal/fr32"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+const (
+	unpaddedQuad = 127
+	paddedQuad   = 128
+	// a fr32 padded quad holds 4 leaves, so it is the root of a level 2 subtree
+	quadLevel = 2
+)
+
+var zeroNodes [64][32]byte
+
+func init() {
+	for i := 1; i < len(zeroNodes); i++ {
+		zeroNodes[i] = hashNode(zeroNodes[i-1], zeroNodes[i-1])
+	}
+}
+
+type treeNode struct {
+	level   int
+	hash    [32]byte
+	pending bool
+}
+
+// Writer computes the piece commitment (commP) of the data written to it on
+// the fly, so the data never has to be held in memory or read a second time.
+// The piece size is the smallest power of two that holds the fr32 padded data.
+//
+// The first reserved bytes of the data are not written through Write but
+// handed to Sum, so a header that is only known at the end, like the root of
+// a CAR, can still be hashed in place.
+type Writer struct {
+	reserved int
+	window   []byte
+	windowSz int
+	buf      []byte
+	total    uint64
+	stack    []treeNode
+	rights   [][32]byte
+	padded   [paddedQuad]byte
+}
+
+// NewWriter returns a Writer whose first reserved bytes are supplied to Sum.
+func NewWriter(reserved int) *Writer {
+	quads := 1
+	for quads*unpaddedQuad < reserved {
+		quads <<= 1
+	}
+	w := &Writer{
+		reserved: reserved,
+		windowSz: quads * unpaddedQuad,
+		window:   make([]byte, reserved, quads*unpaddedQuad),
+		buf:      make([]byte, 0, unpaddedQuad),
+		total:    uint64(reserved),
+	}
+	if reserved == w.windowSz {
+		w.pushWindow()
+	}
+	return w
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n := len(p)
+	w.total += uint64(n)
+	if len(w.window) < w.windowSz {
+		m := w.windowSz - len(w.window)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.window = append(w.window, p[:m]...)
+		p = p[m:]
+		if len(w.window) == w.windowSz {
+			w.pushWindow()
+		}
+	}
+	if len(w.buf) > 0 {
+		m := unpaddedQuad - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		if len(w.buf) < unpaddedQuad {
+			return n, nil
+		}
+		w.push(treeNode{level: quadLevel, hash: w.quadHash(w.buf)})
+		w.buf = w.buf[:0]
+	}
+	for len(p) >= unpaddedQuad {
+		w.push(treeNode{level: quadLevel, hash: w.quadHash(p[:unpaddedQuad])})
+		p = p[unpaddedQuad:]
+	}
+	w.buf = append(w.buf, p...)
+	return n, nil
+}
+
+// Size returns the number of bytes the commitment covers, reserved bytes included.
+func (w *Writer) Size() uint64 {
+	return w.total
+}
+
+// Sum returns the piece CID and padded piece size of the data, with reserved
+// as its leading bytes.
+func (w *Writer) Sum(reserved []byte) (cid.Cid, abi.PaddedPieceSize, error) {
+	if len(reserved) != w.reserved {
+		return cid.Undef, 0, xerrors.Errorf("expected %d reserved bytes, got %d", w.reserved, len(reserved))
+	}
+	copy(w.window, reserved)
+
+	quads := (w.total + unpaddedQuad - 1) / unpaddedQuad
+	if quads == 0 {
+		quads = 1
+	}
+	pieceSize := abi.PaddedPieceSize(paddedQuad)
+	for uint64(pieceSize) < quads*paddedQuad {
+		pieceSize <<= 1
+	}
+	pieceLevel := bits.TrailingZeros64(uint64(pieceSize) / 32)
+
+	// the data did not even fill the leading subtree
+	if len(w.window) < w.windowSz {
+		root := w.subtreeHash(w.window, pieceLevel)
+		return pieceCid(root, pieceSize)
+	}
+
+	stack := append([]treeNode(nil), w.stack...)
+	stack[0].hash = w.subtreeHash(w.window, w.windowLevel())
+	for _, r := range w.rights {
+		stack[0].hash = hashNode(stack[0].hash, r)
+	}
+	stack[0].pending = false
+	if len(w.buf) > 0 {
+		stack = pushNode(stack, treeNode{level: quadLevel, hash: w.quadHash(w.buf)}, nil)
+	}
+
+	// fill the rest of the piece with zero subtrees
+	for len(stack) > 1 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		stack = pushNode(stack, treeNode{level: top.level + 1, hash: hashNode(top.hash, zeroNodes[top.level])}, nil)
+	}
+	root := stack[0]
+	for root.level < pieceLevel {
+		root = treeNode{level: root.level + 1, hash: hashNode(root.hash, zeroNodes[root.level])}
+	}
+	return pieceCid(root.hash, pieceSize)
+}
+
+// pushWindow pushes the leading subtree, which is only hashed in Sum once the
+// reserved bytes are known.
+func (w *Writer) pushWindow() {
+	w.push(treeNode{level: w.windowLevel(), pending: true})
+}
+
+func (w *Writer) windowLevel() int {
+	return quadLevel + bits.TrailingZeros(uint(w.windowSz/unpaddedQuad))
+}
+
+func (w *Writer) push(n treeNode) {
+	w.stack = pushNode(w.stack, n, &w.rights)
+}
+
+// pushNode pushes n and merges equal level subtrees. Merges into the pending
+// leading subtree only record the right hand side, to be replayed by Sum.
+func pushNode(stack []treeNode, n treeNode, rights *[][32]byte) []treeNode {
+	stack = append(stack, n)
+	for len(stack) > 1 {
+		right := stack[len(stack)-1]
+		left := stack[len(stack)-2]
+		if left.level != right.level {
+			break
+		}
+		stack = stack[:len(stack)-2]
+		if left.pending {
+			*rights = append(*rights, right.hash)
+			stack = append(stack, treeNode{level: left.level + 1, pending: true})
+			continue
+		}
+		stack = append(stack, treeNode{level: left.level + 1, hash: hashNode(left.hash, right.hash)})
+	}
+	return stack
+}
+
+func (w *Writer) quadHash(in []byte) [32]byte {
+	var quad [unpaddedQuad]byte
+	copy(quad[:], in)
+	fr32.Pad(quad[:], w.padded[:])
+	var leaves [4][32]byte
+	for i := range leaves {
+		copy(leaves[i][:], w.padded[i*32:(i+1)*32])
+	}
+	return hashNode(hashNode(leaves[0], leaves[1]), hashNode(leaves[2], leaves[3]))
+}
+
+// subtreeHash hashes data, zero padded, as a subtree of the given level.
+func (w *Writer) subtreeHash(data []byte, level int) [32]byte {
+	var stack []treeNode
+	for off := 0; off < len(data); off += unpaddedQuad {
+		end := off + unpaddedQuad
+		if end > len(data) {
+			end = len(data)
+		}
+		stack = pushNode(stack, treeNode{level: quadLevel, hash: w.quadHash(data[off:end])}, nil)
+	}
+	if len(stack) == 0 {
+		stack = append(stack, treeNode{level: quadLevel, hash: zeroNodes[quadLevel]})
+	}
+	for len(stack) > 1 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		stack = pushNode(stack, treeNode{level: top.level + 1, hash: hashNode(top.hash, zeroNodes[top.level])}, nil)
+	}
+	root := stack[0]
+	for root.level < level {
+		root = treeNode{level: root.level + 1, hash: hashNode(root.hash, zeroNodes[root.level])}
+	}
+	return root.hash
+}
+
+func hashNode(left, right [32]byte) [32]byte {
+	h := sha256.New()
+	h.Write(left[:])
+	h.Write(right[:])
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+	out[31] &= 0b00111111
+	return out
+}
+
+func pieceCid(root [32]byte, size abi.PaddedPieceSize) (cid.Cid, abi.PaddedPieceSize, error) {
+	c, err := commcid.PieceCommitmentV1ToCID(root[:])
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	return c, size, nil
+}
@@ -0,0 +1,44 @@
+package commp_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/FogMeta/meta-lib/module/commp"
+	"github.com/FogMeta/meta-lib/module/commp/calpiece"
+	"github.com/FogMeta/meta-lib/module/commp/calunseal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterMatchesPieceFactory(t *testing.T) {
+	for _, size := range []int{1, 127, 128, 1000, 65000, 127*1024 + 5} {
+		for _, reserved := range []int{0, 59, 127, 300} {
+			if reserved > size {
+				continue
+			}
+			data := make([]byte, size)
+			rand.Read(data)
+
+			w := commp.NewWriter(reserved)
+			for rest := data[reserved:]; len(rest) > 0; {
+				n := rand.Intn(300) + 1
+				if n > len(rest) {
+					n = len(rest)
+				}
+				_, err := w.Write(rest[:n])
+				require.NoError(t, err)
+				rest = rest[n:]
+			}
+			pieceCid, pieceSize, err := w.Sum(data[:reserved])
+			require.NoError(t, err)
+
+			_, unsealData, err := calunseal.NewUnsealData(pieceSize, data)
+			require.NoError(t, err)
+			factory, err := calpiece.NewGenPieceFactory(int(pieceSize), unsealData.Fr32Data, 1.2)
+			require.NoError(t, err)
+			expected, err := factory.Sum()
+			require.NoError(t, err)
+			require.Equal(t, expected, pieceCid, "size %d reserved %d", size, reserved)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package ipfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/FogMeta/meta-lib/logs"
+	"github.com/FogMeta/meta-lib/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	"golang.org/x/xerrors"
+)
+
+// AppendCarFile adds srcFiles, files or directories, to the root directory
+// of the CAR at destCar under their base names, as CreateCarFile does. The
+// file DAGs are built with opts, the new root directory has the CID format
+// of the old one, so the CAR keeps its header size, and keeps any UUID map
+// link. The CAR is written in place and its old and new roots are returned,
+// a piece computed before no longer matches it.
+func AppendCarFile(ctx context.Context, destCar string, srcFiles []string, opts ...Option) (cid.Cid, cid.Cid, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return cid.Undef, cid.Undef, err
+	}
+	if len(srcFiles) == 0 {
+		return cid.Undef, cid.Undef, xerrors.Errorf("no files to append to %s", destCar)
+	}
+
+	f, err := os.Open(destCar)
+	if err != nil {
+		return cid.Undef, cid.Undef, err
+	}
+	version, err := car.ReadVersion(f)
+	f.Close()
+	if err != nil {
+		return cid.Undef, cid.Undef, err
+	}
+	r, err := car.OpenReader(destCar)
+	if err != nil {
+		return cid.Undef, cid.Undef, err
+	}
+	roots, err := r.Roots()
+	header := r.Header
+	r.Close()
+	if err != nil {
+		return cid.Undef, cid.Undef, err
+	}
+	if len(roots) != 1 {
+		return cid.Undef, cid.Undef, xerrors.Errorf("%s does not have exactly one root", destCar)
+	}
+	oldRoot := roots[0]
+
+	for _, src := range srcFiles {
+		if _, err := os.Lstat(src); err != nil {
+			return cid.Undef, cid.Undef, err
+		}
+	}
+
+	snap, err := snapshotCar(destCar, version, header)
+	if err != nil {
+		return cid.Undef, cid.Undef, err
+	}
+	var carOpts []car.Option
+	if version == 1 {
+		carOpts = append(carOpts, blockstore.WriteAsCarV1(true))
+	}
+	// the blocks already in the CAR are kept, new ones are written after them
+	rw, err := blockstore.OpenReadWrite(destCar, roots, carOpts...)
+	if err != nil {
+		if rerr := snap.restore(destCar); rerr != nil {
+			log.GetLog().Error("restore ", destCar, ": ", rerr)
+		}
+		return cid.Undef, cid.Undef, err
+	}
+	newRoot, err := appendFiles(ctx, rw, oldRoot, srcFiles, o)
+	if err == nil {
+		err = rw.Finalize()
+	} else {
+		rw.Discard()
+	}
+	if err != nil {
+		// a failed append leaves the CAR as it was
+		if rerr := snap.restore(destCar); rerr != nil {
+			log.GetLog().Error("restore ", destCar, ": ", rerr)
+		}
+		return cid.Undef, cid.Undef, xerrors.Errorf("append to %s: %w", destCar, err)
+	}
+	if err := car.ReplaceRootsInFile(destCar, []cid.Cid{newRoot}); err != nil {
+		return cid.Undef, cid.Undef, err
+	}
+	return oldRoot, newRoot, nil
+}
+
+// appendFiles writes srcFiles to rw and returns the root directory oldRoot
+// with them added.
+func appendFiles(ctx context.Context, rw *blockstore.ReadWrite, oldRoot cid.Cid, srcFiles []string, o Options) (cid.Cid, error) {
+	// stops the scanning when a file fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	store := &carStore{ReadWrite: rw, dirs: make(map[cid.Cid]blocks.Block)}
+	ds := merkledag.NewDAGService(blockservice.NewWriteThrough(store, nil))
+
+	rootNode, err := ds.Get(ctx, oldRoot)
+	if err != nil {
+		return cid.Undef, err
+	}
+	pn, ok := rootNode.(*merkledag.ProtoNode)
+	if !ok {
+		return cid.Undef, xerrors.Errorf("root %s is not a directory", oldRoot)
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil || (fsn.Type() != unixfs.TDirectory && fsn.Type() != unixfs.THAMTShard) {
+		return cid.Undef, xerrors.Errorf("root %s is not a directory", oldRoot)
+	}
+	links, err := dirLinks(ctx, ds, pn, fsn)
+	if err != nil {
+		return cid.Undef, err
+	}
+	tree := newDirTree()
+	names := make(map[string]bool)
+	for _, l := range links {
+		nd, err := ds.Get(ctx, l.Cid)
+		if err != nil {
+			return cid.Undef, err
+		}
+		tree.addFile(nil, "", l.Name, nd)
+		names[l.Name] = true
+	}
+
+	b := newCarBuilder(ctx, nil, o)
+	cidBuilder, err := o.cidBuilder()
+	if err != nil {
+		return cid.Undef, err
+	}
+	for _, src := range srcFiles {
+		src = filepath.Clean(src)
+		if names[filepath.Base(src)] {
+			return cid.Undef, xerrors.Errorf("%s is already in the CAR", filepath.Base(src))
+		}
+		names[filepath.Base(src)] = true
+		parent := filepath.Dir(src)
+		taken := 0
+		for item := range util.GetFileListAsyncOptions(ctx, []string{src}, false, o.scanOptions()) {
+			taken++
+			nd, err := b.buildFile(item, ds, cidBuilder, nil)
+			if err != nil {
+				return cid.Undef, err
+			}
+			rel, err := filepath.Rel(parent, item.Path)
+			if err != nil {
+				return cid.Undef, err
+			}
+			var dirList []string
+			if dir := filepath.ToSlash(filepath.Dir(rel)); dir != "." {
+				dirList = strings.Split(dir, "/")
+			}
+			tree.addFile(dirList, filepath.Dir(item.Path), item.Name, nd)
+			log.GetLog().Debugf("append %s as %s", item.Path, rel)
+		}
+		if err := ctx.Err(); err != nil {
+			return cid.Undef, err
+		}
+		// scanning does not take an empty directory given itself
+		if info, err := os.Stat(src); taken == 0 && err == nil && info.IsDir() {
+			item := util.Finfo{Path: src, Name: filepath.Base(src), Info: info}
+			nd, err := b.buildFile(item, ds, cidBuilder, nil)
+			if err != nil {
+				return cid.Undef, err
+			}
+			tree.addFile(nil, parent, item.Name, nd)
+		}
+	}
+
+	// the root keeps the CID format of the old one, so the CAR header keeps
+	// its size
+	nd, err := tree.build(ctx, store, oldRoot.Prefix(), o)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// carSnapshot is what appending to a CAR changes before it is finalized: the
+// size and, of a CARv2, the header and the index after the data, which are
+// dropped when the CAR is opened for writing.
+type carSnapshot struct {
+	size   int64
+	head   []byte
+	tail   []byte
+	tailAt int64
+}
+
+func snapshotCar(path string, version uint64, header car.Header) (carSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return carSnapshot{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return carSnapshot{}, err
+	}
+	snap := carSnapshot{size: info.Size(), tailAt: info.Size()}
+	if version == 1 {
+		return snap, nil
+	}
+	snap.tailAt = int64(header.DataOffset + header.DataSize)
+	snap.head = make([]byte, header.DataOffset)
+	if _, err := f.ReadAt(snap.head, 0); err != nil {
+		return carSnapshot{}, err
+	}
+	snap.tail = make([]byte, snap.size-snap.tailAt)
+	if _, err := f.ReadAt(snap.tail, snap.tailAt); err != nil {
+		return carSnapshot{}, err
+	}
+	return snap, nil
+}
+
+// restore puts the CAR at path back to the state of the snapshot.
+func (s carSnapshot) restore(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(s.head, 0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt(s.tail, s.tailAt); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(s.size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
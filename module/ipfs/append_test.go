@@ -0,0 +1,76 @@
+package ipfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendCarFile(t *testing.T) {
+	src := t.TempDir()
+	writeRandomFiles(t, src, map[string]int{"a": 100})
+	result, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 1<<20, true, nil)
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 1)
+	car := result.Cars[0]
+
+	more := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(more, "dir", "sub"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(more, "empty"), 0755))
+	added := writeRandomFiles(t, more, map[string]int{"b": 10, "dir/c": 2000, "dir/sub/d": 20})
+
+	oldRoot, newRoot, err := AppendCarFile(context.Background(), car.CarFilePath, []string{filepath.Join(more, "b"), filepath.Join(more, "dir"), filepath.Join(more, "empty")})
+	require.NoError(t, err)
+	require.Equal(t, car.RootCid, oldRoot.String())
+	root, err := GetCarRoot(car.CarFilePath)
+	require.NoError(t, err)
+	require.Equal(t, newRoot.String(), root)
+
+	// the old files keep their UUIDs
+	entries, err := ListCarEntries(car.CarFilePath)
+	require.NoError(t, err)
+	byPath := map[string]CarEntry{}
+	for _, e := range entries {
+		byPath[e.Path] = e
+	}
+	require.NotEmpty(t, car.Details[0].UUID)
+	require.Equal(t, car.Details[0].UUID, byPath[filepath.Join(src, "a")[1:]].Uuid)
+	require.Equal(t, CarEntryDir, byPath["dir/sub"].Type)
+	require.Equal(t, CarEntryDir, byPath["empty"].Type)
+	require.Equal(t, uint64(10), byPath["b"].Size)
+
+	out := t.TempDir()
+	require.NoError(t, RestoreCar(out, car.CarFilePath))
+	for name, data := range added {
+		got, err := os.ReadFile(filepath.Join(out, name))
+		require.NoError(t, err)
+		require.Equal(t, data, got)
+	}
+	_, err = os.Stat(filepath.Join(out, src, "a"))
+	require.NoError(t, err)
+
+	before, err := os.ReadFile(car.CarFilePath)
+	require.NoError(t, err)
+	_, _, err = AppendCarFile(context.Background(), car.CarFilePath, []string{filepath.Join(more, "b")})
+	require.Error(t, err)
+	// a failed append leaves the CAR as it was
+	after, err := os.ReadFile(car.CarFilePath)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	// so it does with a CARv2 and its index
+	v2 := filepath.Join(t.TempDir(), "v2.car")
+	require.NoError(t, CreateCarFile(v2, []string{filepath.Join(src, "a")}))
+	before, err = os.ReadFile(v2)
+	require.NoError(t, err)
+	_, _, err = AppendCarFile(context.Background(), v2, []string{filepath.Join(more, "dir"), filepath.Join(src, "a")})
+	require.Error(t, err)
+	after, err = os.ReadFile(v2)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	_, _, err = AppendCarFile(context.Background(), v2, []string{filepath.Join(more, "b")})
+	require.NoError(t, err)
+}
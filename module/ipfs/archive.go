@@ -0,0 +1,486 @@
+package ipfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/FogMeta/meta-lib/logs"
+	"github.com/FogMeta/meta-lib/util"
+	"github.com/pborman/uuid"
+	"golang.org/x/xerrors"
+)
+
+// Archive formats read by GenerateCarFromArchive.
+const (
+	ArchiveTar   = "tar"
+	ArchiveTarGz = "tar.gz"
+	ArchiveZip   = "zip"
+)
+
+// ArchiveFormat returns the format of the archive at path told by its
+// extension, .tar, .tar.gz or .tgz and .zip, empty for any other.
+func ArchiveFormat(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return ArchiveTar
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveTarGz
+	case strings.HasSuffix(name, ".zip"):
+		return ArchiveZip
+	}
+	return ""
+}
+
+// GenerateCarFromArchive is GenerateCarFromDirResult for the entries of the
+// tar, tar.gz or zip archive at archivePath, which are read from the archive
+// instead of being extracted to disk. The entries are put in the CARs as
+// the files of a directory at archivePath would be, with their directories,
+// symlinks and, with WithPreserveMode and WithPreserveMtime, their modes and
+// modification times. Symlinks are stored as they are unless
+// WithSymlinks(SymlinkSkip), an archive has nothing to follow them to. A
+// tar.gz is read in order about twice, once to scan it and once to build
+// its CARs; WithPacking and WithDeterministic build the entries in another
+// order, which reads it again from the start for every entry before the one
+// read last.
+func GenerateCarFromArchive(ctx context.Context, outputDir string, archivePath string, sliceSize int64, withUUID bool, progress ProgressFunc, opts ...Option) (BuildResult, error) {
+	result := BuildResult{Cars: make([]CarInfo, 0)}
+	o, err := newOptions(opts...)
+	if err != nil {
+		return result, err
+	}
+	if !util.ExistDir(outputDir) {
+		return result, xerrors.Errorf("Unexpected! The path of output dir does not exist")
+	}
+	if withUUID && o.Deterministic {
+		return result, xerrors.Errorf("random UUIDs can not be used in deterministic mode")
+	}
+	format := ArchiveFormat(archivePath)
+	if format == "" {
+		return result, xerrors.Errorf("%s is no tar, tar.gz or zip archive", archivePath)
+	}
+	filter, err := util.NewPathFilter(o.scanOptions())
+	if err != nil {
+		return result, err
+	}
+
+	a := &archive{
+		path:     filepath.Clean(archivePath),
+		format:   format,
+		withUUID: withUUID,
+		filter:   filter,
+		symlinks: o.Symlinks,
+		dirs:     make(map[string]os.FileInfo),
+		taken:    make(map[string]bool),
+		files:    make(map[string]util.Finfo),
+	}
+	if err := a.open(); err != nil {
+		return result, err
+	}
+	defer a.close()
+	run := struct {
+		Archive   string  `json:"archive"`
+		SliceSize int64   `json:"slice_size"`
+		WithUUID  bool    `json:"with_uuid"`
+		Options   Options `json:"options"`
+	}{archivePath, sliceSize, withUUID, o}
+	return generateCars(ctx, outputDir, sliceSize, progress, o, run, fileSource{scan: a.scan, stat: a.stat})
+}
+
+// archive reads the entries of an archive as files below its path.
+type archive struct {
+	path     string
+	format   string
+	withUUID bool
+	filter   func(rel string, isDir bool) bool
+	symlinks util.SymlinkPolicy
+
+	// data is the archive the data of the entries is read from
+	data    *os.File
+	zip     *zip.ReadCloser
+	gzipped *streamCursor
+
+	lock sync.Mutex
+	// dirs are the directory entries by path, for their metadata
+	dirs map[string]os.FileInfo
+	// taken are the directories something was taken below
+	taken map[string]bool
+	// files are the regular files by path, for the hard links to them
+	files map[string]util.Finfo
+}
+
+func (a *archive) open() error {
+	switch a.format {
+	case ArchiveZip:
+		zr, err := zip.OpenReader(a.path)
+		if err != nil {
+			return xerrors.Errorf("open archive %s: %w", a.path, err)
+		}
+		a.zip = zr
+	case ArchiveTarGz:
+		a.gzipped = &streamCursor{size: -1, open: func() (io.ReadCloser, error) {
+			return openGzip(a.path)
+		}}
+	default:
+		f, err := os.Open(a.path)
+		if err != nil {
+			return err
+		}
+		a.data = f
+	}
+	return nil
+}
+
+func (a *archive) close() {
+	if a.zip != nil {
+		a.zip.Close()
+	}
+	if a.gzipped != nil {
+		a.gzipped.Close()
+	}
+	if a.data != nil {
+		a.data.Close()
+	}
+}
+
+// stat returns the info of the directory entry at path, none for a
+// directory the archive has no entry of.
+func (a *archive) stat(path string) (os.FileInfo, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.dirs[path], nil
+}
+
+func (a *archive) scan(ctx context.Context, onError func(string, error)) <-chan util.Finfo {
+	fichan := make(chan util.Finfo)
+	go func() {
+		defer close(fichan)
+		emit := func(item util.Finfo) bool {
+			if a.withUUID {
+				item.Uuid = uuid.New()
+			}
+			select {
+			case fichan <- item:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		var err error
+		if a.format == ArchiveZip {
+			err = a.scanZip(emit, onError)
+		} else {
+			err = a.scanTar(emit, onError)
+		}
+		if err != nil {
+			log.GetLog().Warn(err)
+			onError(a.path, err)
+			return
+		}
+		if ctx.Err() == nil {
+			a.emptyDirs(emit)
+		}
+	}()
+	return fichan
+}
+
+func (a *archive) scanTar(emit func(util.Finfo) bool, onError func(string, error)) error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cr := &countingReader{r: f}
+	if a.format == ArchiveTarGz {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		cr = &countingReader{r: gz}
+	}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// the data of the entry follows its header
+		offset := cr.pos
+		info := hdr.FileInfo()
+		var open func(start, size int64) (io.ReadCloser, error)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			if isSparse(hdr) {
+				onError(path.Join(a.path, hdr.Name), xerrors.Errorf("sparse file %s is not supported", hdr.Name))
+				continue
+			}
+			open = func(start, size int64) (io.ReadCloser, error) {
+				if a.gzipped != nil {
+					return a.gzipped.at(offset+start, size)
+				}
+				return io.NopCloser(io.NewSectionReader(a.data, offset+start, size)), nil
+			}
+		case tar.TypeLink:
+			if !a.link(hdr.Name, hdr.Linkname, emit, onError) {
+				return nil
+			}
+			continue
+		case tar.TypeDir, tar.TypeSymlink:
+		default:
+			onError(path.Join(a.path, hdr.Name), xerrors.Errorf("%s has an unsupported entry type %q", hdr.Name, hdr.Typeflag))
+			continue
+		}
+		if !a.entry(hdr.Name, info, hdr.Linkname, open, emit) {
+			return nil
+		}
+	}
+}
+
+// isSparse tells whether the data of hdr is not stored in one piece.
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *archive) scanZip(emit func(util.Finfo) bool, onError func(string, error)) error {
+	for _, zf := range a.zip.File {
+		zf := zf
+		info := zf.FileInfo()
+		var link string
+		var open func(start, size int64) (io.ReadCloser, error)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			r, err := zf.Open()
+			if err != nil {
+				onError(path.Join(a.path, zf.Name), err)
+				continue
+			}
+			target, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				onError(path.Join(a.path, zf.Name), err)
+				continue
+			}
+			link = string(target)
+		case info.IsDir():
+		case info.Mode().IsRegular():
+			cursor := &streamCursor{size: int64(zf.UncompressedSize64), open: zf.Open}
+			open = cursor.at
+		default:
+			onError(path.Join(a.path, zf.Name), xerrors.Errorf("%s has an unsupported mode %s", zf.Name, info.Mode()))
+			continue
+		}
+		if !a.entry(zf.Name, info, link, open, emit) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// entry emits the entry name of the archive, unless it is a directory or
+// filtered out. It returns false once scanning has to stop.
+func (a *archive) entry(name string, info os.FileInfo, link string, open func(start, size int64) (io.ReadCloser, error), emit func(util.Finfo) bool) bool {
+	// an entry can not leave the archive
+	rel := strings.Trim(path.Clean("/"+name), "/")
+	if rel == "" || !a.filter(rel, info.IsDir()) {
+		return true
+	}
+	p := path.Join(a.path, rel)
+	if info.IsDir() {
+		a.lock.Lock()
+		a.dirs[p] = info
+		a.lock.Unlock()
+		return true
+	}
+	if link != "" || info.Mode()&os.ModeSymlink != 0 {
+		if a.symlinks == util.SymlinkSkip {
+			return true
+		}
+		open = nil
+	}
+	item := util.Finfo{Path: p, Name: path.Base(rel), Info: info, Link: link, Rel: rel, Open: open}
+	a.lock.Lock()
+	if open != nil {
+		a.files[p] = item
+	}
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		a.taken[dir] = true
+	}
+	a.lock.Unlock()
+	return emit(item)
+}
+
+// link emits the hard link name to the file target read before.
+func (a *archive) link(name, target string, emit func(util.Finfo) bool, onError func(string, error)) bool {
+	a.lock.Lock()
+	item, ok := a.files[path.Join(a.path, strings.Trim(path.Clean("/"+target), "/"))]
+	a.lock.Unlock()
+	if !ok {
+		onError(path.Join(a.path, name), xerrors.Errorf("hard link %s to %s which is not in the archive", name, target))
+		return true
+	}
+	return a.entry(name, item.Info, "", item.Open, emit)
+}
+
+// emptyDirs emits the directory entries nothing was taken below, deepest
+// first.
+func (a *archive) emptyDirs(emit func(util.Finfo) bool) {
+	a.lock.Lock()
+	var dirs []string
+	for p := range a.dirs {
+		dirs = append(dirs, p)
+	}
+	a.lock.Unlock()
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, p := range dirs {
+		rel := strings.TrimPrefix(p, a.path+"/")
+		a.lock.Lock()
+		taken, info := a.taken[rel], a.dirs[p]
+		for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+			a.taken[dir] = true
+		}
+		a.lock.Unlock()
+		if taken {
+			continue
+		}
+		if !emit(util.Finfo{Path: p, Name: path.Base(rel), Info: info, Rel: rel}) {
+			return
+		}
+	}
+}
+
+func openGzip(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+// countingReader counts the bytes read from r, seeking included.
+type countingReader struct {
+	r   io.Reader
+	pos int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+// Seek lets tar skip the data of entries when r can seek.
+func (r *countingReader) Seek(offset int64, whence int) (int64, error) {
+	s, ok := r.r.(io.Seeker)
+	if !ok {
+		return 0, xerrors.Errorf("can not seek")
+	}
+	pos, err := s.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+// streamCursor reads a stream that can only be read from its start, such as
+// a tar.gz or a compressed zip entry. The stream is kept open after a read,
+// so reads in order take one pass over it; a read before the last one opens
+// it again. size closes the stream once it is read to the end, -1 keeps it
+// open until Close.
+type streamCursor struct {
+	lock sync.Mutex
+	open func() (io.ReadCloser, error)
+	size int64
+	r    io.ReadCloser
+	pos  int64
+}
+
+// at returns a reader of size bytes of the stream from offset on. The stream
+// is not read elsewhere until the reader is closed.
+func (c *streamCursor) at(offset, size int64) (io.ReadCloser, error) {
+	c.lock.Lock()
+	if c.r != nil && offset < c.pos {
+		c.reset()
+	}
+	if c.r == nil {
+		r, err := c.open()
+		if err != nil {
+			c.lock.Unlock()
+			return nil, err
+		}
+		c.r, c.pos = r, 0
+	}
+	n, err := io.CopyN(io.Discard, c.r, offset-c.pos)
+	c.pos += n
+	if err != nil {
+		c.reset()
+		c.lock.Unlock()
+		return nil, err
+	}
+	return &cursorReader{c: c, r: io.LimitReader(c.r, size)}, nil
+}
+
+func (c *streamCursor) reset() {
+	if c.r != nil {
+		c.r.Close()
+		c.r = nil
+	}
+}
+
+func (c *streamCursor) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reset()
+	return nil
+}
+
+type cursorReader struct {
+	c      *streamCursor
+	r      io.Reader
+	closed bool
+}
+
+func (r *cursorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.c.pos += int64(n)
+	return n, err
+}
+
+func (r *cursorReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if r.c.size >= 0 && r.c.pos >= r.c.size {
+		r.c.reset()
+	}
+	r.c.lock.Unlock()
+	return nil
+}
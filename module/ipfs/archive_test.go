@@ -0,0 +1,107 @@
+package ipfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateCarFromArchive(t *testing.T) {
+	big := make([]byte, 5000)
+	_, err := rand.Read(big)
+	require.NoError(t, err)
+	mtime := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	entries := []*tar.Header{
+		{Name: "data/", Typeflag: tar.TypeDir, Mode: 0750},
+		{Name: "data/big", Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(big))},
+		{Name: "data/empty/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "small", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "zero", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "small"},
+		{Name: ".hidden", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+	}
+	contents := map[string][]byte{"data/big": big, "small": []byte("small"), ".hidden": []byte("hides")}
+
+	dir := t.TempDir()
+	var tarData bytes.Buffer
+	tw := tar.NewWriter(&tarData)
+	for _, hdr := range entries {
+		hdr.ModTime = mtime
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write(contents[hdr.Name])
+		require.NoError(t, err)
+	}
+	// a hard link has the data of its target
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "small", ModTime: mtime}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "in.tar"), tarData.Bytes(), 0644))
+	var gzData bytes.Buffer
+	gw := gzip.NewWriter(&gzData)
+	_, err = gw.Write(tarData.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "in.tgz"), gzData.Bytes(), 0644))
+	var zipData bytes.Buffer
+	zw := zip.NewWriter(&zipData)
+	for _, hdr := range entries {
+		fh, err := zip.FileInfoHeader(hdr.FileInfo())
+		require.NoError(t, err)
+		fh.Name, fh.Method = hdr.Name, zip.Deflate
+		w, err := zw.CreateHeader(fh)
+		require.NoError(t, err)
+		data := contents[hdr.Name]
+		if hdr.Typeflag == tar.TypeSymlink {
+			data = []byte(hdr.Linkname)
+		}
+		_, err = w.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "in.zip"), zipData.Bytes(), 0644))
+
+	for _, name := range []string{"in.tar", "in.tgz", "in.zip"} {
+		result, err := GenerateCarFromArchive(context.Background(), t.TempDir(), filepath.Join(dir, name), 2048, false, nil,
+			WithPathLayout(PathLayoutRelative), WithPreserveMode(true), WithPreserveMtime(true))
+		require.NoError(t, err, name)
+		require.Greater(t, len(result.Cars), 2, name)
+		require.Empty(t, result.Skipped, name)
+
+		out := t.TempDir()
+		require.NoError(t, RestoreCar(out, filepath.Dir(result.Cars[0].CarFilePath)))
+		for file, data := range map[string][]byte{"data/big": big, "small": []byte("small"), "zero": {}} {
+			got, err := os.ReadFile(filepath.Join(out, file))
+			require.NoError(t, err, name, file)
+			require.Equal(t, data, got, name, file)
+		}
+		if name != "in.zip" {
+			got, err := os.ReadFile(filepath.Join(out, "hard"))
+			require.NoError(t, err, name)
+			require.Equal(t, []byte("small"), got)
+		}
+		target, err := os.Readlink(filepath.Join(out, "link"))
+		require.NoError(t, err, name)
+		require.Equal(t, "small", target)
+		info, err := os.Stat(filepath.Join(out, "data", "empty"))
+		require.NoError(t, err, name)
+		require.True(t, info.IsDir())
+		require.Equal(t, os.FileMode(0700), info.Mode().Perm(), name)
+		info, err = os.Stat(filepath.Join(out, "small"))
+		require.NoError(t, err, name)
+		require.Equal(t, os.FileMode(0644), info.Mode().Perm(), name)
+		require.True(t, mtime.Equal(info.ModTime()), name)
+		_, err = os.Stat(filepath.Join(out, ".hidden"))
+		require.True(t, os.IsNotExist(err), name)
+	}
+
+	_, err = GenerateCarFromArchive(context.Background(), t.TempDir(), filepath.Join(dir, "in.rar"), 2048, false, nil)
+	require.Error(t, err)
+}
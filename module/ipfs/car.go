@@ -15,6 +15,7 @@ import (
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
 	"io"
 	"path"
 )
@@ -128,56 +129,309 @@ func ExtractCarFile(destDir string, srcCar string) error {
 	return nil
 }
 
-func printLinksNode(prefix string, node cid.Cid, ls *ipld.LinkSystem, infoList *[]string) error {
-	// it might be a raw file (bytes) node. if so, not actually an error.
-	if node.Prefix().Codec == cid.Raw {
-		return nil
+// CarEntryType is the kind of an entry listed by ListCarEntries.
+type CarEntryType string
+
+const (
+	CarEntryFile    CarEntryType = "file"
+	CarEntryDir     CarEntryType = "dir"
+	CarEntrySymlink CarEntryType = "symlink"
+)
+
+// CarEntry is a file, directory or symlink found below the root directory of
+// a CAR.
+type CarEntry struct {
+	// Path is the path of the entry in the CAR, without the root directory.
+	Path string       `json:"path"`
+	Cid  string       `json:"cid"`
+	Uuid string       `json:"uuid,omitempty"`
+	Type CarEntryType `json:"type"`
+	// Size is the content size: the bytes of a file, the length of the
+	// target of a symlink and the sum of the sizes of the entries of a
+	// directory.
+	Size uint64 `json:"size"`
+	// DagSize is the cumulative size of the blocks of the entry, as recorded
+	// in the link from its parent.
+	DagSize uint64 `json:"dag_size"`
+	// Blocks is the number of distinct blocks of the DAG of the entry. The
+	// count of a directory adds up the ones of its entries, so a block two
+	// entries share counts for both.
+	Blocks int64 `json:"blocks"`
+	// Children are the entries of a directory, only set by ListCarTree.
+	Children []*CarEntry `json:"children,omitempty"`
+}
+
+// ListCarEntries returns the entries of the CAR at destCar, every directory
+// being followed by its entries.
+func ListCarEntries(destCar string) ([]CarEntry, error) {
+	tree, err := ListCarTree(destCar)
+	if err != nil {
+		return nil, err
 	}
+	var entries []CarEntry
+	var walk func([]*CarEntry)
+	walk = func(nodes []*CarEntry) {
+		for _, e := range nodes {
+			entry := *e
+			entry.Children = nil
+			entries = append(entries, entry)
+			walk(e.Children)
+		}
+	}
+	walk(tree)
+	return entries, nil
+}
 
-	pbn, err := ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: node}, dagpb.Type.PBNode)
+// ListCarTree returns the entries of the root directory of the CAR at
+// destCar, with the entries of every directory as its children.
+func ListCarTree(destCar string) ([]*CarEntry, error) {
+	bs, err := blockstore.OpenReadOnly(destCar)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer bs.Close()
 
-	pbnode := pbn.(dagpb.PBNode)
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	ls.TrustedStorage = true
+	ls.StorageReadOpener = func(_ ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		cl, ok := l.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("not a cidlink")
+		}
+		blk, err := bs.Get(ctx, cl.Cid)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewBuffer(blk.RawData()), nil
+	}
 
+	roots, err := bs.Roots()
+	if err != nil {
+		return nil, err
+	}
+	l := &carLister{ctx: ctx, ls: &ls, bs: bs}
+
+	var tree []*CarEntry
+	for _, r := range roots {
+		// a raw root is a file without a name, it has no entries
+		if r.Prefix().Codec == cid.Raw {
+			continue
+		}
+		if l.uuids, l.uuidMap, err = ReadUuidMap(ctx, bs, r); err != nil {
+			return nil, err
+		}
+		pbnode, ufd, err := l.load(r)
+		if err != nil {
+			return nil, err
+		}
+		if ufd.FieldDataType().Int() != data.Data_Directory && ufd.FieldDataType().Int() != data.Data_HAMTShard {
+			continue
+		}
+		entries, _, _, err := l.dirEntries("", pbnode, ufd)
+		if err != nil {
+			return nil, err
+		}
+		tree = append(tree, entries...)
+	}
+	return tree, nil
+}
+
+// carLister walks the UnixFS DAG of a CAR for ListCarTree.
+type carLister struct {
+	ctx context.Context
+	ls  *ipld.LinkSystem
+	bs  interface {
+		GetSize(context.Context, cid.Cid) (int, error)
+	}
+	uuids map[string]string
+	// uuidMap is the link to the UUID map in the root directory
+	uuidMap cid.Cid
+}
+
+func (l *carLister) load(c cid.Cid) (dagpb.PBNode, data.UnixFSData, error) {
+	pbn, err := l.ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: c}, dagpb.Type.PBNode)
+	if err != nil {
+		return nil, nil, err
+	}
+	pbnode := pbn.(dagpb.PBNode)
+	if !pbnode.Data.Exists() {
+		return nil, nil, xerrors.Errorf("node %s has no unixfs data", c)
+	}
 	ufd, err := data.DecodeUnixFSData(pbnode.Data.Must().Bytes())
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if ufd.FieldDataType().Int() == data.Data_Directory {
-		i := pbnode.Links.Iterator()
-		for !i.Done() {
-			_, l := i.Next()
-			name := path.Join(prefix, l.Name.Must().String())
-			size := l.Tsize.Must().Int()
-			nameLen := len(name)
-			uuid := ""
-			uuidLen := len("ce547c40-acf9-11e6-80f5-76304dec7eb7")
-			// TODO: split uuid string and check it
-			if nameLen > uuidLen {
-				uuid = name[nameLen-uuidLen+1:]
-				name = name[:nameLen-uuidLen]
-			}
+	return pbnode, ufd, nil
+}
 
-			// recurse into the file/directory
-			cl, err := l.Hash.AsLink()
-			if err != nil {
-				return err
-			}
-			if cidl, ok := cl.(cidlink.Link); ok {
-				info := fmt.Sprintf("%s     CID:%s     UUID:%s     SIZE:%d\n", name, cidl.Cid, uuid, size)
-				*infoList = append(*infoList, info)
-				if err := printLinksNode(name, cidl.Cid, ls, infoList); err != nil {
-					return err
-				}
+// dirEntries returns the entries of a directory at prefix, with their total
+// size and number of blocks, including the ones of the directory itself.
+// Without a UUID map the UUIDs are taken from the end of the names, as older
+// CARs have them.
+func (l *carLister) dirEntries(prefix string, pbnode dagpb.PBNode, ufd data.UnixFSData) ([]*CarEntry, uint64, int64, error) {
+	var entries []*CarEntry
+	var size uint64
+	shards, err := forEachDirLink(pbnode, ufd, l.ls, func(linkName string, link dagpb.PBLink) error {
+		if prefix == "" && l.uuidMap.Defined() {
+			if cl, err := link.Hash.AsLink(); err == nil && cl.(cidlink.Link).Cid == l.uuidMap {
+				return nil
 			}
-
 		}
-	} else {
-		// file, file chunk, symlink, other un-named entities.
+		name := path.Join(prefix, linkName)
+		uuid := l.uuids[name]
+		if len(l.uuids) == 0 {
+			name, uuid = SplitLegacyUuid(name)
+		}
+		e, err := l.entry(name, link)
+		if err != nil {
+			return err
+		}
+		e.Uuid = uuid
+		size += e.Size
+		entries = append(entries, e)
 		return nil
+	})
+	if err != nil {
+		return nil, 0, 0, err
 	}
+	blocks := 1 + shards
+	for _, e := range entries {
+		blocks += e.Blocks
+	}
+	return entries, size, blocks, nil
+}
 
-	return nil
+func (l *carLister) entry(name string, link dagpb.PBLink) (*CarEntry, error) {
+	cl, err := link.Hash.AsLink()
+	if err != nil {
+		return nil, err
+	}
+	c := cl.(cidlink.Link).Cid
+	e := &CarEntry{Path: name, Cid: c.String(), Type: CarEntryFile}
+	if link.Tsize.Exists() {
+		e.DagSize = uint64(link.Tsize.Must().Int())
+	}
+	if c.Prefix().Codec == cid.Raw {
+		size, err := l.bs.GetSize(l.ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		e.Size, e.Blocks = uint64(size), 1
+		return e, nil
+	}
+
+	pbnode, ufd, err := l.load(c)
+	if err != nil {
+		return nil, err
+	}
+	switch ufd.FieldDataType().Int() {
+	case data.Data_Directory, data.Data_HAMTShard:
+		e.Type = CarEntryDir
+		e.Children, e.Size, e.Blocks, err = l.dirEntries(name, pbnode, ufd)
+		return e, err
+	case data.Data_Symlink:
+		e.Type, e.Blocks = CarEntrySymlink, 1
+		if ufd.FieldData().Exists() {
+			e.Size = uint64(len(ufd.FieldData().Must().Bytes()))
+		}
+		return e, nil
+	}
+	if ufd.FieldFileSize().Exists() {
+		e.Size = uint64(ufd.FieldFileSize().Must().Int())
+	} else if ufd.FieldData().Exists() {
+		e.Size = uint64(len(ufd.FieldData().Must().Bytes()))
+	}
+	e.Blocks, err = l.countBlocks(pbnode, make(map[cid.Cid]bool))
+	return e, err
+}
+
+// countBlocks returns the number of blocks of a file DAG, seen holding the
+// ones already counted. A child whose cumulative size is the size of its
+// block has no links, so leaves are counted without being read.
+func (l *carLister) countBlocks(pbnode dagpb.PBNode, seen map[cid.Cid]bool) (int64, error) {
+	blocks := int64(1)
+	i := pbnode.Links.Iterator()
+	for !i.Done() {
+		_, link := i.Next()
+		cl, err := link.Hash.AsLink()
+		if err != nil {
+			return 0, err
+		}
+		c := cl.(cidlink.Link).Cid
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		if c.Prefix().Codec != cid.DagProtobuf {
+			blocks++
+			continue
+		}
+		size, err := l.bs.GetSize(l.ctx, c)
+		if err != nil {
+			return 0, err
+		}
+		if link.Tsize.Exists() && link.Tsize.Must().Int() <= int64(size) {
+			blocks++
+			continue
+		}
+		child, _, err := l.load(c)
+		if err != nil {
+			return 0, err
+		}
+		n, err := l.countBlocks(child, seen)
+		if err != nil {
+			return 0, err
+		}
+		blocks += n
+	}
+	return blocks, nil
+}
+
+// forEachDirLink calls f with the name and link of every entry of a directory
+// node, walking down the shards of a HAMT directory, and returns the number of
+// child shards it went through.
+func forEachDirLink(pbnode dagpb.PBNode, ufd data.UnixFSData, ls *ipld.LinkSystem, f func(name string, l dagpb.PBLink) error) (int64, error) {
+	var shards int64
+	padLen := 0
+	if ufd.FieldDataType().Int() == data.Data_HAMTShard {
+		padLen = len(fmt.Sprintf("%X", ufd.FieldFanout().Must().Int()-1))
+	}
+	i := pbnode.Links.Iterator()
+	for !i.Done() {
+		_, l := i.Next()
+		name := l.Name.Must().String()
+		if padLen == 0 {
+			if err := f(name, l); err != nil {
+				return shards, err
+			}
+			continue
+		}
+		if len(name) > padLen {
+			if err := f(name[padLen:], l); err != nil {
+				return shards, err
+			}
+			continue
+		}
+		// a link with only the index prefix is a child shard
+		cl, err := l.Hash.AsLink()
+		if err != nil {
+			return shards, err
+		}
+		child, err := ls.Load(ipld.LinkContext{}, cl, dagpb.Type.PBNode)
+		if err != nil {
+			return shards, err
+		}
+		childNode := child.(dagpb.PBNode)
+		childData, err := data.DecodeUnixFSData(childNode.Data.Must().Bytes())
+		if err != nil {
+			return shards, err
+		}
+		n, err := forEachDirLink(childNode, childData, ls, f)
+		shards += 1 + n
+		if err != nil {
+			return shards, err
+		}
+	}
+	return shards, nil
 }
@@ -0,0 +1,123 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListCarEntries(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(src, "many"), 0755))
+	for i := 0; i < 300; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(src, "many", fmt.Sprintf("file-%d", i)), []byte("x"), 0644))
+	}
+	writeRandomFiles(t, src, map[string]int{"big": 1000, "small": 10})
+	require.NoError(t, os.Symlink("big", filepath.Join(src, "link")))
+
+	result, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 1<<20, false, nil,
+		WithCidVersion(1), WithRawLeaves(true), WithChunkSize(256), WithShardSize(1024), WithSymlinks(SymlinkStore))
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 1)
+
+	entries, err := ListCarEntries(result.Cars[0].CarFilePath)
+	require.NoError(t, err)
+	prefix := strings.TrimPrefix(src, "/") + "/"
+	byName := map[string]CarEntry{}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Path, prefix) {
+			byName[strings.TrimPrefix(e.Path, prefix)] = e
+		}
+	}
+	require.Len(t, byName, 300+4)
+
+	big := byName["big"]
+	require.Equal(t, CarEntryFile, big.Type)
+	require.Equal(t, uint64(1000), big.Size)
+	require.Equal(t, int64(5), big.Blocks)
+	require.Greater(t, big.DagSize, uint64(1000))
+	c, err := cid.Decode(big.Cid)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), c.Version())
+
+	small := byName["small"]
+	require.Equal(t, CarEntryFile, small.Type)
+	require.Equal(t, uint64(10), small.Size)
+	require.Equal(t, int64(1), small.Blocks)
+	c, err = cid.Decode(small.Cid)
+	require.NoError(t, err)
+	require.Equal(t, uint64(cid.Raw), c.Type())
+
+	link := byName["link"]
+	require.Equal(t, CarEntrySymlink, link.Type)
+	require.Equal(t, uint64(len("big")), link.Size)
+
+	many := byName["many"]
+	require.Equal(t, CarEntryDir, many.Type)
+	require.Equal(t, uint64(300), many.Size)
+	// the HAMT shards count besides the files
+	require.Greater(t, many.Blocks, int64(300+1))
+	require.Equal(t, CarEntryFile, byName["many/file-7"].Type)
+
+	tree, err := ListCarTree(result.Cars[0].CarFilePath)
+	require.NoError(t, err)
+	// walk down the directories of the path of src
+	for len(tree) == 1 {
+		tree = tree[0].Children
+	}
+	require.Len(t, tree, 4)
+	require.Len(t, tree[2].Children, 300)
+
+	list, err := ListCarFile(result.Cars[0].CarFilePath)
+	require.NoError(t, err)
+	require.Len(t, list, len(entries))
+}
+
+func TestRestoreCarErrors(t *testing.T) {
+	src := t.TempDir()
+	writeRandomFiles(t, src, map[string]int{"big": 100000, "small": 10})
+	result, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 1<<20, false, nil)
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 1)
+
+	data, err := os.ReadFile(result.Cars[0].CarFilePath)
+	require.NoError(t, err)
+	broken := filepath.Join(t.TempDir(), "broken.car")
+	require.NoError(t, os.WriteFile(broken, data[:len(data)/2], 0644))
+
+	err = RestoreCar(t.TempDir(), broken)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), broken)
+	require.Error(t, ExtractFileFromCar(t.TempDir(), broken, "big"))
+
+	// the files of a good CAR can not be written over a regular file
+	out := filepath.Join(t.TempDir(), "out")
+	require.NoError(t, os.WriteFile(out, nil, 0644))
+	require.Error(t, RestoreCar(out, result.Cars[0].CarFilePath))
+	require.NoError(t, RestoreCar(t.TempDir(), result.Cars[0].CarFilePath))
+}
+
+func TestListCarEntriesSharedBlocks(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "zeros"), make([]byte, 2048), 0644))
+
+	result, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 1<<20, false, nil,
+		WithCidVersion(1), WithRawLeaves(true), WithChunkSize(256))
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 1)
+
+	entries, err := ListCarEntries(result.Cars[0].CarFilePath)
+	require.NoError(t, err)
+	// the eight chunks are the same block
+	zeros := entries[len(entries)-1]
+	require.Equal(t, "zeros", path.Base(zeros.Path))
+	require.Equal(t, uint64(2048), zeros.Size)
+	require.Equal(t, int64(2), zeros.Blocks)
+}
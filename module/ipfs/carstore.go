@@ -0,0 +1,180 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+
+	"github.com/FogMeta/meta-lib/module/commp"
+	"github.com/FogMeta/meta-lib/util"
+	"github.com/filecoin-project/go-state-types/abi"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	gocar "github.com/ipld/go-car"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	"golang.org/x/xerrors"
+)
+
+// carStore is a blockstore that writes every block straight into a CARv1 file
+// on disk as it is produced, so building a slice no longer needs the whole
+// slice in memory. Directory nodes are the only blocks read back while
+// building, so they are kept in a small in-memory cache. The written bytes are
+// hashed into the piece commitment at the same time.
+type carStore struct {
+	*blockstore.ReadWrite
+	f        *os.File
+	commp    *commp.Writer
+	progress ProgressFunc
+
+	putLock sync.Mutex
+	// dedup is the size of the blocks which were put again and not written
+	dedup int64
+	lock  sync.RWMutex
+	dirs  map[cid.Cid]blocks.Block
+}
+
+// newCarStore creates a temporary CAR file in carDir. The header carries a
+// placeholder root built with cidBuilder, so that it has the same length as
+// the real root which is patched in by finalize.
+func newCarStore(carDir string, cidBuilder cid.Builder) (*carStore, error) {
+	proxyRoot, err := cidBuilder.Sum([]byte{})
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(carDir, "*.car.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	headerSize, err := gocar.HeaderSize(&gocar.CarHeader{Roots: []cid.Cid{proxyRoot}, Version: 1})
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	rw, err := blockstore.OpenReadWriteFile(f, []cid.Cid{proxyRoot}, blockstore.WriteAsCarV1(true))
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &carStore{
+		ReadWrite: rw,
+		f:         f,
+		commp:     commp.NewWriter(int(headerSize)),
+		dirs:      make(map[cid.Cid]blocks.Block),
+	}, nil
+}
+
+func (s *carStore) Put(ctx context.Context, blk blocks.Block) error {
+	return s.PutMany(ctx, []blocks.Block{blk})
+}
+
+// PutMany writes the blocks which are not in the CAR yet, and feeds the exact
+// sections appended to the CAR into the piece commitment.
+func (s *carStore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	s.putLock.Lock()
+	defer s.putLock.Unlock()
+	for _, blk := range blks {
+		has, err := s.ReadWrite.Has(ctx, blk.Cid())
+		if err != nil {
+			return err
+		}
+		if has {
+			s.dedup += int64(len(blk.RawData()))
+			continue
+		}
+		if err := s.ReadWrite.Put(ctx, blk); err != nil {
+			return err
+		}
+		// a CAR appended to has no piece commitment
+		if s.commp != nil {
+			if err := util.LdWrite(s.commp, blk.Cid().Bytes(), blk.RawData()); err != nil {
+				return err
+			}
+		}
+		s.progress.report(ProgressEvent{Type: ProgressBlockWritten, Cid: blk.Cid().String(), Bytes: int64(len(blk.RawData()))})
+	}
+	return nil
+}
+
+// PutDir writes a directory node and keeps it cached for later reads.
+func (s *carStore) PutDir(ctx context.Context, nd ipld.Node) error {
+	if err := s.Put(ctx, nd); err != nil {
+		return err
+	}
+	s.cacheDir(nd)
+	return nil
+}
+
+// cacheDir keeps a directory node which was already written cached.
+func (s *carStore) cacheDir(nd ipld.Node) {
+	s.lock.Lock()
+	s.dirs[nd.Cid()] = nd
+	s.lock.Unlock()
+}
+
+func (s *carStore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	s.lock.RLock()
+	blk, ok := s.dirs[c]
+	s.lock.RUnlock()
+	if ok {
+		return blk, nil
+	}
+	return s.ReadWrite.Get(ctx, c)
+}
+
+// finalize closes the CAR and sets its root, the CAR stays at its temporary
+// path until place. It returns the piece CID and piece size of the finished
+// CAR.
+func (s *carStore) finalize(root cid.Cid) (cid.Cid, abi.PaddedPieceSize, error) {
+	tmpPath := s.f.Name()
+	if err := s.ReadWrite.Finalize(); err != nil {
+		s.f.Close()
+		os.Remove(tmpPath)
+		return cid.Undef, 0, err
+	}
+	if err := s.f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return cid.Undef, 0, err
+	}
+	if err := car.ReplaceRootsInFile(tmpPath, []cid.Cid{root}); err != nil {
+		os.Remove(tmpPath)
+		return cid.Undef, 0, xerrors.Errorf("replace car root: %w", err)
+	}
+
+	var header bytes.Buffer
+	if err := gocar.WriteHeader(&gocar.CarHeader{Roots: []cid.Cid{root}, Version: 1}, &header); err != nil {
+		os.Remove(tmpPath)
+		return cid.Undef, 0, err
+	}
+	pieceCid, pieceSize, err := s.commp.Sum(header.Bytes())
+	if err != nil {
+		os.Remove(tmpPath)
+		return cid.Undef, 0, err
+	}
+	return pieceCid, pieceSize, nil
+}
+
+// place moves the finalized CAR to carPath, or removes it when that fails.
+func (s *carStore) place(carPath string) error {
+	if err := os.Rename(s.f.Name(), carPath); err != nil {
+		os.Remove(s.f.Name())
+		return err
+	}
+	return nil
+}
+
+// discard drops the partially written CAR.
+func (s *carStore) discard() {
+	s.ReadWrite.Discard()
+	s.f.Close()
+	os.Remove(s.f.Name())
+}
@@ -0,0 +1,55 @@
+package ipfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeterministicCars(t *testing.T) {
+	src := t.TempDir()
+	for _, dir := range []string{"a", "a/b", "c", "d/e/f"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(src, dir), 0755))
+	}
+	writeRandomFiles(t, src, map[string]int{
+		"a/1": 3000, "a/2": 100, "a/b/3": 7000, "c/4": 20000, "c/5": 1, "d/e/f/6": 9000, "7": 4096,
+	})
+	// duplicate blocks are written once, whichever file comes first
+	dup, err := os.ReadFile(filepath.Join(src, "c/4"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a/b/dup"), dup, 0644))
+
+	opts := []Option{WithDeterministic(true), WithChunkSize(1024), WithMaxLinks(4)}
+	run := func(opts ...Option) ([]string, []string) {
+		result, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 16<<10, false, nil, opts...)
+		require.NoError(t, err)
+		var roots, sums []string
+		for _, car := range result.Cars {
+			data, err := os.ReadFile(car.CarFilePath)
+			require.NoError(t, err)
+			sum := sha256.Sum256(data)
+			roots = append(roots, car.RootCid)
+			sums = append(sums, hex.EncodeToString(sum[:]))
+		}
+		return roots, sums
+	}
+	roots, sums := run(opts...)
+	require.Greater(t, len(roots), 1)
+	for i := 0; i < 5; i++ {
+		gotRoots, gotSums := run(opts...)
+		require.Equal(t, roots, gotRoots)
+		require.Equal(t, sums, gotSums)
+	}
+	packedRoots, packedSums := run(append(opts, WithPacking(true))...)
+	gotRoots, gotSums := run(append(opts, WithPacking(true))...)
+	require.Equal(t, packedRoots, gotRoots)
+	require.Equal(t, packedSums, gotSums)
+
+	_, err = GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 16<<10, true, nil, opts...)
+	require.Error(t, err)
+}
@@ -0,0 +1,155 @@
+package ipfs
+
+import (
+	"context"
+	"os"
+	"path"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfs/hamt"
+	uio "github.com/ipfs/go-unixfs/io"
+	"golang.org/x/xerrors"
+)
+
+type dirEntry struct {
+	name string
+	node ipld.Node
+}
+
+// dirTree collects the entries of every directory of a CAR first, so each
+// directory node is built once and can be sharded when it turns out too big.
+type dirTree struct {
+	files map[string][]dirEntry
+	dirs  map[string][]string
+	// paths are the source directories, to read their metadata from with
+	// stat, which gives no info for a directory without metadata. A
+	// directory which is no single source directory has an empty path.
+	paths map[string]string
+	stat  func(path string) (os.FileInfo, error)
+}
+
+func newDirTree() *dirTree {
+	return &dirTree{
+		files: map[string][]dirEntry{rootKey: nil},
+		dirs:  make(map[string][]string),
+		paths: make(map[string]string),
+		stat:  os.Stat,
+	}
+}
+
+// dir keys are slash joined paths, so the empty key can not clash with any of them
+const rootKey = ""
+
+// addFile adds a file node below the directories of dirList, which start at
+// the root. srcDir is the directory the file is read from, the last one of
+// dirList, or empty when dirList are not its source directories.
+func (t *dirTree) addFile(dirList []string, srcDir, name string, nd ipld.Node) {
+	parentKey := rootKey
+	for i, dir := range dirList {
+		key := getDirKey(dirList, i)
+		src := ""
+		if srcDir != "" {
+			src = srcDir
+			for j := len(dirList) - 1; j > i; j-- {
+				src = path.Dir(src)
+			}
+		}
+		if _, ok := t.files[key]; !ok {
+			t.files[key] = nil
+			t.dirs[parentKey] = append(t.dirs[parentKey], dir)
+			t.paths[key] = src
+		} else if t.paths[key] != src {
+			t.paths[key] = ""
+		}
+		parentKey = key
+	}
+	t.files[parentKey] = append(t.files[parentKey], dirEntry{name: name, node: nd})
+}
+
+// build builds the directory nodes bottom up and writes them to store. A
+// directory whose links are estimated to reach o.ShardSize bytes becomes a
+// HAMT shard, as `ipfs add` does; a ShardSize of 0 never shards. Sharded
+// directories and the root do not get metadata.
+func (t *dirTree) build(ctx context.Context, store *carStore, cidBuilder cid.Builder, o Options) (*dag.ProtoNode, error) {
+	return t.buildDir(ctx, rootKey, store, cidBuilder, o)
+}
+
+func (t *dirTree) buildDir(ctx context.Context, key string, store *carStore, cidBuilder cid.Builder, o Options) (*dag.ProtoNode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries := append([]dirEntry(nil), t.files[key]...)
+	for _, name := range t.dirs[key] {
+		childKey := name
+		if key != rootKey {
+			childKey = key + "/" + name
+		}
+		nd, err := t.buildDir(ctx, childKey, store, cidBuilder, o)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, dirEntry{name: name, node: nd})
+	}
+
+	size := 0
+	for _, e := range entries {
+		size += len(e.name) + e.node.Cid().ByteLen()
+	}
+	if o.ShardSize > 0 && size >= o.ShardSize {
+		return buildShard(ctx, entries, store, cidBuilder)
+	}
+
+	nd := unixfs.EmptyDirNode()
+	nd.SetCidBuilder(cidBuilder)
+	for _, e := range entries {
+		if err := nd.AddNodeLink(e.name, e.node); err != nil {
+			return nil, err
+		}
+	}
+	if key != rootKey && t.paths[key] != "" && (o.PreserveMode || o.PreserveMtime) {
+		info, err := t.stat(t.paths[key])
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			if nd, err = o.withMetadata(nd, info); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := store.PutDir(ctx, nd); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
+
+func buildShard(ctx context.Context, entries []dirEntry, store *carStore, cidBuilder cid.Builder) (*dag.ProtoNode, error) {
+	// the shard adds every entry again, so skip blocks the store already has
+	// instead of counting them as duplicates
+	ds := dag.NewDAGService(blockservice.New(store, nil))
+	shard, err := hamt.NewShard(ds, uio.DefaultShardWidth)
+	if err != nil {
+		return nil, err
+	}
+	shard.SetCidBuilder(cidBuilder)
+	for _, e := range entries {
+		if err := shard.Set(ctx, e.name, e.node); err != nil {
+			return nil, err
+		}
+	}
+	// Node writes all shard nodes through ds
+	nd, err := shard.Node()
+	if err != nil {
+		return nil, err
+	}
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil, xerrors.Errorf("shard node should be *dag.ProtoNode")
+	}
+	store.cacheDir(pn)
+	return pn, nil
+}
@@ -0,0 +1,68 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FogMeta/meta-lib/util"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedDir(t *testing.T) {
+	src := t.TempDir()
+	dir := filepath.Join(src, "many")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	var fileList []util.Finfo
+	for i := 0; i < 500; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file-%d", i))
+		require.NoError(t, os.WriteFile(path, []byte(path), 0644))
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		fileList = append(fileList, util.Finfo{Path: path, Name: info.Name(), Info: info})
+	}
+
+	o, err := newOptions(WithShardSize(1024))
+	require.NoError(t, err)
+	root, carInfo, _, err := newCarBuilder(context.Background(), nil, o).buildCar(fileList, src, t.TempDir(), 4)
+	require.NoError(t, err)
+	require.Len(t, root.Links(), 1)
+
+	// the big directory is sharded, the root is small enough not to be
+	fsn, err := unixfs.FSNodeFromBytes(root.Data())
+	require.NoError(t, err)
+	require.Equal(t, unixfs.TDirectory, fsn.Type())
+	bs, err := blockstore.OpenReadOnly(carInfo.CarFilePath)
+	require.NoError(t, err)
+	defer bs.Close()
+	blk, err := bs.Get(context.Background(), root.Links()[0].Cid)
+	require.NoError(t, err)
+	nd, err := dag.DecodeProtobuf(blk.RawData())
+	require.NoError(t, err)
+	fsn, err = unixfs.FSNodeFromBytes(nd.Data())
+	require.NoError(t, err)
+	require.Equal(t, unixfs.THAMTShard, fsn.Type())
+
+	list, err := ListCarFile(carInfo.CarFilePath)
+	require.NoError(t, err)
+	require.Len(t, list, len(fileList)+1)
+
+	out := t.TempDir()
+	require.NoError(t, RestoreCar(out, carInfo.CarFilePath))
+	for _, item := range fileList {
+		data, err := os.ReadFile(filepath.Join(out, "many", item.Name))
+		require.NoError(t, err)
+		require.Equal(t, item.Path, string(data))
+	}
+
+	out = filepath.Join(t.TempDir(), "extract")
+	require.NoError(t, ExtractFileFromCar(out, carInfo.CarFilePath, "file-7"))
+	data, err := os.ReadFile(filepath.Join(out, "many", "file-7"))
+	require.NoError(t, err)
+	require.Equal(t, fileList[7].Path, string(data))
+}
@@ -0,0 +1,59 @@
+package ipfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmptyDirsAndFiles(t *testing.T) {
+	src := t.TempDir()
+	for _, dir := range []string{"a/empty", "b", "e/sub/empty"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(src, dir), 0755))
+	}
+	writeRandomFiles(t, src, map[string]int{"a/zero": 0, "c": 100})
+
+	result, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 1<<20, false, nil, WithPathLayout(PathLayoutRelative))
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 1)
+	entries, err := ListCarEntries(result.Cars[0].CarFilePath)
+	require.NoError(t, err)
+	byPath := make(map[string]CarEntry)
+	for _, e := range entries {
+		byPath[e.Path] = e
+	}
+	for _, dir := range []string{"a/empty", "b", "e/sub/empty"} {
+		require.Equal(t, CarEntryDir, byPath[dir].Type, dir)
+	}
+	zero := byPath["a/zero"]
+	require.Equal(t, CarEntryFile, zero.Type)
+	require.Equal(t, uint64(0), zero.Size)
+	// the CID `ipfs add` gives an empty file
+	require.Equal(t, "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH", zero.Cid)
+
+	out := t.TempDir()
+	require.NoError(t, RestoreCar(out, result.Cars[0].CarFilePath))
+	for _, dir := range []string{"a/empty", "b", "e/sub/empty"} {
+		names, err := os.ReadDir(filepath.Join(out, dir))
+		require.NoError(t, err)
+		require.Empty(t, names)
+	}
+	info, err := os.Stat(filepath.Join(out, "a/zero"))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), info.Size())
+
+	// zero-byte files alone still make a CAR, with raw leaves the empty file
+	// is a raw block
+	only := t.TempDir()
+	writeRandomFiles(t, only, map[string]int{"zero": 0})
+	result, err = GenerateCarFromDirResult(context.Background(), t.TempDir(), only, 1<<20, false, nil, WithPathLayout(PathLayoutRelative), WithCidVersion(1), WithRawLeaves(true))
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 1)
+	entries, err = ListCarEntries(result.Cars[0].CarFilePath)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku", entries[0].Cid)
+}
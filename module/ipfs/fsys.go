@@ -0,0 +1,59 @@
+package ipfs
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/FogMeta/meta-lib/util"
+	"golang.org/x/xerrors"
+)
+
+// GenerateCarFromFS is GenerateCarFromDirResult for the directory or file
+// root of fsys, such as an embed.FS, a zip.Reader or an fstest.MapFS. Paths
+// in fsys are slash separated and have no leading slash, so root "." puts
+// the files of fsys under their own paths in the CARs. The data of the files
+// is read through fsys, seeking when its files can; symlinks fsys reports as
+// such can only be skipped.
+func GenerateCarFromFS(ctx context.Context, outputDir string, fsys fs.FS, root string, sliceSize int64, withUUID bool, progress ProgressFunc, opts ...Option) (BuildResult, error) {
+	result := BuildResult{Cars: make([]CarInfo, 0)}
+	o, err := newOptions(opts...)
+	if err != nil {
+		return result, err
+	}
+	if !util.ExistDir(outputDir) {
+		return result, xerrors.Errorf("Unexpected! The path of output dir does not exist")
+	}
+	if withUUID && o.Deterministic {
+		return result, xerrors.Errorf("random UUIDs can not be used in deterministic mode")
+	}
+	root = path.Clean(root)
+	if !fs.ValidPath(root) {
+		return result, xerrors.Errorf("%s is no valid path in the file system", root)
+	}
+	if _, err := fs.Stat(fsys, root); err != nil {
+		return result, err
+	}
+
+	run := struct {
+		Root      string  `json:"root"`
+		SliceSize int64   `json:"slice_size"`
+		WithUUID  bool    `json:"with_uuid"`
+		Options   Options `json:"options"`
+	}{root, sliceSize, withUUID, o}
+	return generateCars(ctx, outputDir, sliceSize, progress, o, run, fileSource{
+		scan: func(ctx context.Context, onError func(string, error)) <-chan util.Finfo {
+			scan := o.scanOptions()
+			scan.OnError = onError
+			return util.GetFileListAsyncFS(ctx, fsys, []string{root}, withUUID, scan)
+		},
+		stat: func(p string) (os.FileInfo, error) {
+			// directories above the root of fsys have no metadata
+			if !fs.ValidPath(p) {
+				return nil, nil
+			}
+			return fs.Stat(fsys, p)
+		},
+	})
+}
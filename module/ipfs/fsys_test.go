@@ -0,0 +1,77 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateCarFromFS(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"site/index.html":    {Data: []byte("<html></html>"), Mode: 0600, ModTime: mtime},
+		"site/data/big":      {Data: big, Mode: 0644, ModTime: mtime},
+		"site/data/zero":     {Mode: 0644, ModTime: mtime},
+		"site/empty":         {Mode: fs.ModeDir | 0755, ModTime: mtime},
+		"site/.git/config":   {Data: []byte("hidden")},
+		"elsewhere/file.txt": {Data: []byte("not below the root")},
+	}
+
+	result, err := GenerateCarFromFS(context.Background(), t.TempDir(), fsys, "site", 4096, false, nil,
+		WithPathLayout(PathLayoutRelative), WithPreserveMode(true), WithPreserveMtime(true))
+	require.NoError(t, err)
+	require.Greater(t, len(result.Cars), 2)
+	require.Empty(t, result.Skipped)
+
+	byPath := make(map[string]CarEntry)
+	for _, car := range result.Cars {
+		entries, err := ListCarEntries(car.CarFilePath)
+		require.NoError(t, err)
+		for _, e := range entries {
+			byPath[e.Path] = e
+		}
+	}
+	require.Equal(t, CarEntryDir, byPath["empty"].Type)
+	require.Equal(t, CarEntryFile, byPath["data/zero"].Type)
+	require.Equal(t, uint64(0), byPath["data/zero"].Size)
+	require.NotContains(t, byPath, ".git/config")
+
+	out := t.TempDir()
+	require.NoError(t, RestoreCar(out, filepath.Dir(result.Cars[0].CarFilePath)))
+	for name, data := range map[string][]byte{"index.html": []byte("<html></html>"), "data/big": big, "data/zero": {}} {
+		got, err := os.ReadFile(filepath.Join(out, name))
+		require.NoError(t, err, name)
+		require.Equal(t, data, got, name)
+	}
+	info, err := os.Stat(filepath.Join(out, "index.html"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	require.True(t, mtime.Equal(info.ModTime()))
+
+	// the whole file system keeps its paths
+	result, err = GenerateCarFromFS(context.Background(), t.TempDir(), fsys, ".", 1<<20, false, nil)
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 1)
+	entries, err := ListCarEntries(result.Cars[0].CarFilePath)
+	require.NoError(t, err)
+	var files []string
+	for _, e := range entries {
+		if e.Type == CarEntryFile {
+			files = append(files, e.Path)
+		}
+	}
+	require.ElementsMatch(t, []string{"elsewhere/file.txt", "site/data/big", "site/data/zero", "site/index.html"}, files)
+
+	_, err = GenerateCarFromFS(context.Background(), t.TempDir(), fsys, "/site", 1<<20, false, nil)
+	require.Error(t, err)
+	_, err = GenerateCarFromFS(context.Background(), t.TempDir(), fsys, "missing", 1<<20, false, nil)
+	require.Error(t, err)
+}
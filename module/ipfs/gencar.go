@@ -2,6 +2,8 @@ package ipfs
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,7 +14,6 @@ import (
 	"github.com/ipfs/go-datastore"
 	dss "github.com/ipfs/go-datastore/sync"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
-	chunker "github.com/ipfs/go-ipfs-chunker"
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	files "github.com/ipfs/go-ipfs-files"
 	format "github.com/ipfs/go-ipld-format"
@@ -21,20 +22,25 @@ import (
 	dag "github.com/ipfs/go-merkledag"
 	"github.com/ipfs/go-unixfs"
 	unixfile "github.com/ipfs/go-unixfs/file"
+	"github.com/ipfs/go-unixfs/hamt"
 	"github.com/ipfs/go-unixfs/importer/balanced"
 	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
+	"github.com/ipfs/go-unixfs/importer/trickle"
 	"github.com/ipld/go-car"
 	ipldprime "github.com/ipld/go-ipld-prime"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
+	"hash"
 	"io"
 	"os"
 	"path"
 	pa "path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -42,7 +48,7 @@ import (
 	ipfsfiles "github.com/ipfs/go-ipfs-files"
 )
 
-func doGenerateCar(sliceSize int64, parentPath, targetPath, carDir, graphName string, parallel int, isUuid bool) error {
+func doGenerateCar(sliceSize int64, parentPath, targetPath, carDir, graphName string, parallel int, isUuid bool, opts ...Option) error {
 	var cumuSize int64 = 0
 	graphSliceCount := 0
 	graphFiles := make([]util.Finfo, 0)
@@ -55,16 +61,20 @@ func doGenerateCar(sliceSize int64, parentPath, targetPath, carDir, graphName st
 	if parentPath == "" {
 		parentPath = targetPath
 	}
+	o, err := newOptions(opts...)
+	if err != nil {
+		return err
+	}
 
 	args := []string{targetPath}
-	sliceTotal := GetGraphCount(args, sliceSize)
+	sliceTotal := graphCount(args, sliceSize, o.scanOptions())
 	if sliceTotal == 0 {
 		log.GetLog().Warn("Empty folder or file!")
 		return nil
 	}
-	files := util.GetFileListAsync(args, isUuid)
+	files := util.GetFileListAsyncOptions(context.Background(), args, isUuid, o.scanOptions())
 	for item := range files {
-		fileSize := item.Info.Size()
+		fileSize := item.Size()
 		switch {
 		case cumuSize+fileSize < sliceSize:
 			cumuSize += fileSize
@@ -73,7 +83,9 @@ func doGenerateCar(sliceSize int64, parentPath, targetPath, carDir, graphName st
 			cumuSize += fileSize
 			graphFiles = append(graphFiles, item)
 			// todo build ipld from graphFiles
-			BuildIpldGraph(graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel)
+			if _, err := BuildIpldGraph(graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel, opts...); err != nil {
+				return err
+			}
 			fmt.Printf("cumu-size: %d\n", cumuSize)
 			// fmt.Printf(GenGraphName(graphName, graphSliceCount, sliceTotal))
 			// fmt.Printf("=================\n")
@@ -99,7 +111,9 @@ func doGenerateCar(sliceSize int64, parentPath, targetPath, carDir, graphName st
 			})
 			fileSliceCount++
 			// todo build ipld from graphFiles
-			BuildIpldGraph(graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel)
+			if _, err := BuildIpldGraph(graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel, opts...); err != nil {
+				return err
+			}
 			fmt.Printf("cumu-size: %d\n", cumuSize+firstCut)
 			// fmt.Printf(GenGraphName(graphName, graphSliceCount, sliceTotal))
 			// fmt.Printf("=================\n")
@@ -125,7 +139,9 @@ func doGenerateCar(sliceSize int64, parentPath, targetPath, carDir, graphName st
 				fileSliceCount++
 				if seekEnd-seekStart == sliceSize-1 {
 					// todo build ipld from graphFiles
-					BuildIpldGraph(graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel)
+					if _, err := BuildIpldGraph(graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel, opts...); err != nil {
+						return err
+					}
 					fmt.Printf("cumu-size: %d\n", sliceSize)
 					// fmt.Printf(GenGraphName(graphName, graphSliceCount, sliceTotal))
 					// fmt.Printf("=================\n")
@@ -137,9 +153,11 @@ func doGenerateCar(sliceSize int64, parentPath, targetPath, carDir, graphName st
 
 		}
 	}
-	if cumuSize > 0 {
+	if len(graphFiles) > 0 {
 		// todo build ipld from graphFiles
-		BuildIpldGraph(graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel)
+		if _, err := BuildIpldGraph(graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel, opts...); err != nil {
+			return err
+		}
 		fmt.Printf("cumu-size: %d\n", cumuSize)
 		// fmt.Printf(GenGraphName(graphName, graphSliceCount, sliceTotal))
 		// fmt.Printf("=================\n")
@@ -164,10 +182,12 @@ type fsNode struct {
 type FSBuilder struct {
 	root *dag.ProtoNode
 	ds   ipld.DAGService
+	// uuidMap is the link to the UUID map in root, which is no file
+	uuidMap cid.Cid
 }
 
 func NewFSBuilder(root *dag.ProtoNode, ds ipld.DAGService) *FSBuilder {
-	return &FSBuilder{root, ds}
+	return &FSBuilder{root: root, ds: ds}
 }
 
 func (b *FSBuilder) Build() (*fsNode, error) {
@@ -184,7 +204,14 @@ func (b *FSBuilder) Build() (*fsNode, error) {
 	if !fsn.IsDir() {
 		return rootn, nil
 	}
-	for _, ln := range b.root.Links() {
+	links, err := b.dirLinks(b.root, fsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, ln := range links {
+		if ln.Cid == b.uuidMap {
+			continue
+		}
 		fn, err := b.getNodeByLink(ln)
 		if err != nil {
 			return nil, err
@@ -209,6 +236,10 @@ func (b *FSBuilder) getNodeByLink(ln *format.Link) (fn fsNode, err error) {
 		return
 	}
 
+	if _, ok := nd.(*dag.RawNode); ok {
+		// a raw leaf is a whole file
+		return
+	}
 	nnd, ok := nd.(*dag.ProtoNode)
 	if !ok {
 		err = xerrors.Errorf("failed to transformed to dag.ProtoNode")
@@ -222,7 +253,11 @@ func (b *FSBuilder) getNodeByLink(ln *format.Link) (fn fsNode, err error) {
 	if !fsn.IsDir() {
 		return
 	}
-	for _, ln := range nnd.Links() {
+	links, err := b.dirLinks(nnd, fsn)
+	if err != nil {
+		return
+	}
+	for _, ln := range links {
 		node, err := b.getNodeByLink(ln)
 		if err != nil {
 			return node, err
@@ -232,6 +267,28 @@ func (b *FSBuilder) getNodeByLink(ln *format.Link) (fn fsNode, err error) {
 	return
 }
 
+func (b *FSBuilder) dirLinks(nd *dag.ProtoNode, fsn *unixfs.FSNode) ([]*format.Link, error) {
+	return dirLinks(context.Background(), b.ds, nd, fsn)
+}
+
+// dirLinks returns the entries of a directory, looking through the shards of
+// a HAMT directory.
+func dirLinks(ctx context.Context, ds ipld.DAGService, nd *dag.ProtoNode, fsn *unixfs.FSNode) ([]*format.Link, error) {
+	if fsn.Type() != unixfs.THAMTShard {
+		return nd.Links(), nil
+	}
+	shard, err := hamt.NewHamtFromDag(ds, nd)
+	if err != nil {
+		return nil, err
+	}
+	var links []*format.Link
+	err = shard.ForEachLink(ctx, func(ln *format.Link) error {
+		links = append(links, ln)
+		return nil
+	})
+	return links, err
+}
+
 func GenGraphName(graphName string, sliceCount, sliceTotal int) string {
 	if sliceTotal == 1 {
 		return fmt.Sprintf("%s.car", graphName)
@@ -239,67 +296,204 @@ func GenGraphName(graphName string, sliceCount, sliceTotal int) string {
 	return fmt.Sprintf("%s-total-%d-part-%d.car", graphName, sliceTotal, sliceCount+1)
 }
 
-func GetGraphCount(args []string, sliceSize int64) int {
-	list, err := util.GetFileList(args)
+// ScanFiles lists the files below args as the generate functions do with the
+// same opts, which decide e.g. what happens to symlinks.
+func ScanFiles(ctx context.Context, args []string, withUUID bool, opts ...Option) (chan util.Finfo, error) {
+	o, err := newOptions(opts...)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return util.GetFileListAsyncOptions(ctx, args, withUUID, o.scanOptions()), nil
+}
+
+// GetGraphCount returns the number of CARs of sliceSize the files below args
+// make, or the error of an invalid option.
+func GetGraphCount(args []string, sliceSize int64, opts ...Option) (int, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return 0, err
+	}
+	return graphCount(args, sliceSize, o.scanOptions()), nil
+}
+
+func graphCount(args []string, sliceSize int64, scan util.ScanOptions) int {
 	var totalSize int64 = 0
-	for _, path := range list {
-		finfo, err := os.Stat(path)
-		if err != nil {
-			panic(err)
-		}
-		totalSize += finfo.Size()
+	items := 0
+	for item := range util.GetFileListAsyncOptions(context.Background(), args, false, scan) {
+		totalSize += item.Size()
+		items++
 	}
-	if totalSize == 0 {
+	// zero-byte files and empty directories still make a CAR
+	if items == 0 {
 		return 0
 	}
 	count := (totalSize / sliceSize) + 1
 	return int(count)
 }
 
-func BuildIpldGraph(fileList []util.Finfo, graphName, parentPath, carDir string, parallel int) {
-	node, fsDetail, err := buildIpldGraph(fileList, parentPath, carDir, parallel)
+// BuildIpldGraph builds the CAR of fileList in carDir and adds it to the
+// manifest of carDir when WithManifest is given, and to the journal of
+// WithJournal.
+func BuildIpldGraph(fileList []util.Finfo, graphName, parentPath, carDir string, parallel int, opts ...Option) (CarInfo, error) {
+	o, err := newOptions(opts...)
 	if err != nil {
-		log.GetLog().Fatal(err)
-		return
+		return CarInfo{}, err
+	}
+	if parallel > runtime.NumCPU() {
+		parallel = runtime.NumCPU()
 	}
-	SaveToCsv(carDir, node, graphName, fsDetail)
-	//log.GetLog().Info("Build ipld graph result:", "Cid=", node.Cid().String(), " Detail=", fsDetail)
+	b := newCarBuilder(context.Background(), nil, o)
+	if o.journal != nil {
+		b.commit = func(carInfo CarInfo, place func() error) error {
+			return o.journal.Commit(JournalEntry{GraphName: graphName, Car: carInfo}, place)
+		}
+	}
+	_, carInfo, _, err := b.buildCar(fileList, parentPath, carDir, parallel)
+	if err != nil {
+		return CarInfo{}, err
+	}
+	log.GetLog().Infof("%s: piece-cid: %s, dedup-saved: %d bytes", carInfo.CarFileName, carInfo.PieceCID, carInfo.DedupSize)
+	if o.Manifest == "" {
+		return carInfo, nil
+	}
+	return carInfo, AppendManifest(ManifestPath(carDir, o.Manifest), o.Manifest, ManifestEntry{GraphName: graphName, CarInfo: carInfo})
 }
 
-func buildIpldGraph(fileList []util.Finfo, parentPath, carDir string, parallel int) (ipld.Node, string, error) {
+// carBuilder carries the context and progress reporting of one generation run
+// through its steps.
+type carBuilder struct {
+	ctx      context.Context
+	progress ProgressFunc
+	opts     Options
+
+	lock   sync.Mutex
+	splits map[string]*fileSplit
+	sums   map[string]*fileSum
+	// stat returns the info of the source directories, for their metadata
+	stat func(path string) (os.FileInfo, error)
+	// commit moves every finished CAR into place with place, so that a
+	// journal can record it first
+	commit func(carInfo CarInfo, place func() error) error
+}
 
-	ctx := context.Background()
+func newCarBuilder(ctx context.Context, progress ProgressFunc, opts Options) *carBuilder {
+	return &carBuilder{ctx: ctx, progress: progress, opts: opts, splits: make(map[string]*fileSplit), sums: make(map[string]*fileSum), stat: os.Stat}
+}
 
-	bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
-	dagServ := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
+// buildCar builds the unixfs DAG of fileList and streams its blocks into a CAR
+// file in carDir, named after the root CID. Only directory nodes are held in
+// memory, so memory use does not grow with the size of the files. The piece
+// commitment of the CAR is computed while it is written.
+func (b *carBuilder) buildCar(fileList []util.Finfo, parentPath, carDir string, parallel int) (*dag.ProtoNode, CarInfo, string, error) {
+	ctx := b.ctx
+	if b.opts.Deterministic {
+		// the files are built one after the other in path order, so their
+		// blocks are written in the same order every time
+		fileList = append([]util.Finfo(nil), fileList...)
+		sort.SliceStable(fileList, func(i, j int) bool {
+			if fileList[i].Path != fileList[j].Path {
+				return fileList[i].Path < fileList[j].Path
+			}
+			return fileList[i].SeekStart < fileList[j].SeekStart
+		})
+	}
 
-	cidBuilder, err := merkledag.PrefixForCidVersion(0)
+	cidBuilder, err := b.opts.cidBuilder()
+	if err != nil {
+		return nil, CarInfo{}, "", err
+	}
+	store, err := newCarStore(carDir, cidBuilder)
 	if err != nil {
-		return nil, "", err
+		return nil, CarInfo{}, "", err
 	}
-	fileNodeMap := make(map[string]*dag.ProtoNode)
-	dirNodeMap := make(map[string]*dag.ProtoNode)
+	store.progress = b.progress
+	finalized := false
+	defer func() {
+		if !finalized {
+			store.discard()
+		}
+	}()
+	// the parts of split files only count once the CAR is in place
+	committed := false
+	defer func() {
+		if !committed {
+			b.dropSplits(fileList)
+		}
+	}()
+	// write through, so store sees and counts duplicate blocks, and no exchange,
+	// the offline one would put every added block a second time
+	dagServ := merkledag.NewDAGService(blockservice.NewWriteThrough(store, nil))
 
-	var rootNode *dag.ProtoNode
-	rootNode = unixfs.EmptyDirNode()
-	rootNode.SetCidBuilder(cidBuilder)
-	var rootKey = "root"
-	dirNodeMap[rootKey] = rootNode
+	fileNodes := make([]ipld.Node, len(fileList))
 
-	// fmt.Println("************ start to build **************")
-	// build file node
-	// parallel build
-	cpun := runtime.NumCPU()
-	if parallel > cpun {
-		parallel = cpun
-	}
 	pchan := make(chan struct{}, parallel)
 	wg := sync.WaitGroup{}
 	lock := sync.Mutex{}
+	detailInfo := make([]DetailInfo, len(fileList))
+	var buildErr error
+	buildOne := func(i int, item util.Finfo) {
+		if ctx.Err() != nil {
+			return
+		}
+		var h hash.Hash
+		var w io.Writer
+		if item.Parts > 0 {
+			h = sha256.New()
+			w = h
+		}
+		sum := b.sumHash(item)
+		if sum != nil {
+			w = sum
+			if h != nil {
+				w = io.MultiWriter(h, sum)
+			}
+		}
+		fileNode, err := b.buildFile(item, dagServ, cidBuilder, w)
+		if err == nil {
+			err = b.checkSum(item, sum)
+		} else if sum != nil {
+			b.dropSum(item.Path)
+		}
+		if err != nil {
+			log.GetLog().Warn(err)
+			lock.Lock()
+			buildErr = err
+			lock.Unlock()
+			return
+		}
+		stat, _ := fileNode.Stat()
+		detail := DetailInfo{
+			FilePath: item.Path,
+			FileName: item.Name,
+			FileSize: int64(stat.CumulativeSize),
+			CID:      fileNode.String(),
+			UUID:     item.Uuid,
+		}
+		if item.Parts > 0 {
+			detail.Split = &SplitInfo{
+				OriginalPath: item.Path,
+				OriginalSize: item.Info.Size(),
+				Part:         item.Part,
+				Parts:        item.Parts,
+				Start:        item.SeekStart,
+				End:          item.SeekEnd,
+				Sha256:       hex.EncodeToString(h.Sum(nil)),
+				FileCid:      b.fileCid(item),
+			}
+		}
+		lock.Lock()
+		fileNodes[i] = fileNode
+		detailInfo[i] = detail
+		lock.Unlock()
+		log.GetLog().Infof("FILE:%s    CID:%s    UUID:%s      SIZE:%d\n", item.Path, fileNode, item.Uuid, stat.CumulativeSize)
+	}
 	for i, item := range fileList {
+		// the parts of a file with a checksum are read in order, as are the
+		// files not on disk, which may share one stream
+		if b.opts.Deterministic || (item.Parts > 0 && item.Sha256 != "") || item.Open != nil {
+			buildOne(i, item)
+			continue
+		}
 		wg.Add(1)
 		go func(i int, item util.Finfo) {
 			defer func() {
@@ -307,143 +501,111 @@ func buildIpldGraph(fileList []util.Finfo, parentPath, carDir string, parallel i
 				wg.Done()
 			}()
 			pchan <- struct{}{}
-			fileNode, err := BuildFileNode(item, dagServ, cidBuilder)
-			if err != nil {
-				log.GetLog().Warn(err)
-				return
-			}
-			fn, ok := fileNode.(*dag.ProtoNode)
-			if !ok {
-				emsg := "file node should be *dag.ProtoNode"
-				log.GetLog().Warn(emsg)
-				return
-			}
-			lock.Lock()
-			fileNodeMap[item.Path] = fn
-			lock.Unlock()
-			// fmt.Println(item.Path)
-			stat, _ := fileNode.Stat()
-			log.GetLog().Infof("FILE:%s    CID:%s    UUID:uuid-%s      SIZE:%d\n", item.Path, fileNode, item.Uuid, stat.CumulativeSize)
+			buildOne(i, item)
 		}(i, item)
 	}
 	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, CarInfo{}, "", err
+	}
+	if buildErr != nil {
+		return nil, CarInfo{}, "", buildErr
+	}
 
 	// build dir tree
-	for _, item := range fileList {
-		// log.GetLog().Info(item.Path)
-		// log.Infof("file name: %s, file size: %d, item size: %d, seek-start:%d, seek-end:%d", item.Name, item.Info.Size(), item.SeekEnd-item.SeekStart, item.SeekStart, item.SeekEnd)
-		dirStr := path.Dir(item.Path)
-		parentPath = path.Clean(parentPath)
-		// when parent path equal target path, and the parent path is also a file path
-		if parentPath == path.Clean(item.Path) {
-			dirStr = ""
-		} else if parentPath != "" && strings.HasPrefix(dirStr, parentPath) {
-			dirStr = dirStr[len(parentPath):]
+	tree := newDirTree()
+	tree.stat = b.stat
+	uuids := make(map[string]string)
+	sources := make(map[string]string)
+	for index, item := range fileList {
+		dirList, name, mirrored := b.opts.carPath(item, parentPath)
+		carPath := path.Join(append(dirList, name)...)
+		if src, ok := sources[carPath]; ok {
+			return nil, CarInfo{}, "", xerrors.Errorf("%s and %s are both at %s in the CAR", src, item.Path, carPath)
 		}
-
-		if strings.HasPrefix(dirStr, "/") {
-			dirStr = dirStr[1:]
+		sources[carPath] = item.Path
+		srcDir := path.Dir(item.Path)
+		if !mirrored {
+			srcDir = ""
 		}
-		var dirList []string
-		if dirStr == "" {
-			dirList = []string{}
-		} else {
-			dirList = strings.Split(dirStr, "/")
+		tree.addFile(dirList, srcDir, name, fileNodes[index])
+		if item.Uuid != "" {
+			uuids[carPath] = item.Uuid
 		}
-		fileNode, ok := fileNodeMap[item.Path]
-		if !ok {
-			panic("unexpected, missing file node")
+	}
+	uuidMap := cid.Undef
+	if len(uuids) > 0 {
+		if src, ok := sources[UuidMapName]; ok {
+			return nil, CarInfo{}, "", xerrors.Errorf("%s is at %s in the CAR, which is kept for the UUID map", src, UuidMapName)
 		}
-		if len(dirList) == 0 {
-			dirNodeMap[rootKey].AddNodeLink(item.Name+item.Uuid, fileNode)
-			continue
+		blk, err := buildUuidMap(uuids)
+		if err != nil {
+			return nil, CarInfo{}, "", err
 		}
-		//log.Info(item.Path)
-		log.GetLog().Info(dirList)
-		i := len(dirList) - 1
-		for ; i >= 0; i-- {
-			// get dirNodeMap by index
-			var ok bool
-			var dirNode *dag.ProtoNode
-			var parentNode *dag.ProtoNode
-			var parentKey string
-			dir := dirList[i]
-			dirKey := getDirKey(dirList, i)
-			log.GetLog().Info(dirList)
-			log.GetLog().Infof("dirKey: %s", dirKey)
-			dirNode, ok = dirNodeMap[dirKey]
-			if !ok {
-				dirNode = unixfs.EmptyDirNode()
-				dirNode.SetCidBuilder(cidBuilder)
-				dirNodeMap[dirKey] = dirNode
-			}
-			// add file node to its nearest parent node
-			if i == len(dirList)-1 {
-				dirNode.AddNodeLink(item.Name+item.Uuid, fileNode)
-			}
-			if i == 0 {
-				parentKey = rootKey
-			} else {
-				parentKey = getDirKey(dirList, i-1)
-			}
-			log.GetLog().Infof("parentKey: %s", parentKey)
-			parentNode, ok = dirNodeMap[parentKey]
-			if !ok {
-				parentNode = unixfs.EmptyDirNode()
-				parentNode.SetCidBuilder(cidBuilder)
-				dirNodeMap[parentKey] = parentNode
-			}
-			if isLinked(parentNode, dir) {
-				parentNode, err = parentNode.UpdateNodeLink(dir, dirNode)
-				if err != nil {
-					return nil, "", err
-				}
-				dirNodeMap[parentKey] = parentNode
-			} else {
-				parentNode.AddNodeLink(dir, dirNode)
-			}
+		nd, err := ipld.Decode(blk)
+		if err != nil {
+			return nil, CarInfo{}, "", err
 		}
+		if err := store.Put(ctx, blk); err != nil {
+			return nil, CarInfo{}, "", err
+		}
+		tree.addFile(nil, "", UuidMapName, nd)
+		uuidMap = blk.Cid()
 	}
-
-	for _, node := range dirNodeMap {
-		// fmt.Printf("add node to store: %v\n", node)
-		// fmt.Printf("key: %s, links: %v\n", key, len(node.Links()))
-		dagServ.Add(ctx, node)
-	}
-
-	rootNode = dirNodeMap[rootKey]
-	//fmt.Printf("root node cid: %s\n", rootNode.Cid())
-	// log.GetLog().Infof("start to generate car for %s", rootNode.Cid())
-	// genCarStartTime := time.Now()
-	//car
-	carF, err := os.Create(path.Join(carDir, rootNode.Cid().String()+".car"))
+	rootNode, err := tree.build(ctx, store, cidBuilder, b.opts)
 	if err != nil {
-		return nil, "", err
-	}
-	defer carF.Close()
-	selector := allSelector()
-	sc := car.NewSelectiveCar(ctx, bs2, []car.Dag{{Root: rootNode.Cid(), Selector: selector}})
-	err = sc.Write(carF)
-	// cario := cario.NewCarIO()
-	// err = cario.WriteCar(context.Background(), bs2, rootNode.Cid(), selector, carF)
-	if err != nil {
-		return nil, "", err
+		return nil, CarInfo{}, "", err
 	}
-	//log.GetLog().Infof("generate car file completed, time elapsed: %s", time.Now().Sub(genCarStartTime))
-
 	fsBuilder := NewFSBuilder(rootNode, dagServ)
+	fsBuilder.uuidMap = uuidMap
 	fsNode, err := fsBuilder.Build()
 	if err != nil {
-		return nil, "", err
+		return nil, CarInfo{}, "", err
 	}
 	fsNodeBytes, err := json.Marshal(fsNode)
 	if err != nil {
-		return nil, "", err
+		return nil, CarInfo{}, "", err
+	}
+
+	carFileName := path.Join(carDir, rootNode.Cid().String()+".car")
+	finalized = true
+	pieceCid, pieceSize, err := store.finalize(rootNode.Cid())
+	if err != nil {
+		return nil, CarInfo{}, "", err
+	}
+
+	carStat, err := os.Stat(store.f.Name())
+	if err != nil {
+		os.Remove(store.f.Name())
+		return nil, CarInfo{}, "", err
+	}
+	carInfo := CarInfo{
+		CarFilePath: carFileName,
+		CarFileName: filepath.Base(carFileName),
+		RootCid:     rootNode.Cid().String(),
+		PieceCID:    pieceCid.String(),
+		PieceSize:   int64(pieceSize),
+		CarSize:     carStat.Size(),
+		DedupSize:   store.dedup,
+		Details:     detailInfo,
+	}
+	place := func() error {
+		return store.place(carFileName)
+	}
+	// the journal records the splits with the parts in this CAR
+	b.commitSplits(fileList)
+	if b.commit != nil {
+		err = b.commit(carInfo, place)
+	} else {
+		err = place()
+	}
+	if err != nil {
+		os.Remove(store.f.Name())
+		return nil, CarInfo{}, "", err
 	}
-	// log.GetLog().Info("File Node Map:", fileNodeMap)
-	// log.GetLog().Info("Dir  Node Map:", dirNodeMap)
-	// fmt.Println("++++++++++++ finished to build +++++++++++++")
-	return rootNode, fmt.Sprintf("%s", fsNodeBytes), nil
+	committed = true
+	b.progress.report(ProgressEvent{Type: ProgressCarFinished, Path: carFileName, Cid: carInfo.RootCid, Bytes: int64(store.commp.Size())})
+	return rootNode, carInfo, string(fsNodeBytes), nil
 }
 
 func allSelector() ipldprime.Node {
@@ -454,134 +616,200 @@ func allSelector() ipldprime.Node {
 }
 
 func getDirKey(dirList []string, i int) (key string) {
-	for j := 0; j <= i; j++ {
-		key += dirList[j]
-		if j < i {
-			key += "."
-		}
-	}
-	return
+	return strings.Join(dirList[:i+1], "/")
 }
 
-func isLinked(node *dag.ProtoNode, name string) bool {
-	for _, lk := range node.Links() {
-		if lk.Name == name {
-			return true
-		}
-	}
-	return false
+func BuildFileNode(item util.Finfo, bufDs ipld.DAGService, cidBuilder cid.Builder) (node ipld.Node, err error) {
+	return newCarBuilder(context.Background(), nil, defaultOptions()).buildFileNode(item, bufDs, cidBuilder)
 }
 
-type fileSlice struct {
-	r        *os.File
-	offset   int64
-	start    int64
-	end      int64
-	fileSize int64
+func (b *carBuilder) buildFileNode(item util.Finfo, bufDs ipld.DAGService, cidBuilder cid.Builder) (node ipld.Node, err error) {
+	return b.buildFile(item, bufDs, cidBuilder, nil)
 }
 
-func (fs *fileSlice) Read(p []byte) (n int, err error) {
-	if fs.end == 0 {
-		fs.end = fs.fileSize - 1
+// buildFile builds the DAG of item, the data read is also written to h unless
+// it is nil.
+func (b *carBuilder) buildFile(item util.Finfo, bufDs ipld.DAGService, cidBuilder cid.Builder, h io.Writer) (node ipld.Node, err error) {
+	if item.Link != "" {
+		return b.buildSymlinkNode(item, bufDs, cidBuilder)
 	}
-	if fs.offset == 0 && fs.start > 0 {
-		_, err = fs.r.Seek(fs.start, 0)
-		if err != nil {
-			log.GetLog().Warn(err)
-			return 0, err
-		}
-		fs.offset = fs.start
+	if item.Info.IsDir() {
+		return b.buildEmptyDirNode(item, bufDs, cidBuilder)
 	}
-	//fmt.Printf("offset: %d, end: %d, start: %d, size: %d\n", fs.offset, fs.end, fs.start, fs.fileSize)
-	if fs.end-fs.offset+1 == 0 {
-		return 0, io.EOF
+	f, err := openFile(item)
+	if err != nil {
+		return nil, err
 	}
-	if fs.end-fs.offset+1 < 0 {
-		return 0, xerrors.Errorf("read data out bound of the slice")
+	defer f.Close()
+	var r io.Reader = f
+	if h != nil {
+		r = io.TeeReader(r, h)
 	}
-	plen := len(p)
-	leftLen := fs.end - fs.offset + 1
-	if leftLen > int64(plen) {
-		n, err = fs.r.Read(p)
-		if err != nil {
-			log.GetLog().Warn(err)
-			return
+	if sp := b.split(item.Path); sp != nil && item.Parts > 0 {
+		r = &progressReader{ctx: b.ctx, r: r, path: item.Path, progress: b.progress}
+		return b.buildSplitPart(item, sp, r, bufDs, cidBuilder)
+	}
+
+	preserve := b.opts.PreserveMode || b.opts.PreserveMtime
+	ds := bufDs
+	if preserve {
+		// the root gets the metadata, so it must not be written as built
+		ds = &rootHolder{DAGService: bufDs}
+	}
+	params := ihelper.DagBuilderParams{
+		Maxlinks:   b.opts.MaxLinks,
+		RawLeaves:  b.opts.RawLeaves,
+		CidBuilder: cidBuilder,
+		Dagserv:    ds,
+		NoCopy:     false,
+	}
+	if item.Parts == 0 && item.Info.Size() == 0 {
+		// a zero-byte file is not read, it gets the node the importers
+		// give it
+		node, err = b.emptyFileNode(cidBuilder)
+		if err == nil {
+			err = ds.Add(b.ctx, node)
+		}
+	} else {
+		r = &progressReader{ctx: b.ctx, r: r, path: item.Path, progress: b.progress}
+		var db *ihelper.DagBuilderHelper
+		if db, err = params.New(b.opts.splitter(r)); err != nil {
+			return nil, err
+		}
+		if b.opts.Layout == LayoutTrickle {
+			node, err = trickle.Layout(db)
+		} else {
+			node, err = balanced.Layout(db)
 		}
-		//fmt.Printf("read num: %d\n", n)
-		fs.offset += int64(n)
-		return
 	}
-	b := make([]byte, leftLen)
-	n, err = fs.r.Read(b)
 	if err != nil {
+		return nil, err
+	}
+	if !preserve {
 		return
 	}
-	//fmt.Printf("read num: %d\n", n)
-	fs.offset += int64(n)
 
-	return copy(p, b), io.EOF
+	var pn *dag.ProtoNode
+	switch nd := node.(type) {
+	case *dag.ProtoNode:
+		pn = nd
+	case *dag.RawNode:
+		// a raw leaf has no room for metadata, so wrap it in a file node
+		if err := bufDs.Add(b.ctx, nd); err != nil {
+			return nil, err
+		}
+		fsn := unixfs.NewFSNode(unixfs.TFile)
+		fsn.AddBlockSize(uint64(len(nd.RawData())))
+		data, err := fsn.GetBytes()
+		if err != nil {
+			return nil, err
+		}
+		pn = dag.NodeWithData(data)
+		pn.SetCidBuilder(cidBuilder)
+		if err := pn.AddNodeLink("", nd); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, xerrors.Errorf("unexpected file root node %T", node)
+	}
+	pn, err = b.opts.withMetadata(pn, item.Info)
+	if err != nil {
+		return nil, err
+	}
+	if err := bufDs.Add(b.ctx, pn); err != nil {
+		return nil, err
+	}
+	return pn, nil
 }
 
-func BuildFileNode(item util.Finfo, bufDs ipld.DAGService, cidBuilder cid.Builder) (node ipld.Node, err error) {
-	var r io.Reader
+// openFile opens the data of item, only the bytes of a part of a split file.
+func openFile(item util.Finfo) (io.ReadCloser, error) {
+	part := item.Parts > 0 || item.SeekStart > 0 || item.SeekEnd > 0
+	start, size := int64(0), item.Info.Size()
+	if part {
+		start, size = item.SeekStart, item.SeekEnd-item.SeekStart+1
+	}
+	if item.Open != nil {
+		return item.Open(start, size)
+	}
 	f, err := os.Open(item.Path)
 	if err != nil {
 		return nil, err
 	}
-	r = f
+	if !part {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, start, size), f}, nil
+}
 
-	// read all data of item
-	if item.SeekStart > 0 || item.SeekEnd > 0 {
-		r = &fileSlice{
-			r:        f,
-			start:    item.SeekStart,
-			end:      item.SeekEnd,
-			fileSize: item.Info.Size(),
-		}
+// emptyFileNode returns the node of a zero-byte file: a raw leaf with raw
+// leaves in the balanced layout, an empty UnixFS file node otherwise.
+func (b *carBuilder) emptyFileNode(cidBuilder cid.Builder) (ipld.Node, error) {
+	if b.opts.RawLeaves && b.opts.Layout != LayoutTrickle {
+		return dag.NewRawNodeWPrefix(nil, cidBuilder)
 	}
+	nd := dag.NodeWithData(unixfs.FilePBData(nil, 0))
+	nd.SetCidBuilder(cidBuilder)
+	return nd, nil
+}
 
-	params := ihelper.DagBuilderParams{
-		Maxlinks:   UnixfsLinksPerLevel,
-		RawLeaves:  false,
-		CidBuilder: cidBuilder,
-		Dagserv:    bufDs,
-		NoCopy:     false,
+// buildEmptyDirNode builds the node of a directory with nothing in it, with
+// its metadata as the directories of the tree get it.
+func (b *carBuilder) buildEmptyDirNode(item util.Finfo, bufDs ipld.DAGService, cidBuilder cid.Builder) (ipld.Node, error) {
+	nd := unixfs.EmptyDirNode()
+	nd.SetCidBuilder(cidBuilder)
+	if b.opts.PreserveMode || b.opts.PreserveMtime {
+		var err error
+		if nd, err = b.opts.withMetadata(nd, item.Info); err != nil {
+			return nil, err
+		}
 	}
-	db, err := params.New(chunker.NewSizeSplitter(r, int64(UnixfsChunkSize)))
-	if err != nil {
+	if err := bufDs.Add(b.ctx, nd); err != nil {
 		return nil, err
 	}
-	node, err = balanced.Layout(db)
+	return nd, nil
+}
+
+func (b *carBuilder) buildSymlinkNode(item util.Finfo, bufDs ipld.DAGService, cidBuilder cid.Builder) (ipld.Node, error) {
+	data, err := unixfs.SymlinkData(item.Link)
 	if err != nil {
 		return nil, err
 	}
-	return
+	nd := dag.NodeWithData(data)
+	nd.SetCidBuilder(cidBuilder)
+	if err := bufDs.Add(b.ctx, nd); err != nil {
+		return nil, err
+	}
+	return nd, nil
 }
 
-func SaveToCsv(carDir string, node ipld.Node, graphName, fsDetail string) {
-	// Add node inof to manifest.csv
-	manifestPath := path.Join(carDir, "manifest.csv")
-	_, err := os.Stat(manifestPath)
-	if err != nil && !os.IsNotExist(err) {
-		log.GetLog().Fatal(err)
-	}
-	var isCreateAction bool
-	if err != nil && os.IsNotExist(err) {
-		isCreateAction = true
-	}
-	f, err := os.OpenFile(manifestPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.GetLog().Fatal(err)
-	}
-	defer f.Close()
-	if isCreateAction {
-		if _, err := f.Write([]byte("playload_cid,filename,detail\n")); err != nil {
-			log.GetLog().Fatal(err)
+// rootHolder holds back the node added last. The importers add the root of a
+// file last of all.
+type rootHolder struct {
+	ipld.DAGService
+	last ipld.Node
+}
+
+func (h *rootHolder) Add(ctx context.Context, nd ipld.Node) error {
+	if h.last != nil {
+		if err := h.DAGService.Add(ctx, h.last); err != nil {
+			return err
 		}
 	}
-	if _, err := f.Write([]byte(fmt.Sprintf("%s,%s,%s\n", node.Cid(), graphName, fsDetail))); err != nil {
-		log.GetLog().Fatal(err)
+	h.last = nd
+	return nil
+}
+
+func (h *rootHolder) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		if err := h.Add(ctx, nd); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func checkFiles(srcFiles []string, sliceSize int64) bool {
@@ -625,20 +853,24 @@ func getFileInfoWithUuidAsync(srcFiles []string, uuidStr []string) chan util.Fin
 	return fichan
 }
 
-func doGenerateCarFrom(outputPath string, srcFiles []string) (string, string, error) {
+func (b *carBuilder) doGenerateCarFrom(outputPath string, srcFiles []string) (string, string, error) {
 
-	return doGenerateCarFromEx(outputPath, srcFiles, false)
+	return b.doGenerateCarFromEx(outputPath, srcFiles, false)
 }
 
-func doGenerateCarFromEx(outputPath string, srcFiles []string, withUUID bool) (string, string, error) {
+func (b *carBuilder) doGenerateCarFromEx(outputPath string, srcFiles []string, withUUID bool) (string, string, error) {
 
 	graphFiles := make([]util.Finfo, 0)
-	files := util.GetFileListAsync(srcFiles, withUUID)
+	files := util.GetFileListAsyncOptions(b.ctx, srcFiles, withUUID, b.opts.scanOptions())
 	for item := range files {
+		b.progress.report(ProgressEvent{Type: ProgressFileScanned, Path: item.Path, Bytes: item.Size()})
 		graphFiles = append(graphFiles, item)
 	}
+	if err := b.ctx.Err(); err != nil {
+		return "", "", err
+	}
 
-	carName, detail, err := buildGraph(graphFiles, outputPath)
+	carName, detail, err := b.buildGraph(graphFiles, outputPath)
 	if err != nil {
 		return "", "", err
 	}
@@ -646,366 +878,32 @@ func doGenerateCarFromEx(outputPath string, srcFiles []string, withUUID bool) (s
 	return carName, detail, nil
 }
 
-func doGenerateCarWithUuid(outputPath string, srcFiles []string, uuidStr []string) (string, string, error) {
-
-	graphFiles := make([]util.Finfo, 0)
-	files := getFileInfoWithUuidAsync(srcFiles, uuidStr)
-	for item := range files {
-		graphFiles = append(graphFiles, item)
-	}
-
-	return buildGraph(graphFiles, outputPath)
-}
+func (b *carBuilder) doGenerateCarWithUuid(outputPath string, srcFiles []string, uuidStr []string) (string, string, error) {
 
-func doGenerateCarWithUuidEx(outputPath string, srcFiles []string, uuidStr []string) (string, string, string, []DetailInfo, error) {
 	graphFiles := make([]util.Finfo, 0)
 	files := getFileInfoWithUuidAsync(srcFiles, uuidStr)
 	for item := range files {
+		b.progress.report(ProgressEvent{Type: ProgressFileScanned, Path: item.Path, Bytes: item.Size()})
 		graphFiles = append(graphFiles, item)
 	}
 
-	return buildGraphEx(graphFiles, outputPath)
+	return b.buildGraph(graphFiles, outputPath)
 }
 
-func buildGraph(fileList []util.Finfo, outputPath string) (string, string, error) {
-
-	parentPath := "/"
-	ctx := context.Background()
-
-	bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
-	dagServ := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
-
-	cidBuilder, err := merkledag.PrefixForCidVersion(0)
-	if err != nil {
-		return "", "", err
-	}
-	fileNodeMap := make(map[string]*dag.ProtoNode)
-	dirNodeMap := make(map[string]*dag.ProtoNode)
-
-	var rootNode *dag.ProtoNode
-	rootNode = unixfs.EmptyDirNode()
-	rootNode.SetCidBuilder(cidBuilder)
-	var rootKey = "root"
-	dirNodeMap[rootKey] = rootNode
-
-	parallel := runtime.NumCPU()
-	pchan := make(chan struct{}, parallel)
-	wg := sync.WaitGroup{}
-	lock := sync.Mutex{}
-	for i, item := range fileList {
-		wg.Add(1)
-		go func(i int, item util.Finfo) {
-			defer func() {
-				<-pchan
-				wg.Done()
-			}()
-			pchan <- struct{}{}
-			fileNode, err := BuildFileNode(item, dagServ, cidBuilder)
-			if err != nil {
-				log.GetLog().Warn(err)
-				return
-			}
-			fn, ok := fileNode.(*dag.ProtoNode)
-			if !ok {
-				emsg := "file node should be *dag.ProtoNode"
-				log.GetLog().Warn(emsg)
-				return
-			}
-			lock.Lock()
-			fileNodeMap[item.Path] = fn
-			lock.Unlock()
-			stat, _ := fileNode.Stat()
-			log.GetLog().Infof("FILE:%s    CID:%s    UUID:%s      SIZE:%d\n", item.Path, fileNode, item.Uuid, stat.CumulativeSize)
-		}(i, item)
-	}
-	wg.Wait()
-
-	// build dir tree
-	for _, item := range fileList {
-		// log.GetLog().Info(item.Path)
-		// log.Infof("file name: %s, file size: %d, item size: %d, seek-start:%d, seek-end:%d", item.Name, item.Info.Size(), item.SeekEnd-item.SeekStart, item.SeekStart, item.SeekEnd)
-		dirStr := path.Dir(item.Path)
-		parentPath = path.Clean(parentPath)
-		// when parent path equal target path, and the parent path is also a file path
-		if parentPath == path.Clean(item.Path) {
-			dirStr = ""
-		} else if parentPath != "" && strings.HasPrefix(dirStr, parentPath) {
-			dirStr = dirStr[len(parentPath):]
-		}
-
-		if strings.HasPrefix(dirStr, "/") {
-			dirStr = dirStr[1:]
-		}
-		var dirList []string
-		if dirStr == "" {
-			dirList = []string{}
-		} else {
-			dirList = strings.Split(dirStr, "/")
-		}
-		fileNode, ok := fileNodeMap[item.Path]
-		if !ok {
-			panic("unexpected, missing file node")
-		}
-		if len(dirList) == 0 {
-			dirNodeMap[rootKey].AddNodeLink(item.Name+item.Uuid, fileNode)
-			continue
-		}
-		//log.Info(item.Path)
-		//log.GetLog().Info(dirList)
-		i := len(dirList) - 1
-		for ; i >= 0; i-- {
-			// get dirNodeMap by index
-			var ok bool
-			var dirNode *dag.ProtoNode
-			var parentNode *dag.ProtoNode
-			var parentKey string
-			dir := dirList[i]
-			dirKey := getDirKey(dirList, i)
-			//log.GetLog().Info(dirList)
-			//log.GetLog().Infof("dirKey: %s", dirKey)
-			dirNode, ok = dirNodeMap[dirKey]
-			if !ok {
-				dirNode = unixfs.EmptyDirNode()
-				dirNode.SetCidBuilder(cidBuilder)
-				dirNodeMap[dirKey] = dirNode
-			}
-			// add file node to its nearest parent node
-			if i == len(dirList)-1 {
-				dirNode.AddNodeLink(item.Name+item.Uuid, fileNode)
-			}
-			if i == 0 {
-				parentKey = rootKey
-			} else {
-				parentKey = getDirKey(dirList, i-1)
-			}
-			//log.GetLog().Infof("parentKey: %s", parentKey)
-			parentNode, ok = dirNodeMap[parentKey]
-			if !ok {
-				parentNode = unixfs.EmptyDirNode()
-				parentNode.SetCidBuilder(cidBuilder)
-				dirNodeMap[parentKey] = parentNode
-			}
-			if isLinked(parentNode, dir) {
-				parentNode, err = parentNode.UpdateNodeLink(dir, dirNode)
-				if err != nil {
-					return "", "", err
-				}
-				dirNodeMap[parentKey] = parentNode
-			} else {
-				parentNode.AddNodeLink(dir, dirNode)
-			}
-		}
-	}
-
-	for _, node := range dirNodeMap {
-		// fmt.Printf("add node to store: %v\n", node)
-		// fmt.Printf("key: %s, links: %v\n", key, len(node.Links()))
-		dagServ.Add(ctx, node)
-	}
-
-	rootNode = dirNodeMap[rootKey]
-	carFileName := path.Join(outputPath, rootNode.Cid().String()+".car")
-	carF, err := os.Create(carFileName)
+func (b *carBuilder) buildGraph(fileList []util.Finfo, outputPath string) (string, string, error) {
+	_, carInfo, detail, err := b.buildCar(fileList, "/", outputPath, runtime.NumCPU())
 	if err != nil {
 		return "", "", err
 	}
-	defer carF.Close()
-	selector := allSelector()
-	sc := car.NewSelectiveCar(ctx, bs2, []car.Dag{{Root: rootNode.Cid(), Selector: selector}})
-	err = sc.Write(carF)
-
-	if err != nil {
-		return "", "", err
-	}
-	//log.GetLog().Infof("generate car file completed, time elapsed: %s", time.Now().Sub(genCarStartTime))
-
-	fsBuilder := NewFSBuilder(rootNode, dagServ)
-	fsNode, err := fsBuilder.Build()
-	if err != nil {
-		return "", "", err
-	}
-	fsNodeBytes, err := json.Marshal(fsNode)
-	if err != nil {
-		return "", "", err
-	}
-	detail := fmt.Sprintf("%s", fsNodeBytes)
-
-	return carFileName, detail, nil
+	return carInfo.CarFilePath, detail, nil
 }
 
-func buildGraphEx(fileList []util.Finfo, outputPath string) (string, string, string, []DetailInfo, error) {
-
-	parentPath := "/"
-	ctx := context.Background()
-
-	bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
-	dagServ := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
-
-	cidBuilder, err := merkledag.PrefixForCidVersion(0)
-	if err != nil {
-		return "", "", "", nil, err
-	}
-	fileNodeMap := make(map[string]*dag.ProtoNode)
-	dirNodeMap := make(map[string]*dag.ProtoNode)
-
-	var rootNode *dag.ProtoNode
-	rootNode = unixfs.EmptyDirNode()
-	rootNode.SetCidBuilder(cidBuilder)
-	var rootKey = "root"
-	dirNodeMap[rootKey] = rootNode
-
-	parallel := runtime.NumCPU()
-	pchan := make(chan struct{}, parallel)
-	wg := sync.WaitGroup{}
-	lock := sync.Mutex{}
-	detailInfo := make([]DetailInfo, 0)
-	for i, item := range fileList {
-		wg.Add(1)
-		go func(i int, item util.Finfo) {
-			defer func() {
-				<-pchan
-				wg.Done()
-			}()
-			pchan <- struct{}{}
-			fileNode, err := BuildFileNode(item, dagServ, cidBuilder)
-			if err != nil {
-				log.GetLog().Warn(err)
-				return
-			}
-			fn, ok := fileNode.(*dag.ProtoNode)
-			if !ok {
-				emsg := "file node should be *dag.ProtoNode"
-				log.GetLog().Warn(emsg)
-				return
-			}
-			lock.Lock()
-			fileNodeMap[item.Path] = fn
-			lock.Unlock()
-			stat, _ := fileNode.Stat()
-			detailInfo = append(detailInfo, DetailInfo{
-				FilePath: item.Path,
-				FileName: item.Name,
-				FileSize: int64(stat.CumulativeSize),
-				CID:      fileNode.String(),
-				UUID:     item.Uuid,
-			})
-			log.GetLog().Infof("FILE:%s    CID:%s    UUID:%s      SIZE:%d\n", item.Path, fileNode, item.Uuid, stat.CumulativeSize)
-		}(i, item)
-	}
-	wg.Wait()
-
-	// build dir tree
-	for _, item := range fileList {
-		// log.GetLog().Info(item.Path)
-		// log.Infof("file name: %s, file size: %d, item size: %d, seek-start:%d, seek-end:%d", item.Name, item.Info.Size(), item.SeekEnd-item.SeekStart, item.SeekStart, item.SeekEnd)
-		dirStr := path.Dir(item.Path)
-		parentPath = path.Clean(parentPath)
-		// when parent path equal target path, and the parent path is also a file path
-		if parentPath == path.Clean(item.Path) {
-			dirStr = ""
-		} else if parentPath != "" && strings.HasPrefix(dirStr, parentPath) {
-			dirStr = dirStr[len(parentPath):]
-		}
-
-		if strings.HasPrefix(dirStr, "/") {
-			dirStr = dirStr[1:]
-		}
-		var dirList []string
-		if dirStr == "" {
-			dirList = []string{}
-		} else {
-			dirList = strings.Split(dirStr, "/")
-		}
-		fileNode, ok := fileNodeMap[item.Path]
-		if !ok {
-			panic("unexpected, missing file node")
-		}
-		if len(dirList) == 0 {
-			dirNodeMap[rootKey].AddNodeLink(item.Name+item.Uuid, fileNode)
-			continue
-		}
-		//log.Info(item.Path)
-		//log.GetLog().Info(dirList)
-		i := len(dirList) - 1
-		for ; i >= 0; i-- {
-			// get dirNodeMap by index
-			var ok bool
-			var dirNode *dag.ProtoNode
-			var parentNode *dag.ProtoNode
-			var parentKey string
-			dir := dirList[i]
-			dirKey := getDirKey(dirList, i)
-			//log.GetLog().Info(dirList)
-			//log.GetLog().Infof("dirKey: %s", dirKey)
-			dirNode, ok = dirNodeMap[dirKey]
-			if !ok {
-				dirNode = unixfs.EmptyDirNode()
-				dirNode.SetCidBuilder(cidBuilder)
-				dirNodeMap[dirKey] = dirNode
-			}
-			// add file node to its nearest parent node
-			if i == len(dirList)-1 {
-				dirNode.AddNodeLink(item.Name+item.Uuid, fileNode)
-			}
-			if i == 0 {
-				parentKey = rootKey
-			} else {
-				parentKey = getDirKey(dirList, i-1)
-			}
-			//log.GetLog().Infof("parentKey: %s", parentKey)
-			parentNode, ok = dirNodeMap[parentKey]
-			if !ok {
-				parentNode = unixfs.EmptyDirNode()
-				parentNode.SetCidBuilder(cidBuilder)
-				dirNodeMap[parentKey] = parentNode
-			}
-			if isLinked(parentNode, dir) {
-				parentNode, err = parentNode.UpdateNodeLink(dir, dirNode)
-				if err != nil {
-					return "", "", "", nil, err
-				}
-				dirNodeMap[parentKey] = parentNode
-			} else {
-				parentNode.AddNodeLink(dir, dirNode)
-			}
-		}
-	}
-
-	for _, node := range dirNodeMap {
-		// fmt.Printf("add node to store: %v\n", node)
-		// fmt.Printf("key: %s, links: %v\n", key, len(node.Links()))
-		dagServ.Add(ctx, node)
-	}
-
-	rootNode = dirNodeMap[rootKey]
-	rootCid := rootNode.Cid().String()
-	carFileName := path.Join(outputPath, rootNode.Cid().String()+".car")
-	carF, err := os.Create(carFileName)
-	if err != nil {
-		return "", "", "", nil, err
-	}
-	defer carF.Close()
-	selector := allSelector()
-	sc := car.NewSelectiveCar(ctx, bs2, []car.Dag{{Root: rootNode.Cid(), Selector: selector}})
-	err = sc.Write(carF)
-
-	if err != nil {
-		return "", "", "", nil, err
-	}
-	//log.GetLog().Infof("generate car file completed, time elapsed: %s", time.Now().Sub(genCarStartTime))
-
-	fsBuilder := NewFSBuilder(rootNode, dagServ)
-	fsNode, err := fsBuilder.Build()
-	if err != nil {
-		return "", "", "", nil, err
-	}
-	fsNodeBytes, err := json.Marshal(fsNode)
+func (b *carBuilder) buildGraphEx(fileList []util.Finfo, outputPath string) (CarInfo, string, error) {
+	_, carInfo, detail, err := b.buildCar(fileList, "/", outputPath, runtime.NumCPU())
 	if err != nil {
-		return "", "", "", nil, err
+		return CarInfo{}, "", err
 	}
-	detail := fmt.Sprintf("%s", fsNodeBytes)
-
-	return carFileName, rootCid, detail, detailInfo, nil
+	return carInfo, detail, nil
 }
 
 func Import(ctx context.Context, path string, st car.Store) (cid.Cid, error) {
@@ -1038,6 +936,13 @@ func Import(ctx context.Context, path string, st car.Store) (cid.Cid, error) {
 }
 
 func NodeWriteTo(nd files.Node, fpath string) error {
+	return nodeWriteTo(context.Background(), nd, fpath, nil)
+}
+
+func nodeWriteTo(ctx context.Context, nd files.Node, fpath string, progress ProgressFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	switch nd := nd.(type) {
 	case *files.Symlink:
 		return os.Symlink(nd.Target, fpath)
@@ -1047,10 +952,11 @@ func NodeWriteTo(nd files.Node, fpath string) error {
 			return err
 		}
 		defer f.Close()
-		_, err = io.Copy(f, nd)
+		n, err := io.Copy(f, &progressReader{ctx: ctx, r: nd})
 		if err != nil {
 			return err
 		}
+		progress.report(ProgressEvent{Type: ProgressFileRestored, Path: fpath, Bytes: n})
 		return nil
 	case files.Directory:
 		if !util.ExistDir(fpath) {
@@ -1063,7 +969,7 @@ func NodeWriteTo(nd files.Node, fpath string) error {
 		entries := nd.Entries()
 		for entries.Next() {
 			child := filepath.Join(fpath, entries.Name())
-			if err := NodeWriteTo(entries.Node(), child); err != nil {
+			if err := nodeWriteTo(ctx, entries.Node(), child, progress); err != nil {
 				return err
 			}
 		}
@@ -1073,79 +979,97 @@ func NodeWriteTo(nd files.Node, fpath string) error {
 	}
 }
 
-func carTo(carPath, outputDir string, parallel int) {
-	ctx := context.Background()
-	bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
-	rdag := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
-
-	workerCh := make(chan func())
-	go func() {
-		defer close(workerCh)
-		err := filepath.Walk(carPath, func(path string, fi os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if fi.IsDir() {
-				return nil
-			}
-			if strings.ToLower(pa.Ext(fi.Name())) != ".car" {
-				log.GetLog().Warn(path, ", it's not a CAR file, skip it")
-				return nil
-			}
-			workerCh <- func() {
-				log.GetLog().Info(path)
-				root, err := Import(ctx, path, bs2)
-				if err != nil {
-					log.GetLog().Error("import error, ", err)
-					return
-				}
-				nd, err := rdag.Get(ctx, root)
-				if err != nil {
-					log.GetLog().Error("dagService.Get error, ", err)
-					return
-				}
-				file, err := unixfile.NewUnixfsFile(ctx, rdag, nd)
-				if err != nil {
-					log.GetLog().Error("NewUnixfsFile error, ", err)
-					return
-				}
-				err = NodeWriteTo(file, outputDir)
-				if err != nil {
-					log.GetLog().Error("NodeWriteTo error, ", err)
-				}
+// forEachCar walks carPath and calls fn for each CAR file in it, running at
+// most parallel calls at once. It stops at and returns the first error.
+func forEachCar(ctx context.Context, carPath string, parallel int, fn func(ctx context.Context, path string, fi os.FileInfo) error) error {
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(parallel)
+	err := filepath.Walk(carPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if gctx.Err() != nil {
+			return gctx.Err()
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if strings.ToLower(pa.Ext(fi.Name())) != ".car" {
+			log.GetLog().Warn(path, ", it's not a CAR file, skip it")
+			return nil
+		}
+		g.Go(func() error {
+			log.GetLog().Info(path)
+			if err := fn(gctx, path, fi); err != nil {
+				return xerrors.Errorf("%s: %w", path, err)
 			}
 			return nil
 		})
+		return nil
+	})
+	// the error of a task wins over the cancellation it caused in the walk
+	if werr := g.Wait(); werr != nil {
+		return werr
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// openCarFile imports the CAR at path into bs and returns its root as a
+// unixfs file, without the UUID map.
+func openCarFile(ctx context.Context, path string, bs bstore.Blockstore, rdag ipld.DAGService) (cid.Cid, ipld.Node, files.Node, error) {
+	root, err := Import(ctx, path, bs)
+	if err != nil {
+		return cid.Undef, nil, nil, xerrors.Errorf("import: %w", err)
+	}
+	nd, err := rdag.Get(ctx, root)
+	if err != nil {
+		return cid.Undef, nil, nil, xerrors.Errorf("get root %s: %w", root, err)
+	}
+	if nd, err = StripUuidMap(ctx, rdag, nd); err != nil {
+		return cid.Undef, nil, nil, err
+	}
+	file, err := unixfile.NewUnixfsFile(ctx, rdag, nd)
+	if err != nil {
+		return cid.Undef, nil, nil, xerrors.Errorf("open root %s: %w", root, err)
+	}
+	return root, nd, file, nil
+}
+
+func carTo(ctx context.Context, carPath, outputDir string, parallel int, progress ProgressFunc) error {
+	bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	rdag := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
+
+	return forEachCar(ctx, carPath, parallel, func(ctx context.Context, path string, fi os.FileInfo) error {
+		root, nd, file, err := openCarFile(ctx, path, bs2, rdag)
 		if err != nil {
-			log.GetLog().Error("Walk path failed, ", err)
+			return err
 		}
-	}()
-
-	limitCh := make(chan struct{}, parallel)
-	wg := sync.WaitGroup{}
-	func() {
-		for {
-			select {
-			case taskFunc, ok := <-workerCh:
-				if !ok {
-					return
-				}
-				limitCh <- struct{}{}
-				wg.Add(1)
-				go func() {
-					defer func() {
-						<-limitCh
-						wg.Done()
-					}()
-					taskFunc()
-				}()
-			}
+		if err := nodeWriteTo(ctx, file, outputDir, progress); err != nil {
+			return err
 		}
-	}()
-	wg.Wait()
+		if err := RestoreMetadata(ctx, rdag, nd, outputDir); err != nil {
+			return xerrors.Errorf("restore metadata: %w", err)
+		}
+		progress.report(ProgressEvent{Type: ProgressCarFinished, Path: path, Cid: root.String(), Bytes: fi.Size()})
+		return nil
+	})
 }
 
-func merge(dir string, parallel int) {
+func merge(dir string, parallel int) error {
+	var (
+		errMu    sync.Mutex
+		mergeErr error
+	)
+	fail := func(err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		if mergeErr == nil {
+			mergeErr = err
+		}
+	}
 	wg := sync.WaitGroup{}
 	limitCh := make(chan struct{}, parallel)
 	mergeCh := make(chan string)
@@ -1169,9 +1093,17 @@ func merge(dir string, parallel int) {
 					f, err := os.Create(fpath)
 					if err != nil {
 						log.GetLog().Error("Create file failed, ", err)
+						fail(err)
 						return
 					}
 					defer f.Close()
+					// the merged file takes the mode and mtime restored on
+					// its first part
+					first, err := os.Stat(fpath + ".00000000")
+					if err != nil {
+						fail(err)
+						return
+					}
 					for i := 0; ; i++ {
 						chunkPath := fmt.Sprintf("%s.%08d", fpath, i)
 						err := func(path string) error {
@@ -1186,6 +1118,7 @@ func merge(dir string, parallel int) {
 							_, err = io.Copy(f, chunkF)
 							if err != nil {
 								log.GetLog().Error("io.Copy failed, ", err)
+								fail(xerrors.Errorf("merge %s: %w", path, err))
 							}
 							return err
 						}(chunkPath)
@@ -1194,10 +1127,18 @@ func merge(dir string, parallel int) {
 							break
 						}
 					}
+					if err := os.Chmod(fpath, first.Mode().Perm()); err != nil {
+						fail(err)
+					}
+					if err := os.Chtimes(fpath, first.ModTime(), first.ModTime()); err != nil {
+						fail(err)
+					}
 				}()
 			}
 		}
 	}()
+	// find the files first, merging removes the parts from the walked tree
+	var fpaths []string
 	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -1210,15 +1151,20 @@ func merge(dir string, parallel int) {
 			log.GetLog().Error("filepath.Match failed, ", err)
 			return nil
 		} else if matched {
-			mergeCh <- strings.TrimSuffix(path, ".00000000")
+			fpaths = append(fpaths, strings.TrimSuffix(path, ".00000000"))
 		}
 		return nil
 	})
 	if err != nil {
 		log.GetLog().Error("Walk path failed, ", err)
+		fail(err)
+	}
+	for _, fpath := range fpaths {
+		mergeCh <- fpath
 	}
 	close(mergeCh)
 	wg.Wait()
+	return mergeErr
 }
 
 var ErrInvalidDirectoryEntry = errors.New("invalid directory entry name")
@@ -1280,7 +1226,10 @@ func exportFileInCar(nd ipfsfiles.Node, fpath string) error {
 	}
 }
 
-func exportFileInCarByName(nd ipfsfiles.Node, fpath string, targetName string) error {
+func exportFileInCarByName(ctx context.Context, nd ipfsfiles.Node, fpath string, targetName string, progress ProgressFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if _, err := os.Lstat(fpath); err == nil {
 		log.GetLog().Info("error export file to:", fpath)
 		return ErrPathExistsOverwrite
@@ -1298,10 +1247,11 @@ func exportFileInCarByName(nd ipfsfiles.Node, fpath string, targetName string) e
 			if err != nil {
 				return err
 			}
-			_, err = io.Copy(f, nd)
+			n, err := io.Copy(f, &progressReader{ctx: ctx, r: nd})
 			if err != nil {
 				return err
 			}
+			progress.report(ProgressEvent{Type: ProgressFileRestored, Path: fpath, Bytes: n})
 		}
 		return nil
 	case ipfsfiles.Directory:
@@ -1320,7 +1270,7 @@ func exportFileInCarByName(nd ipfsfiles.Node, fpath string, targetName string) e
 				return ErrInvalidDirectoryEntry
 			}
 			child := filepath.Join(fpath, entryName)
-			if err := exportFileInCarByName(entries.Node(), child, targetName); err != nil {
+			if err := exportFileInCarByName(ctx, entries.Node(), child, targetName, progress); err != nil {
 				return err
 			}
 		}
@@ -1330,74 +1280,19 @@ func exportFileInCarByName(nd ipfsfiles.Node, fpath string, targetName string) e
 	}
 }
 
-func extractFromCar(carPath, outputDir string, inFileName string) {
-	ctx := context.Background()
+func extractFromCar(ctx context.Context, carPath, outputDir string, inFileName string, progress ProgressFunc) error {
 	bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
 	rdag := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
 
-	workerCh := make(chan func())
-	go func() {
-		defer close(workerCh)
-		err := filepath.Walk(carPath, func(path string, fi os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if fi.IsDir() {
-				return nil
-			}
-			if strings.ToLower(pa.Ext(fi.Name())) != ".car" {
-				log.GetLog().Warn(path, ", it's not a CAR file, skip it")
-				return nil
-			}
-			workerCh <- func() {
-				log.GetLog().Info(path)
-				root, err := Import(ctx, path, bs2)
-				if err != nil {
-					log.GetLog().Error("import error, ", err)
-					return
-				}
-				nd, err := rdag.Get(ctx, root)
-				if err != nil {
-					log.GetLog().Error("dagService.Get error, ", err)
-					return
-				}
-				file, err := unixfile.NewUnixfsFile(ctx, rdag, nd)
-				if err != nil {
-					log.GetLog().Error("NewUnixfsFile error, ", err)
-					return
-				}
-				err = exportFileInCarByName(file, outputDir, inFileName)
-				if err != nil {
-					log.GetLog().Error("NodeWriteTo error, ", err)
-				}
-			}
-			return nil
-		})
+	return forEachCar(ctx, carPath, runtime.NumCPU(), func(ctx context.Context, path string, fi os.FileInfo) error {
+		root, _, file, err := openCarFile(ctx, path, bs2, rdag)
 		if err != nil {
-			log.GetLog().Error("Walk path failed, ", err)
+			return err
 		}
-	}()
-
-	limitCh := make(chan struct{}, runtime.NumCPU())
-	wg := sync.WaitGroup{}
-	func() {
-		for {
-			select {
-			case taskFunc, ok := <-workerCh:
-				if !ok {
-					return
-				}
-				limitCh <- struct{}{}
-				wg.Add(1)
-				go func() {
-					defer func() {
-						<-limitCh
-						wg.Done()
-					}()
-					taskFunc()
-				}()
-			}
+		if err := exportFileInCarByName(ctx, file, outputDir, inFileName, progress); err != nil {
+			return err
 		}
-	}()
-	wg.Wait()
+		progress.report(ProgressEvent{Type: ProgressCarFinished, Path: path, Cid: root.String(), Bytes: fi.Size()})
+		return nil
+	})
 }
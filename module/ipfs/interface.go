@@ -1,20 +1,15 @@
 package ipfs
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	log "github.com/FogMeta/meta-lib/logs"
 	"github.com/FogMeta/meta-lib/util"
 	carv2 "github.com/ipld/go-car/v2"
-	"github.com/ipld/go-car/v2/blockstore"
-	"github.com/ipld/go-ipld-prime"
-	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"golang.org/x/xerrors"
-	"io"
 	"os"
-	"path/filepath"
 	"runtime"
+	"sync"
 )
 
 type DetailInfo struct {
@@ -23,50 +18,87 @@ type DetailInfo struct {
 	FileSize int64  `json:"file_size"`
 	CID      string `json:"cid"`
 	UUID     string `json:"uuid"`
+	// Split is set for a part of a file split across CARs.
+	Split *SplitInfo `json:"split,omitempty"`
+}
+
+// SplitInfo describes one part of a file that was split across CARs. The
+// part holds the bytes Start to End of the original file, both inclusive.
+// When the file is split along its DAG, FileCid of the last part is the CID
+// of the whole file, the one `ipfs add` gives it, and the nodes that tie the
+// parts together are in the CAR of the last part.
+type SplitInfo struct {
+	OriginalPath string `json:"original_path"`
+	OriginalSize int64  `json:"original_size"`
+	Part         int    `json:"part"`
+	Parts        int    `json:"parts"`
+	Start        int64  `json:"start"`
+	End          int64  `json:"end"`
+	Sha256       string `json:"sha256"`
+	FileCid      string `json:"file_cid,omitempty"`
 }
 
 type CarInfo struct {
-	CarFilePath string       `json:"car_file_path"`
-	CarFileName string       `json:"car_file_name"`
-	RootCid     string       `json:"root_cid"`
-	PieceCID    string       `json:"piece_cid"`
-	PieceSize   int64        `json:"piece_size"`
-	Details     []DetailInfo `json:"details"`
+	CarFilePath string `json:"car_file_path"`
+	CarFileName string `json:"car_file_name"`
+	RootCid     string `json:"root_cid"`
+	PieceCID    string `json:"piece_cid"`
+	PieceSize   int64  `json:"piece_size"`
+	CarSize     int64  `json:"car_size"`
+	// DedupSize is the size of the duplicate blocks which were stored only once.
+	DedupSize int64        `json:"dedup_size"`
+	Details   []DetailInfo `json:"details"`
 }
 
-func ListCarFile(destCar string) ([]string, error) {
-	infoList := make([]string, 0)
+// SkipReason tells why a file was left out of the CARs.
+type SkipReason string
+
+const (
+	// SkipOversized is a file bigger than the slice size, when splitting is
+	// turned off by WithSkipOversized.
+	SkipOversized SkipReason = "oversized"
+	// SkipUnreadable is a file or directory that could not be scanned.
+	SkipUnreadable SkipReason = "unreadable"
+	// SkipFailedCar is a file of a CAR that could not be built.
+	SkipFailedCar SkipReason = "failed-car"
+)
 
-	bs, err := blockstore.OpenReadOnly(destCar)
-	if err != nil {
-		return infoList, err
-	}
-	ls := cidlink.DefaultLinkSystem()
-	ls.TrustedStorage = true
-	ls.StorageReadOpener = func(_ ipld.LinkContext, l ipld.Link) (io.Reader, error) {
-		cl, ok := l.(cidlink.Link)
-		if !ok {
-			return nil, fmt.Errorf("not a cidlink")
-		}
+type SkippedFile struct {
+	Path   string     `json:"path"`
+	Size   int64      `json:"size"`
+	Reason SkipReason `json:"reason"`
+	Err    string     `json:"error,omitempty"`
+}
 
-		blk, err := bs.Get(context.Background(), cl.Cid)
-		if err != nil {
-			return nil, err
-		}
-		return bytes.NewBuffer(blk.RawData()), nil
+// BuildResult is the outcome of a generation run.
+type BuildResult struct {
+	Cars    []CarInfo     `json:"cars"`
+	Skipped []SkippedFile `json:"skipped"`
+}
+
+// SkipError stops a strict run at the first skipped file.
+type SkipError struct {
+	File SkippedFile
+}
+
+func (e *SkipError) Error() string {
+	if e.File.Err != "" {
+		return fmt.Sprintf("%s skipped, %s: %s", e.File.Path, e.File.Reason, e.File.Err)
 	}
+	return fmt.Sprintf("%s skipped, %s", e.File.Path, e.File.Reason)
+}
 
-	roots, err := bs.Roots()
+// ListCarFile returns a line per entry of the CAR at destCar, see
+// ListCarEntries for the entries themselves.
+func ListCarFile(destCar string) ([]string, error) {
+	infoList := make([]string, 0)
+	entries, err := ListCarEntries(destCar)
 	if err != nil {
 		return infoList, err
 	}
-
-	for _, r := range roots {
-		if err := printLinksNode("", r, &ls, &infoList); err != nil {
-			return infoList, err
-		}
+	for _, e := range entries {
+		infoList = append(infoList, fmt.Sprintf("%s     CID:%s     UUID:%s     SIZE:%d\n", e.Path, e.Cid, e.Uuid, e.DagSize))
 	}
-
 	return infoList, nil
 }
 
@@ -88,22 +120,35 @@ func GetCarRoot(destCar string) (string, error) {
 	return root, nil
 }
 
-func GenerateCarFromFiles(outputDir string, srcFiles []string, sliceSize int64) (string, error) {
+func GenerateCarFromFiles(outputDir string, srcFiles []string, sliceSize int64, opts ...Option) (string, error) {
+	return GenerateCarFromFilesContext(context.Background(), outputDir, srcFiles, sliceSize, nil, opts...)
+}
+
+// GenerateCarFromFilesContext is GenerateCarFromFiles that stops once ctx is
+// done and sends progress events to progress, which may be nil.
+func GenerateCarFromFilesContext(ctx context.Context, outputDir string, srcFiles []string, sliceSize int64, progress ProgressFunc, opts ...Option) (string, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return "", err
+	}
 
 	if !util.ExistDir(outputDir) {
 		return "", xerrors.Errorf("Unexpected! The path of output dir does not exist")
 	}
 
 	var totalSize int64 = 0
-	files := util.GetFileListAsync(srcFiles, false)
+	files := util.GetFileListAsyncOptions(ctx, srcFiles, false, o.scanOptions())
 	for item := range files {
-		totalSize += item.Info.Size()
+		totalSize += item.Size()
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
 	if totalSize > sliceSize {
 		return "", xerrors.Errorf("Total files size has been bigger than sliceSize(%u)", sliceSize)
 	}
 
-	carFileName, _, err := doGenerateCarFrom(outputDir, srcFiles)
+	carFileName, _, err := newCarBuilder(ctx, progress, o).doGenerateCarFrom(outputDir, srcFiles)
 	if err != nil {
 		return "", err
 	}
@@ -111,22 +156,35 @@ func GenerateCarFromFiles(outputDir string, srcFiles []string, sliceSize int64)
 	return carFileName, nil
 }
 
-func GenerateCarFromDir(outputDir string, srcDir string, sliceSize int64) (string, error) {
+func GenerateCarFromDir(outputDir string, srcDir string, sliceSize int64, opts ...Option) (string, error) {
+	return GenerateCarFromDirContext(context.Background(), outputDir, srcDir, sliceSize, nil, opts...)
+}
+
+// GenerateCarFromDirContext is GenerateCarFromDir that stops once ctx is done
+// and sends progress events to progress, which may be nil.
+func GenerateCarFromDirContext(ctx context.Context, outputDir string, srcDir string, sliceSize int64, progress ProgressFunc, opts ...Option) (string, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return "", err
+	}
 
 	if !util.ExistDir(outputDir) {
 		return "", xerrors.Errorf("Unexpected! The path of output dir does not exist")
 	}
 
 	var totalSize int64 = 0
-	files := util.GetFileListAsync([]string{srcDir}, false)
+	files := util.GetFileListAsyncOptions(ctx, []string{srcDir}, false, o.scanOptions())
 	for item := range files {
-		totalSize += item.Info.Size()
+		totalSize += item.Size()
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
 	if totalSize > sliceSize {
 		return "", xerrors.Errorf("Total files size has been bigger than sliceSize(%u)", sliceSize)
 	}
 
-	carFileName, _, err := doGenerateCarFrom(outputDir, []string{srcDir})
+	carFileName, _, err := newCarBuilder(ctx, progress, o).doGenerateCarFrom(outputDir, []string{srcDir})
 	if err != nil {
 		return "", err
 	}
@@ -134,90 +192,328 @@ func GenerateCarFromDir(outputDir string, srcDir string, sliceSize int64) (strin
 	return carFileName, nil
 }
 
-func GenerateCarFromDirEx(outputDir string, srcDir string, sliceSize int64, withUUID bool) ([]CarInfo, error) {
+func GenerateCarFromDirEx(outputDir string, srcDir string, sliceSize int64, withUUID bool, opts ...Option) ([]CarInfo, error) {
+	return GenerateCarFromDirExContext(context.Background(), outputDir, srcDir, sliceSize, withUUID, nil, opts...)
+}
+
+// GenerateCarFromDirExContext is GenerateCarFromDirEx that stops once ctx is
+// done and sends progress events to progress, which may be nil.
+func GenerateCarFromDirExContext(ctx context.Context, outputDir string, srcDir string, sliceSize int64, withUUID bool, progress ProgressFunc, opts ...Option) ([]CarInfo, error) {
+	result, err := GenerateCarFromDirResult(ctx, outputDir, srcDir, sliceSize, withUUID, progress, opts...)
+	return result.Cars, err
+}
+
+// GenerateCarFromDirResult is GenerateCarFromDirExContext that also reports
+// the files it left out. With WithStrict it stops at the first of them and
+// returns a *SkipError; the CARs built until then stay in the result.
+func GenerateCarFromDirResult(ctx context.Context, outputDir string, srcDir string, sliceSize int64, withUUID bool, progress ProgressFunc, opts ...Option) (BuildResult, error) {
+	result := BuildResult{Cars: make([]CarInfo, 0)}
+	o, err := newOptions(opts...)
+	if err != nil {
+		return result, err
+	}
 
 	if !util.ExistDir(outputDir) {
-		return nil, xerrors.Errorf("Unexpected! The path of output dir does not exist")
+		return result, xerrors.Errorf("Unexpected! The path of output dir does not exist")
 	}
+	if withUUID && o.Deterministic {
+		return result, xerrors.Errorf("random UUIDs can not be used in deterministic mode")
+	}
+
+	run := struct {
+		SrcDir    string  `json:"src_dir"`
+		SliceSize int64   `json:"slice_size"`
+		WithUUID  bool    `json:"with_uuid"`
+		Options   Options `json:"options"`
+	}{srcDir, sliceSize, withUUID, o}
+	return generateCars(ctx, outputDir, sliceSize, progress, o, run, fileSource{
+		scan: func(ctx context.Context, onError func(string, error)) <-chan util.Finfo {
+			scan := o.scanOptions()
+			scan.OnError = onError
+			return util.GetFileListAsyncOptions(ctx, []string{srcDir}, withUUID, scan)
+		},
+	})
+}
+
+// fileSource gives generateCars its files. scan reports the files it can not
+// read to onError, stat returns the info of a directory the files are in,
+// os.Stat when nil.
+type fileSource struct {
+	scan func(ctx context.Context, onError func(string, error)) <-chan util.Finfo
+	stat func(path string) (os.FileInfo, error)
+}
 
-	files := util.GetFileListAsync([]string{srcDir}, withUUID)
+// generateCars builds the CARs of the files of src into outputDir, for
+// GenerateCarFromDirResult, GenerateCarFromManifest, GenerateCarFromArchive
+// and GenerateCarFromFS. run are the inputs recorded in the journal of the
+// run.
+func generateCars(ctx context.Context, outputDir string, sliceSize int64, progress ProgressFunc, o Options, run interface{}, src fileSource) (BuildResult, error) {
+	result := BuildResult{Cars: make([]CarInfo, 0)}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// unreadable files are reported by the scanning goroutine
+	var lock sync.Mutex
+	var scanSkipped []SkippedFile
+	onError := func(path string, err error) {
+		lock.Lock()
+		scanSkipped = append(scanSkipped, SkippedFile{Path: path, Reason: SkipUnreadable, Err: err.Error()})
+		lock.Unlock()
+	}
+	// skip adds the skipped files to result, it returns an error in strict mode
+	skip := func(files ...SkippedFile) error {
+		result.Skipped = append(result.Skipped, files...)
+		if o.Strict && len(files) > 0 {
+			cancel()
+			return &SkipError{File: files[0]}
+		}
+		return nil
+	}
+	takeScanSkipped := func() []SkippedFile {
+		lock.Lock()
+		defer lock.Unlock()
+		files := scanSkipped
+		scanSkipped = nil
+		return files
+	}
+
+	b := newCarBuilder(ctx, progress, o)
+	if src.stat != nil {
+		b.stat = src.stat
+	}
+	var journal *Journal
+	var journaled []JournalEntry
+	var resumed resumeState
+	if o.Resume {
+		var err error
+		journal, err = OpenJournal(outputDir, run)
+		if err != nil {
+			return result, err
+		}
+		defer journal.Close()
+		journaled = journal.Entries()
+		for _, e := range journaled {
+			result.Cars = append(result.Cars, e.Car)
+		}
+		if len(journaled) > 0 {
+			if err := b.restoreSplits(journaled[len(journaled)-1].Splits); err != nil {
+				return result, err
+			}
+		}
+		resumed = newResumeState(journaled)
+	}
+	// a failed journal ends the run instead of skipping the files of the CAR
+	var recordErr error
+	if journal != nil {
+		b.commit = func(carInfo CarInfo, place func() error) error {
+			var placeErr error
+			err := journal.Commit(JournalEntry{Car: carInfo, Splits: b.splitStates()}, func() error {
+				placeErr = place()
+				return placeErr
+			})
+			if err != nil && err != placeErr {
+				recordErr = err
+			}
+			return err
+		}
+	}
+	files := src.scan(ctx, onError)
 	accSize := int64(0)
-	accFiles := make([]string, 0)
-	accUUIDs := make([]string, 0)
-	remainFiles := make([]string, 0)
-	buildCars := make([]CarInfo, 0)
-	for item := range files {
-		fileSize := item.Info.Size()
-		if fileSize > sliceSize {
-			log.GetLog().Errorf("%s size is %d and bigger than: %d", item.Path, fileSize, sliceSize)
-			remainFiles = append(remainFiles, item.Path)
-			continue
+	accFiles := make([]util.Finfo, 0)
+	// build makes a CAR of accFiles and starts a new one, the files are
+	// skipped when it fails
+	build := func() error {
+		files := accFiles
+		carInfo, detailStr, err := b.buildGraphEx(files, outputDir)
+		accSize = int64(0)
+		accFiles = make([]util.Finfo, 0)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if recordErr != nil {
+				return recordErr
+			}
+			log.GetLog().Error("generate CAR file error:", err)
+			failed := make([]SkippedFile, 0, len(files))
+			for _, item := range files {
+				failed = append(failed, SkippedFile{Path: item.Path, Size: item.Size(), Reason: SkipFailedCar, Err: err.Error()})
+			}
+			return skip(failed...)
 		}
 
-		if (accSize + fileSize) > sliceSize {
-			if len(accFiles) != len(accUUIDs) {
-				log.GetLog().Error("The length of accFiles should be the same as the length of accUUIDs.")
+		//one CAR generated
+		log.GetLog().Debug("Create CAR: ", carInfo.CarFilePath)
+		log.GetLog().Debug("Create Detail: ", detailStr)
+
+		result.Cars = append(result.Cars, carInfo)
+		return nil
+	}
+	if o.Pack {
+		// the CARs are planned once all the files are scanned
+		var scanned []util.Finfo
+		for item := range files {
+			progress.report(ProgressEvent{Type: ProgressFileScanned, Path: item.Path, Bytes: item.Size()})
+			scanned = append(scanned, item)
+		}
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		plans, oversized := o.planCars(scanned, sliceSize)
+		if err := skip(append(takeScanSkipped(), oversized...)...); err != nil {
+			return result, err
+		}
+		for i, plan := range plans {
+			// the plans are the same as in the run that is resumed
+			if i < len(journaled) {
+				if car := journaled[i].Car; !sameFiles(car, plan.Files) {
+					return result, xerrors.Errorf("the files of %s changed since it was built", car.CarFileName)
+				}
 				continue
 			}
-
-			carFile, rootCid, detailStr, detaiInfo, err := doGenerateCarWithUuidEx(outputDir, accFiles, accUUIDs)
-			if err != nil {
-				log.GetLog().Error("generate CAR file error:", err)
-				//TODO: move accFiles to remainFiles
+			for _, item := range plan.Files {
+				if item.Parts == 0 || item.Part > 0 {
+					continue
+				}
+				// the parts are cut at subtree boundaries when they can be
+				size := item.SeekEnd + 1
+				if span, depth := o.splitSpan(size); span > 0 && size%span == 0 {
+					b.startSplit(item.Path, depth)
+				}
+			}
+			accFiles = plan.Files
+			if err := build(); err != nil {
+				return result, err
+			}
+		}
+		return result, writeResultManifest(outputDir, o.Manifest, result)
+	}
+	for item := range files {
+		if err := skip(takeScanSkipped()...); err != nil {
+			return result, err
+		}
+		fileSize := item.Size()
+		progress.report(ProgressEvent{Type: ProgressFileScanned, Path: item.Path, Bytes: fileSize})
+		if resumed.files[item.Path] {
+			continue
+		}
+		if fileSize > sliceSize {
+			if o.SkipOversized {
+				log.GetLog().Errorf("%s size is %d and bigger than: %d", item.Path, fileSize, sliceSize)
+				if err := skip(SkippedFile{Path: item.Path, Size: fileSize, Reason: SkipOversized}); err != nil {
+					return result, err
+				}
 				continue
 			}
-
-			//one CAR generated
-			log.GetLog().Debug("Create CAR: ", carFile)
-			log.GetLog().Debug("Create Detail: ", detailStr)
-
-			buildCars = append(buildCars, CarInfo{
-				CarFilePath: carFile,
-				CarFileName: filepath.Base(carFile),
-				RootCid:     rootCid,
-				Details:     detaiInfo,
-			})
-
-			accSize = int64(0)
-			accFiles = accFiles[:0] //make([]string, 0)
-			accUUIDs = accUUIDs[:0]
+			// the first part fills up the current CAR, the last one starts the
+			// next, parts split along the DAG are cut at subtree boundaries
+			first, size := sliceSize-accSize, sliceSize
+			span, depth := o.splitSpan(sliceSize)
+			if span > 0 {
+				first, size = first/span*span, size/span*span
+			}
+			done := resumed.parts[item.Path]
+			switch {
+			case len(done) > 0:
+				// the parts are cut as in the run that is resumed, which
+				// also left the state of the split in its journal
+				first = done[0].End + 1
+			default:
+				// a full CAR is built first, it has no room for a part
+				if first == 0 {
+					if err := build(); err != nil {
+						return result, err
+					}
+					first = size
+				}
+				if span > 0 {
+					b.startSplit(item.Path, depth)
+				}
+			}
+			for _, part := range splitFile(item, first, size)[len(done):] {
+				accSize += part.SeekEnd - part.SeekStart + 1
+				accFiles = append(accFiles, part)
+				if part.Part == part.Parts-1 && accSize < sliceSize {
+					continue
+				}
+				if err := build(); err != nil {
+					return result, err
+				}
+			}
 			continue
 		}
 
+		if (accSize + fileSize) > sliceSize {
+			if err := build(); err != nil {
+				return result, err
+			}
+		}
+
 		accSize += fileSize
-		accFiles = append(accFiles, item.Path)
-		accUUIDs = append(accUUIDs, item.Uuid)
+		accFiles = append(accFiles, item)
 	}
 
-	if accSize > 0 {
-		if len(accFiles) != len(accUUIDs) {
-			log.GetLog().Error("The length of accFiles should be the same as the length of accUUIDs.")
-		}
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if err := skip(takeScanSkipped()...); err != nil {
+		return result, err
+	}
 
-		carFile, rootCid, detailStr, detaiInfo, err := doGenerateCarWithUuidEx(outputDir, accFiles, accUUIDs)
-		if err != nil {
-			log.GetLog().Error("generate CAR file error:", err)
-			//TODO: move accFiles to remainFiles
+	if len(accFiles) > 0 {
+		if err := build(); err != nil {
+			return result, err
 		}
-		//one CAR generated
-		log.GetLog().Debug("Create CAR: ", carFile)
-		log.GetLog().Debug("Create Detail: ", detailStr)
+	}
 
-		buildCars = append(buildCars, CarInfo{
-			CarFilePath: carFile,
-			CarFileName: filepath.Base(carFile),
-			RootCid:     rootCid,
-			Details:     detaiInfo,
-		})
+	log.GetLog().Debug("Build CARs Info:", result.Cars)
+	return result, writeResultManifest(outputDir, o.Manifest, result)
+}
 
+// writeResultManifest writes the manifest of the CARs of result to
+// outputDir, unless format is empty.
+func writeResultManifest(outputDir string, format ManifestFormat, result BuildResult) error {
+	if format == "" {
+		return nil
+	}
+	entries := make([]ManifestEntry, 0, len(result.Cars))
+	for _, car := range result.Cars {
+		entries = append(entries, ManifestEntry{CarInfo: car})
 	}
+	return WriteManifest(ManifestPath(outputDir, format), format, entries)
+}
 
-	//TODO: write json file to output dir
-	log.GetLog().Debug("Build CARs Info:", buildCars)
-	return buildCars, nil
+// splitFile cuts item into parts of size bytes, the first one of first bytes.
+func splitFile(item util.Finfo, first, size int64) []util.Finfo {
+	fileSize := item.Info.Size()
+	var parts []util.Finfo
+	for start, end := int64(0), first; start < fileSize; start, end = end, end+size {
+		if end > fileSize {
+			end = fileSize
+		}
+		part := item
+		part.Name = fmt.Sprintf("%s.%08d", item.Name, len(parts))
+		part.SeekStart = start
+		part.SeekEnd = end - 1
+		part.Part = len(parts)
+		parts = append(parts, part)
+	}
+	for i := range parts {
+		parts[i].Parts = len(parts)
+	}
+	return parts
 }
 
-func GenerateCarFromFilesWithUuid(outputDir string, srcFiles []string, uuid []string, sliceSize int64) (string, error) {
+func GenerateCarFromFilesWithUuid(outputDir string, srcFiles []string, uuid []string, sliceSize int64, opts ...Option) (string, error) {
+	return GenerateCarFromFilesWithUuidContext(context.Background(), outputDir, srcFiles, uuid, sliceSize, nil, opts...)
+}
+
+// GenerateCarFromFilesWithUuidContext is GenerateCarFromFilesWithUuid that
+// stops once ctx is done and sends progress events to progress, which may be nil.
+func GenerateCarFromFilesWithUuidContext(ctx context.Context, outputDir string, srcFiles []string, uuid []string, sliceSize int64, progress ProgressFunc, opts ...Option) (string, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return "", err
+	}
 
 	if len(srcFiles) != len(uuid) {
 		return "", xerrors.Errorf("The len of source files and uuids do not match.")
@@ -227,7 +523,7 @@ func GenerateCarFromFilesWithUuid(outputDir string, srcFiles []string, uuid []st
 		return "", xerrors.Errorf("Total files size has been bigger than sliceSize(%u)", sliceSize)
 	}
 
-	carFileName, detailJson, err := doGenerateCarWithUuid(outputDir, srcFiles, uuid)
+	carFileName, detailJson, err := newCarBuilder(ctx, progress, o).doGenerateCarWithUuid(outputDir, srcFiles, uuid)
 	if err != nil {
 		return "", err
 	}
@@ -237,17 +533,26 @@ func GenerateCarFromFilesWithUuid(outputDir string, srcFiles []string, uuid []st
 }
 
 func RestoreCar(outputDir string, srcCar string) error {
+	return RestoreCarContext(context.Background(), outputDir, srcCar, nil)
+}
 
-	parallel := runtime.NumCPU()
-	carTo(srcCar, outputDir, parallel)
-	merge(outputDir, parallel)
-	fmt.Println("completed!")
+// RestoreCarContext is RestoreCar that stops once ctx is done and sends
+// progress events to progress, which may be nil.
+func RestoreCarContext(ctx context.Context, outputDir string, srcCar string, progress ProgressFunc) error {
 
-	return nil
+	parallel := runtime.NumCPU()
+	if err := carTo(ctx, srcCar, outputDir, parallel, progress); err != nil {
+		return err
+	}
+	return merge(outputDir, parallel)
 }
 
 func ExtractFileFromCar(outputDir string, srcCar string, inFileName string) error {
-	extractFromCar(srcCar, outputDir, inFileName)
-	fmt.Println("completed!")
-	return nil
+	return ExtractFileFromCarContext(context.Background(), outputDir, srcCar, inFileName, nil)
+}
+
+// ExtractFileFromCarContext is ExtractFileFromCar that stops once ctx is done
+// and sends progress events to progress, which may be nil.
+func ExtractFileFromCarContext(ctx context.Context, outputDir string, srcCar string, inFileName string, progress ProgressFunc) error {
+	return extractFromCar(ctx, srcCar, outputDir, inFileName, progress)
 }
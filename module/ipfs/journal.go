@@ -0,0 +1,293 @@
+package ipfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/FogMeta/meta-lib/util"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// JournalName is the name of the journal of a run in its output directory.
+const JournalName = ".meta-car.journal"
+
+// Journal records the CARs a run has finished in its output directory, so
+// that a run which died halfway can be resumed. The first line of the
+// journal describes the inputs of the run, every other line is a
+// JournalEntry, written just before its CAR is moved into place.
+type Journal struct {
+	path    string
+	header  []byte
+	f       *os.File
+	entries []JournalEntry
+}
+
+// JournalEntry is a finished CAR of a run.
+type JournalEntry struct {
+	// GraphName is the name given to the CAR by `meta-car build`.
+	GraphName string  `json:"graph_name,omitempty"`
+	Car       CarInfo `json:"car"`
+	// Splits are the files split along their DAG whose last part is not
+	// built yet, with the subtrees of the parts built so far.
+	Splits map[string]journalSplit `json:"splits,omitempty"`
+}
+
+type journalSplit struct {
+	Depth    int           `json:"depth"`
+	Parts    int           `json:"parts"`
+	Subtrees []journalLink `json:"subtrees"`
+}
+
+type journalLink struct {
+	Cid      string `json:"cid"`
+	Size     uint64 `json:"size"`
+	FileSize uint64 `json:"file_size"`
+}
+
+// OpenJournal opens the journal in outputDir of the run with the inputs run,
+// any value encoded as JSON, and creates it when there is none. It fails when
+// the journal is of a run with other inputs. The CARs the earlier run left
+// unfinished are removed, and the last entry when the run died before its CAR
+// was moved into place.
+func OpenJournal(outputDir string, run interface{}) (*Journal, error) {
+	header, err := json.Marshal(run)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(outputDir, JournalName)
+	j := &Journal{path: path, header: header}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		lines := bytes.Split(data, []byte("\n"))
+		var old bytes.Buffer
+		if err := json.Compact(&old, lines[0]); err != nil || !bytes.Equal(old.Bytes(), header) {
+			return nil, xerrors.Errorf("the journal %s is of a run with other inputs", path)
+		}
+		for _, line := range lines[1:] {
+			var e JournalEntry
+			// a line cut short by a crash ends the journal
+			if err := json.Unmarshal(line, &e); err != nil {
+				break
+			}
+			j.entries = append(j.entries, e)
+		}
+		if n := len(j.entries); n > 0 {
+			name := j.entries[n-1].Car.CarFileName
+			if _, err := os.Stat(filepath.Join(outputDir, name)); errors.Is(err, os.ErrNotExist) {
+				j.entries = j.entries[:n-1]
+			}
+		}
+	}
+
+	tmps, err := filepath.Glob(filepath.Join(outputDir, "*.car.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmp := range tmps {
+		if err := os.Remove(tmp); err != nil {
+			return nil, err
+		}
+	}
+
+	// the journal is written again without the line cut short, if any
+	if err := j.rewrite(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// rewrite writes the journal again with the entries in j and opens it to
+// append to.
+func (j *Journal) rewrite() error {
+	var buf bytes.Buffer
+	buf.Write(j.header)
+	buf.WriteByte('\n')
+	for _, e := range j.entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	var err error
+	j.f, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0644)
+	return err
+}
+
+// Entries returns the CARs recorded in the journal, in the order they were
+// finished.
+func (j *Journal) Entries() []JournalEntry {
+	return j.entries
+}
+
+// Done returns the CAR recorded for graphName. It fails when that CAR has
+// other files than files, as the inputs then changed since it was built.
+func (j *Journal) Done(graphName string, files []util.Finfo) (CarInfo, bool, error) {
+	for _, e := range j.entries {
+		if e.GraphName != graphName {
+			continue
+		}
+		if !sameFiles(e.Car, files) {
+			return CarInfo{}, false, xerrors.Errorf("the files of %s changed since %s was built", graphName, e.Car.CarFileName)
+		}
+		return e.Car, true, nil
+	}
+	return CarInfo{}, false, nil
+}
+
+// Record adds a finished CAR to the journal, it is on disk when Record
+// returns. The CAR is moved into place after that, so that no CAR in the
+// output directory is missing from the journal.
+func (j *Journal) Record(e JournalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.entries = append(j.entries, e)
+	return nil
+}
+
+// Commit records e and then moves its CAR into place with place. When place
+// fails, its error is returned and e is taken out of the journal again.
+func (j *Journal) Commit(e JournalEntry, place func() error) error {
+	if err := j.Record(e); err != nil {
+		return err
+	}
+	err := place()
+	if err == nil {
+		return nil
+	}
+	j.entries = j.entries[:len(j.entries)-1]
+	if rerr := j.rewrite(); rerr != nil {
+		return xerrors.Errorf("remove %s from the journal after %v: %w", e.Car.CarFileName, err, rerr)
+	}
+	return err
+}
+
+func (j *Journal) Close() error {
+	if j.f == nil {
+		return nil
+	}
+	return j.f.Close()
+}
+
+// sameFiles tells whether car holds files, in any order.
+func sameFiles(car CarInfo, files []util.Finfo) bool {
+	if len(car.Details) != len(files) {
+		return false
+	}
+	key := func(path string, start int64) string {
+		return fmt.Sprintf("%s@%d", path, start)
+	}
+	count := make(map[string]int)
+	for _, d := range car.Details {
+		var start int64
+		if d.Split != nil {
+			start = d.Split.Start
+		}
+		count[key(d.FilePath, start)]++
+	}
+	for _, item := range files {
+		var start int64
+		if item.Parts > 0 {
+			start = item.SeekStart
+		}
+		if count[key(item.Path, start)] == 0 {
+			return false
+		}
+		count[key(item.Path, start)]--
+	}
+	return true
+}
+
+// resumeState is what a run resumed from its journal has done already.
+type resumeState struct {
+	// files are the files all in finished CARs
+	files map[string]bool
+	// parts are the finished parts of the files split in the finished CARs,
+	// in order, when the last part is not finished yet
+	parts map[string][]SplitInfo
+}
+
+func newResumeState(entries []JournalEntry) resumeState {
+	s := resumeState{files: make(map[string]bool), parts: make(map[string][]SplitInfo)}
+	for _, e := range entries {
+		for _, d := range e.Car.Details {
+			switch {
+			case d.Split == nil:
+				s.files[d.FilePath] = true
+			case d.Split.Part == d.Split.Parts-1:
+				s.files[d.FilePath] = true
+				delete(s.parts, d.FilePath)
+			default:
+				s.parts[d.FilePath] = append(s.parts[d.FilePath], *d.Split)
+			}
+		}
+	}
+	return s
+}
+
+// splitStates returns the files being split along their DAG, to be recorded
+// in the journal.
+func (b *carBuilder) splitStates() map[string]journalSplit {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.splits) == 0 {
+		return nil
+	}
+	states := make(map[string]journalSplit, len(b.splits))
+	for path, sp := range b.splits {
+		st := journalSplit{Depth: sp.depth, Parts: sp.parts}
+		for _, l := range sp.subtrees {
+			st.Subtrees = append(st.Subtrees, journalLink{Cid: l.cid.String(), Size: l.size, FileSize: l.fileSize})
+		}
+		states[path] = st
+	}
+	return states
+}
+
+// restoreSplits continues the files being split along their DAG recorded in
+// the journal.
+func (b *carBuilder) restoreSplits(states map[string]journalSplit) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for path, st := range states {
+		sp := &fileSplit{depth: st.Depth, parts: st.Parts}
+		for _, l := range st.Subtrees {
+			c, err := cid.Decode(l.Cid)
+			if err != nil {
+				return xerrors.Errorf("journal of %s: %w", path, err)
+			}
+			sp.subtrees = append(sp.subtrees, splitLink{cid: c, size: l.Size, fileSize: l.FileSize})
+		}
+		b.splits[path] = sp
+	}
+	return nil
+}
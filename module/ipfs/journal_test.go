@@ -0,0 +1,168 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FogMeta/meta-lib/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResume(t *testing.T) {
+	src := t.TempDir()
+	writeRandomFiles(t, src, map[string]int{"a-small": 5, "b-big": 5000, "c": 100})
+	opts := []Option{WithChunkSize(256), WithMaxLinks(4), WithDeterministic(true), WithResume(true)}
+
+	carDir := t.TempDir()
+	full, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, nil, opts...)
+	require.NoError(t, err)
+	require.Len(t, full.Cars, 3)
+
+	// a run that died while building its second CAR, in the middle of b-big
+	journal := filepath.Join(carDir, JournalName)
+	data, err := os.ReadFile(journal)
+	require.NoError(t, err)
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	require.NoError(t, os.WriteFile(journal, append(bytes.Join(lines[:2], nil), `{"car":{"car_file`...), 0644))
+	for _, car := range full.Cars[1:] {
+		require.NoError(t, os.Remove(car.CarFilePath))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(carDir, "partial.car.tmp"), []byte("partial"), 0644))
+
+	resumed, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, nil, opts...)
+	require.NoError(t, err)
+	require.Equal(t, full.Cars, resumed.Cars)
+	_, err = os.Stat(filepath.Join(carDir, "partial.car.tmp"))
+	require.True(t, os.IsNotExist(err))
+	for _, car := range resumed.Cars {
+		_, err := os.Stat(car.CarFilePath)
+		require.NoError(t, err)
+	}
+
+	out := t.TempDir()
+	require.NoError(t, RestoreCar(out, carDir))
+	got, err := os.ReadFile(filepath.Join(out, src, "b-big"))
+	require.NoError(t, err)
+	want, err := os.ReadFile(filepath.Join(src, "b-big"))
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// nothing is left to do on a third run, other inputs are refused
+	again, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, nil, opts...)
+	require.NoError(t, err)
+	require.Equal(t, full.Cars, again.Cars)
+	_, err = GenerateCarFromDirResult(context.Background(), carDir, src, 4096, false, nil, opts...)
+	require.Error(t, err)
+}
+
+func TestJournalBeforePlace(t *testing.T) {
+	src := t.TempDir()
+	writeRandomFiles(t, src, map[string]int{"a-small": 5, "b-big": 5000, "c": 100})
+	opts := []Option{WithChunkSize(256), WithMaxLinks(4), WithDeterministic(true), WithResume(true)}
+
+	carDir := t.TempDir()
+	full, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, nil, opts...)
+	require.NoError(t, err)
+	require.Len(t, full.Cars, 3)
+
+	// a run that died after journaling its second CAR, before moving it
+	// into place
+	journal := filepath.Join(carDir, JournalName)
+	data, err := os.ReadFile(journal)
+	require.NoError(t, err)
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	require.NoError(t, os.WriteFile(journal, bytes.Join(lines[:3], nil), 0644))
+	require.NoError(t, os.Rename(full.Cars[1].CarFilePath, filepath.Join(carDir, "second.car.tmp")))
+	require.NoError(t, os.Remove(full.Cars[2].CarFilePath))
+
+	resumed, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, nil, opts...)
+	require.NoError(t, err)
+	require.Equal(t, full.Cars, resumed.Cars)
+	for _, car := range resumed.Cars {
+		_, err := os.Stat(car.CarFilePath)
+		require.NoError(t, err)
+	}
+	tmps, err := filepath.Glob(filepath.Join(carDir, "*.car.tmp"))
+	require.NoError(t, err)
+	require.Empty(t, tmps)
+
+	// a CAR the journal failed to record is not moved into place
+	files, err := ScanFiles(context.Background(), []string{src}, false)
+	require.NoError(t, err)
+	var fileList []util.Finfo
+	for item := range files {
+		fileList = append(fileList, item)
+	}
+	carDir = t.TempDir()
+	b := newCarBuilder(context.Background(), nil, defaultOptions())
+	b.commit = func(carInfo CarInfo, place func() error) error {
+		_, err := os.Stat(carInfo.CarFilePath)
+		require.True(t, os.IsNotExist(err))
+		return errors.New("disk full")
+	}
+	_, _, _, err = b.buildCar(fileList, src, carDir, 2)
+	require.EqualError(t, err, "disk full")
+	left, err := os.ReadDir(carDir)
+	require.NoError(t, err)
+	require.Empty(t, left)
+
+	// BuildIpldGraph records its CARs under their graph names
+	j, err := OpenJournal(carDir, "run")
+	require.NoError(t, err)
+	defer j.Close()
+	carInfo, err := BuildIpldGraph(fileList, "graph-0", src, carDir, 2, WithJournal(j))
+	require.NoError(t, err)
+	require.Equal(t, []JournalEntry{{GraphName: "graph-0", Car: carInfo}}, j.Entries())
+	done, ok, err := j.Done("graph-0", fileList)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, carInfo, done)
+}
+
+func TestJournalPlaceFails(t *testing.T) {
+	src := t.TempDir()
+	writeRandomFiles(t, src, map[string]int{"a": 1500, "b": 1500, "c": 1500})
+	opts := []Option{WithChunkSize(256), WithMaxLinks(4), WithDeterministic(true), WithResume(true)}
+	full, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 2048, false, nil, opts...)
+	require.NoError(t, err)
+	require.Len(t, full.Cars, 3)
+
+	// the first CAR can not be moved into place over a directory
+	carDir := t.TempDir()
+	blocker := filepath.Join(carDir, full.Cars[0].CarFileName)
+	require.NoError(t, os.MkdirAll(filepath.Join(blocker, "in-the-way"), 0755))
+	failed, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, nil, opts...)
+	require.NoError(t, err)
+	require.Len(t, failed.Cars, 2)
+	require.Len(t, failed.Skipped, 1)
+
+	data, err := os.ReadFile(filepath.Join(carDir, JournalName))
+	require.NoError(t, err)
+	var names []string
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n"))[1:] {
+		var e JournalEntry
+		require.NoError(t, json.Unmarshal(line, &e))
+		names = append(names, e.Car.CarFileName)
+	}
+	require.Equal(t, []string{full.Cars[1].CarFileName, full.Cars[2].CarFileName}, names)
+
+	// the resumed run builds the files of the CAR that failed again
+	require.NoError(t, os.RemoveAll(blocker))
+	resumed, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, nil, opts...)
+	require.NoError(t, err)
+	require.Len(t, resumed.Cars, 3)
+	out := t.TempDir()
+	require.NoError(t, RestoreCar(out, carDir))
+	for _, name := range []string{"a", "b", "c"} {
+		want, err := os.ReadFile(filepath.Join(src, name))
+		require.NoError(t, err)
+		got, err := os.ReadFile(filepath.Join(out, src, name))
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
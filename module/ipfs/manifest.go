@@ -0,0 +1,207 @@
+package ipfs
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/xerrors"
+)
+
+// ManifestFormat is the file format of a manifest.
+type ManifestFormat string
+
+// Manifest formats accepted by WithManifest.
+const (
+	// ManifestCSV has a header line and a line per CAR, the file details
+	// are a JSON array in the last column.
+	ManifestCSV ManifestFormat = "csv"
+	// ManifestJSON is a JSON array of the entries.
+	ManifestJSON ManifestFormat = "json"
+	// ManifestNDJSON has one JSON entry per line.
+	ManifestNDJSON ManifestFormat = "ndjson"
+)
+
+var manifestHeader = []string{"car_file_name", "graph_name", "root_cid", "piece_cid", "piece_size", "car_size", "details"}
+
+// ManifestEntry is what a manifest records about one CAR.
+type ManifestEntry struct {
+	// GraphName is the name given to the CAR by `meta-car build`.
+	GraphName string `json:"graph_name,omitempty"`
+	CarInfo
+}
+
+func (f ManifestFormat) validate() error {
+	switch f {
+	case ManifestCSV, ManifestJSON, ManifestNDJSON:
+		return nil
+	}
+	return xerrors.Errorf("unknown manifest format %q", f)
+}
+
+// ManifestPath returns the path of the manifest of format in dir.
+func ManifestPath(dir string, format ManifestFormat) string {
+	return filepath.Join(dir, "manifest."+string(format))
+}
+
+// WriteManifest writes entries to a new manifest at path, replacing the one
+// that is there.
+func WriteManifest(path string, format ManifestFormat, entries []ManifestEntry) error {
+	if err := format.validate(); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeManifest(tmp, format, entries, true); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// AppendManifest adds entries to the manifest at path, which is created
+// when it does not exist yet.
+func AppendManifest(path string, format ManifestFormat, entries ...ManifestEntry) error {
+	if err := format.validate(); err != nil {
+		return err
+	}
+	if format == ManifestJSON {
+		// a JSON array can only be written as a whole
+		old, err := ReadManifest(path, format)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return WriteManifest(path, format, append(old, entries...))
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := writeManifest(f, format, entries, info.Size() == 0); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeManifest(w io.Writer, format ManifestFormat, entries []ManifestEntry, header bool) error {
+	switch format {
+	case ManifestJSON:
+		if entries == nil {
+			entries = []ManifestEntry{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	case ManifestNDJSON:
+		enc := json.NewEncoder(w)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	cw := csv.NewWriter(w)
+	if header {
+		if err := cw.Write(manifestHeader); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		details, err := json.Marshal(e.Details)
+		if err != nil {
+			return err
+		}
+		if err := cw.Write([]string{
+			e.CarFileName,
+			e.GraphName,
+			e.RootCid,
+			e.PieceCID,
+			strconv.FormatInt(e.PieceSize, 10),
+			strconv.FormatInt(e.CarSize, 10),
+			string(details),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadManifest reads the entries of the manifest at path. The CAR paths are
+// not in a CSV manifest, so they are left empty.
+func ReadManifest(path string, format ManifestFormat) ([]ManifestEntry, error) {
+	if err := format.validate(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []ManifestEntry
+	switch format {
+	case ManifestJSON:
+		if err := json.NewDecoder(f).Decode(&entries); err != nil {
+			return nil, xerrors.Errorf("read manifest %s: %w", path, err)
+		}
+		return entries, nil
+	case ManifestNDJSON:
+		dec := json.NewDecoder(f)
+		for {
+			var e ManifestEntry
+			if err := dec.Decode(&e); err == io.EOF {
+				return entries, nil
+			} else if err != nil {
+				return nil, xerrors.Errorf("read manifest %s: %w", path, err)
+			}
+			entries = append(entries, e)
+		}
+	}
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, xerrors.Errorf("read manifest %s: %w", path, err)
+	}
+	for i, r := range records {
+		if i == 0 {
+			continue
+		}
+		if len(r) != len(manifestHeader) {
+			return nil, xerrors.Errorf("read manifest %s: line %d has %d fields", path, i+1, len(r))
+		}
+		e := ManifestEntry{GraphName: r[1]}
+		e.CarFileName, e.RootCid, e.PieceCID = r[0], r[2], r[3]
+		if e.PieceSize, err = strconv.ParseInt(r[4], 10, 64); err != nil {
+			return nil, xerrors.Errorf("read manifest %s: line %d: %w", path, i+1, err)
+		}
+		if e.CarSize, err = strconv.ParseInt(r[5], 10, 64); err != nil {
+			return nil, xerrors.Errorf("read manifest %s: line %d: %w", path, i+1, err)
+		}
+		if err := json.Unmarshal([]byte(r[6]), &e.Details); err != nil {
+			return nil, xerrors.Errorf("read manifest %s: line %d: %w", path, i+1, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
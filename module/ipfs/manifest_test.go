@@ -0,0 +1,52 @@
+package ipfs
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	src := t.TempDir()
+	writeRandomFiles(t, src, map[string]int{"a,b": 600, "c \"d\"": 600, "e": 600})
+
+	for _, format := range []ManifestFormat{ManifestCSV, ManifestJSON, ManifestNDJSON} {
+		carDir := t.TempDir()
+		result, err := GenerateCarFromDirResult(context.Background(), carDir, src, 1000, false, nil, WithManifest(format))
+		require.NoError(t, err)
+		require.Len(t, result.Cars, 3)
+
+		entries, err := ReadManifest(ManifestPath(carDir, format), format)
+		require.NoError(t, err)
+		require.Len(t, entries, len(result.Cars))
+		for i, car := range result.Cars {
+			info, err := os.Stat(car.CarFilePath)
+			require.NoError(t, err)
+			require.Equal(t, info.Size(), car.CarSize)
+			if format == ManifestCSV {
+				car.CarFilePath = ""
+			}
+			require.Equal(t, car, entries[i].CarInfo, format)
+		}
+
+		// appending keeps the entries and, for CSV, the single header
+		path := ManifestPath(carDir, format)
+		require.NoError(t, AppendManifest(path, format, ManifestEntry{GraphName: "more", CarInfo: result.Cars[0]}))
+		entries, err = ReadManifest(path, format)
+		require.NoError(t, err)
+		require.Len(t, entries, len(result.Cars)+1)
+		require.Equal(t, "more", entries[len(entries)-1].GraphName)
+	}
+
+	_, err := newOptions(WithManifest("xml"))
+	require.Error(t, err)
+
+	path := ManifestPath(t.TempDir(), ManifestCSV)
+	require.NoError(t, AppendManifest(path, ManifestCSV))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, strings.Join(manifestHeader, ",")+"\n", string(data))
+}
@@ -0,0 +1,157 @@
+package ipfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+)
+
+// unixfsMode converts the permission bits of m to the POSIX mode stored by
+// UnixFS 1.5.
+func unixfsMode(m os.FileMode) int {
+	mode := int(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	return mode
+}
+
+// fileMode is the reverse of unixfsMode.
+func fileMode(mode int64) os.FileMode {
+	m := os.FileMode(mode & 0o777)
+	if mode&0o4000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// withMetadata returns a copy of nd whose unixfs data also carries the mode
+// and modification time of info, as far as o asks to preserve them. nd is
+// returned as is when nothing is preserved.
+func (o Options) withMetadata(nd *dag.ProtoNode, info os.FileInfo) (*dag.ProtoNode, error) {
+	if !o.PreserveMode && !o.PreserveMtime {
+		return nd, nil
+	}
+	ufd, err := data.DecodeUnixFSData(nd.Data())
+	if err != nil {
+		return nil, err
+	}
+	ufd, err = builder.BuildUnixFS(func(b *builder.Builder) {
+		builder.DataType(b, ufd.FieldDataType().Int())
+		if ufd.FieldData().Exists() {
+			builder.Data(b, ufd.FieldData().Must().Bytes())
+		}
+		if ufd.FieldFileSize().Exists() {
+			builder.FileSize(b, uint64(ufd.FieldFileSize().Must().Int()))
+		}
+		var blockSizes []uint64
+		it := ufd.FieldBlockSizes().Iterator()
+		for !it.Done() {
+			_, size := it.Next()
+			blockSizes = append(blockSizes, uint64(size.Int()))
+		}
+		builder.BlockSizes(b, blockSizes)
+		if ufd.FieldHashType().Exists() {
+			builder.HashType(b, uint64(ufd.FieldHashType().Must().Int()))
+		}
+		if ufd.FieldFanout().Exists() {
+			builder.Fanout(b, uint64(ufd.FieldFanout().Must().Int()))
+		}
+		if o.PreserveMode {
+			builder.Permissions(b, unixfsMode(info.Mode()))
+		}
+		if o.PreserveMtime {
+			builder.Mtime(b, func(tb builder.TimeBuilder) {
+				builder.Time(tb, info.ModTime())
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	pn := nd.Copy().(*dag.ProtoNode)
+	pn.SetData(data.EncodeUnixFSData(ufd))
+	return pn, nil
+}
+
+// RestoreMetadata applies the mode and modification time stored in the DAG of
+// nd to the files restored from it at fpath. Entries without them, and nd
+// itself when it is the root directory of a CAR, are left as they are.
+func RestoreMetadata(ctx context.Context, ds ipld.DAGService, nd ipld.Node, fpath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		// raw leaves carry no metadata
+		return nil
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return err
+	}
+	switch fsn.Type() {
+	case unixfs.TSymlink:
+		// chmod and chtimes would follow the link
+		return nil
+	case unixfs.TDirectory, unixfs.THAMTShard:
+		links, err := dirLinks(ctx, ds, pn, fsn)
+		if err != nil {
+			return err
+		}
+		for _, ln := range links {
+			child, err := ds.Get(ctx, ln.Cid)
+			if err != nil {
+				return err
+			}
+			if err := RestoreMetadata(ctx, ds, child, filepath.Join(fpath, ln.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	// apply to a directory after its entries, which change its mtime
+	return applyMetadata(pn.Data(), fpath)
+}
+
+func applyMetadata(pbData []byte, fpath string) error {
+	ufd, err := data.DecodeUnixFSData(pbData)
+	if err != nil {
+		return err
+	}
+	if ufd.FieldMode().Exists() {
+		if err := os.Chmod(fpath, fileMode(ufd.FieldMode().Must().Int())); err != nil {
+			return err
+		}
+	}
+	if ufd.FieldMtime().Exists() {
+		mtime := ufd.FieldMtime().Must()
+		var nsec int64
+		if mtime.FieldFractionalNanoseconds().Exists() {
+			nsec = mtime.FieldFractionalNanoseconds().Must().Int()
+		}
+		t := time.Unix(mtime.FieldSeconds().Int(), nsec)
+		if err := os.Chtimes(fpath, t, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package ipfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/FogMeta/meta-lib/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreserveMetadata(t *testing.T) {
+	src := t.TempDir()
+	sub := filepath.Join(src, "sub")
+	require.NoError(t, os.Mkdir(sub, 0755))
+	mtime := time.Date(2020, 2, 29, 12, 30, 0, 123456789, time.UTC)
+	modes := map[string]os.FileMode{
+		filepath.Join(sub, "run.sh"):   0755,
+		filepath.Join(sub, "secret"):   0600,
+		filepath.Join(src, "big.data"): 0640,
+	}
+	var fileList []util.Finfo
+	for path, mode := range modes {
+		data := []byte(path)
+		if filepath.Base(path) == "big.data" {
+			data = make([]byte, 3<<20)
+		}
+		require.NoError(t, os.WriteFile(path, data, 0644))
+		require.NoError(t, os.Chmod(path, mode))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		fileList = append(fileList, util.Finfo{Path: path, Name: info.Name(), Info: info})
+	}
+	require.NoError(t, os.Chmod(sub, 0750))
+	require.NoError(t, os.Chtimes(sub, mtime, mtime))
+
+	for _, rawLeaves := range []bool{false, true} {
+		o, err := newOptions(WithPreserveMode(true), WithPreserveMtime(true), WithRawLeaves(rawLeaves))
+		require.NoError(t, err)
+		_, carInfo, _, err := newCarBuilder(context.Background(), nil, o).buildCar(fileList, src, t.TempDir(), 2)
+		require.NoError(t, err)
+
+		out := t.TempDir()
+		require.NoError(t, RestoreCar(out, carInfo.CarFilePath))
+		for path, mode := range modes {
+			rel, err := filepath.Rel(src, path)
+			require.NoError(t, err)
+			info, err := os.Stat(filepath.Join(out, rel))
+			require.NoError(t, err)
+			require.Equal(t, mode, info.Mode().Perm(), rel)
+			require.True(t, mtime.Equal(info.ModTime()), rel)
+		}
+		info, err := os.Stat(filepath.Join(out, "sub"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0750), info.Mode().Perm())
+		require.True(t, mtime.Equal(info.ModTime()))
+	}
+}
+
+func TestMappedDirsWithoutMetadata(t *testing.T) {
+	src := t.TempDir()
+	secret := filepath.Join(src, "secret")
+	require.NoError(t, os.Mkdir(secret, 0755))
+	path := filepath.Join(secret, "a")
+	require.NoError(t, os.WriteFile(path, []byte("a"), 0644))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Chmod(secret, 0700))
+
+	// neither a destination path nor a mapped path takes the metadata of
+	// the source directories
+	for _, tc := range []struct {
+		item util.Finfo
+		opts []Option
+	}{
+		{util.Finfo{Path: path, Name: "a", Info: info, Dest: "pub/docs/a"}, nil},
+		{util.Finfo{Path: path, Name: "a", Info: info}, []Option{WithPathMap(map[string]string{secret: "pub/docs"})}},
+	} {
+		o, err := newOptions(append(tc.opts, WithPreserveMode(true))...)
+		require.NoError(t, err)
+		_, carInfo, _, err := newCarBuilder(context.Background(), nil, o).buildCar([]util.Finfo{tc.item}, src, t.TempDir(), 1)
+		require.NoError(t, err)
+		out := t.TempDir()
+		require.NoError(t, RestoreCar(out, carInfo.CarFilePath))
+		for _, dir := range []string{"pub", "pub/docs"} {
+			info, err := os.Stat(filepath.Join(out, dir))
+			require.NoError(t, err)
+			require.NotEqual(t, os.FileMode(0700), info.Mode().Perm(), dir)
+		}
+		got, err := os.ReadFile(filepath.Join(out, "pub/docs/a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("a"), got)
+	}
+}
+
+func TestMergedFileMetadata(t *testing.T) {
+	src := t.TempDir()
+	writeRandomFiles(t, src, map[string]int{"run.sh": 5000})
+	path := filepath.Join(src, "run.sh")
+	mtime := time.Date(2020, 2, 29, 12, 30, 0, 0, time.UTC)
+	require.NoError(t, os.Chmod(path, 0755))
+	require.NoError(t, os.Chtimes(path, mtime, mtime))
+
+	carDir := t.TempDir()
+	result, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, nil, WithPreserveMode(true), WithPreserveMtime(true))
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 3)
+
+	out := t.TempDir()
+	require.NoError(t, RestoreCar(out, carDir))
+	info, err := os.Stat(filepath.Join(out, path))
+	require.NoError(t, err)
+	require.Equal(t, int64(5000), info.Size())
+	require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	require.True(t, mtime.Equal(info.ModTime()))
+}
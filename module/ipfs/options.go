@@ -0,0 +1,550 @@
+package ipfs
+
+import (
+	"io"
+	"sort"
+
+	"github.com/FogMeta/meta-lib/util"
+	"github.com/ipfs/go-cid"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	"github.com/ipfs/go-merkledag"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// Options are the DAG construction parameters of a generation run.
+type Options struct {
+	CidVersion int
+	// HashFunc is a multihash name, e.g. sha2-256, sha2-512 or blake2b-256.
+	HashFunc string
+	Chunker  string
+	// ChunkSize is the block size of the fixed size chunker and the average
+	// block size of the rabin chunker, which also honours MinChunkSize and
+	// MaxChunkSize. The buzhash chunker has fixed bounds of 128KiB and 512KiB.
+	ChunkSize    int64
+	MinChunkSize int64
+	MaxChunkSize int64
+	MaxLinks     int
+	RawLeaves    bool
+	Layout       string
+	// ShardSize is the estimated size of its links at which a directory is
+	// turned into a HAMT shard, 0 never shards.
+	ShardSize int
+	// PreserveMode and PreserveMtime store the permissions and modification
+	// time of files and directories in their UnixFS 1.5 fields.
+	PreserveMode  bool
+	PreserveMtime bool
+	// Symlinks is what scanning does with symbolic links, see WithSymlinks.
+	Symlinks util.SymlinkPolicy
+	// Include, Exclude and Hidden filter the scanned files, see
+	// util.ScanOptions.
+	Include []string
+	Exclude []string
+	Hidden  bool
+	// Strict fails a run at the first file it would leave out.
+	Strict bool
+	// SkipOversized leaves out files bigger than the slice size instead of
+	// splitting them across CARs.
+	SkipOversized bool
+	// Pack plans the CARs of a run with PlanCars instead of filling them in
+	// the order the files are scanned.
+	Pack bool
+	// Deterministic builds the same CARs, byte for byte, from the same tree
+	// and options, see WithDeterministic.
+	Deterministic bool
+	// Manifest is the format of the manifest written next to the CARs, none
+	// when empty.
+	Manifest ManifestFormat
+	// Resume keeps a journal of the finished CARs in the output directory
+	// and continues the run it records, see WithResume.
+	Resume bool
+	// PathLayout is how the source paths of the files become their paths in
+	// the CARs, PathLayoutFull when empty. StripPrefix is cut from the
+	// source paths of the full layout and PathMap maps source paths to paths
+	// in the CARs before any layout, see WithPathMap.
+	PathLayout  string
+	StripPrefix string
+	PathMap     map[string]string
+
+	// journal records the CARs of BuildIpldGraph, see WithJournal.
+	journal *Journal
+}
+
+// Option changes the Options of a generation run.
+type Option func(*Options) error
+
+// Chunkers accepted by WithChunker.
+const (
+	// ChunkerFixed cuts files into blocks of the same size.
+	ChunkerFixed = "size"
+	// ChunkerRabin cuts files at content defined boundaries found by a rabin
+	// fingerprint, so an insert only changes the blocks around it.
+	ChunkerRabin = "rabin"
+	// ChunkerBuzhash is a faster content defined chunker, the same as
+	// `ipfs add --chunker=buzhash`.
+	ChunkerBuzhash = "buzhash"
+)
+
+// Layouts of the file DAG accepted by WithLayout.
+const (
+	// LayoutBalanced builds a balanced tree, as `ipfs add` does by default.
+	LayoutBalanced = "balanced"
+	// LayoutTrickle builds a trickle tree, which suits data that is read in
+	// order, like logs and media streams.
+	LayoutTrickle = "trickle"
+)
+
+// Path layouts accepted by WithPathLayout.
+const (
+	// PathLayoutFull keeps the whole source path of every file below the
+	// root of its CAR.
+	PathLayoutFull = "full"
+	// PathLayoutRelative keeps the path below the scanned directory, a file
+	// given by itself goes to the root.
+	PathLayoutRelative = "relative"
+	// PathLayoutFlat puts every file in the root under its name.
+	PathLayoutFlat = "flat"
+)
+
+// Symlink policies accepted by WithSymlinks.
+const (
+	SymlinkFollow = util.SymlinkFollow
+	SymlinkSkip   = util.SymlinkSkip
+	SymlinkStore  = util.SymlinkStore
+)
+
+// DefaultShardSize is the directory size at which `ipfs add` starts sharding.
+const DefaultShardSize = 256 << 10
+
+// Names of the presets accepted by WithPreset.
+const (
+	// PresetMeta is the default of meta-lib, also used by go-graphsplit.
+	PresetMeta = "meta"
+	// PresetIpfsAdd matches `ipfs add` with its default settings.
+	PresetIpfsAdd = "ipfs-add"
+	// PresetIpfsAddCidV1 matches `ipfs add --cid-version=1`.
+	PresetIpfsAddCidV1 = "ipfs-add-cidv1"
+	// PresetLotus matches `lotus client import`.
+	PresetLotus = "lotus"
+)
+
+var presets = map[string]Options{
+	PresetMeta: {
+		CidVersion: 0,
+		HashFunc:   "sha2-256",
+		Chunker:    ChunkerFixed,
+		ChunkSize:  int64(UnixfsChunkSize),
+		MaxLinks:   UnixfsLinksPerLevel,
+		Layout:     LayoutBalanced,
+		ShardSize:  DefaultShardSize,
+	},
+	PresetIpfsAdd: {
+		CidVersion: 0,
+		HashFunc:   "sha2-256",
+		Chunker:    ChunkerFixed,
+		ChunkSize:  256 << 10,
+		MaxLinks:   174,
+		Layout:     LayoutBalanced,
+		ShardSize:  DefaultShardSize,
+	},
+	PresetIpfsAddCidV1: {
+		CidVersion: 1,
+		HashFunc:   "sha2-256",
+		Chunker:    ChunkerFixed,
+		ChunkSize:  256 << 10,
+		MaxLinks:   174,
+		RawLeaves:  true,
+		Layout:     LayoutBalanced,
+		ShardSize:  DefaultShardSize,
+	},
+	PresetLotus: {
+		CidVersion: 1,
+		HashFunc:   "sha2-256",
+		Chunker:    ChunkerFixed,
+		ChunkSize:  int64(UnixfsChunkSize),
+		MaxLinks:   UnixfsLinksPerLevel,
+		RawLeaves:  true,
+		Layout:     LayoutBalanced,
+		ShardSize:  DefaultShardSize,
+	},
+}
+
+// Presets returns the names of the available presets.
+func Presets() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithPreset sets the DAG parameters to the named preset: CID version, hash,
+// chunker and chunk sizes, links per node, raw leaves, layout and shard size.
+// The other options are kept, and options given after it override single
+// parameters of the preset.
+func WithPreset(name string) Option {
+	return func(o *Options) error {
+		p, ok := presets[name]
+		if !ok {
+			return xerrors.Errorf("unknown preset %q", name)
+		}
+		o.CidVersion = p.CidVersion
+		o.HashFunc = p.HashFunc
+		o.Chunker = p.Chunker
+		o.ChunkSize = p.ChunkSize
+		o.MinChunkSize = p.MinChunkSize
+		o.MaxChunkSize = p.MaxChunkSize
+		o.MaxLinks = p.MaxLinks
+		o.RawLeaves = p.RawLeaves
+		o.Layout = p.Layout
+		o.ShardSize = p.ShardSize
+		return nil
+	}
+}
+
+func WithCidVersion(version int) Option {
+	return func(o *Options) error {
+		o.CidVersion = version
+		return nil
+	}
+}
+
+func WithHashFunc(name string) Option {
+	return func(o *Options) error {
+		o.HashFunc = name
+		return nil
+	}
+}
+
+func WithChunkSize(size int64) Option {
+	return func(o *Options) error {
+		o.ChunkSize = size
+		return nil
+	}
+}
+
+// WithChunker selects the chunker. Selecting rabin also resets the chunk sizes
+// to an average of 256KiB, the same as `ipfs add --chunker=rabin`.
+func WithChunker(name string) Option {
+	return func(o *Options) error {
+		o.Chunker = name
+		if name == ChunkerRabin {
+			o.ChunkSize = chunker.DefaultBlockSize
+			o.MinChunkSize = 0
+			o.MaxChunkSize = 0
+		}
+		return nil
+	}
+}
+
+// WithChunkSizes sets the min, average and max block size of the rabin
+// chunker. A min or max of 0 is derived from avg, as `ipfs add` does, and an
+// avg of 0 keeps the current average.
+func WithChunkSizes(min, avg, max int64) Option {
+	return func(o *Options) error {
+		o.MinChunkSize = min
+		if avg != 0 {
+			o.ChunkSize = avg
+		}
+		o.MaxChunkSize = max
+		return nil
+	}
+}
+
+func WithMaxLinks(n int) Option {
+	return func(o *Options) error {
+		o.MaxLinks = n
+		return nil
+	}
+}
+
+func WithRawLeaves(rawLeaves bool) Option {
+	return func(o *Options) error {
+		o.RawLeaves = rawLeaves
+		return nil
+	}
+}
+
+func WithLayout(layout string) Option {
+	return func(o *Options) error {
+		o.Layout = layout
+		return nil
+	}
+}
+
+func WithShardSize(size int) Option {
+	return func(o *Options) error {
+		o.ShardSize = size
+		return nil
+	}
+}
+
+func WithPreserveMode(preserve bool) Option {
+	return func(o *Options) error {
+		o.PreserveMode = preserve
+		return nil
+	}
+}
+
+func WithPreserveMtime(preserve bool) Option {
+	return func(o *Options) error {
+		o.PreserveMtime = preserve
+		return nil
+	}
+}
+
+// WithSymlinks sets what scanning does with symbolic links: follow them, the
+// default, skip them or store them as UnixFS symlinks.
+func WithSymlinks(policy util.SymlinkPolicy) Option {
+	return func(o *Options) error {
+		o.Symlinks = policy
+		return nil
+	}
+}
+
+// WithInclude takes only the files matching one of the gitignore style
+// patterns, relative to the scanned directory.
+func WithInclude(patterns ...string) Option {
+	return func(o *Options) error {
+		o.Include = append(o.Include, patterns...)
+		return nil
+	}
+}
+
+// WithExclude leaves out the files and directories matching the gitignore
+// style patterns, relative to the scanned directory. "!pattern" takes back a
+// match of an earlier pattern.
+func WithExclude(patterns ...string) Option {
+	return func(o *Options) error {
+		o.Exclude = append(o.Exclude, patterns...)
+		return nil
+	}
+}
+
+// WithHidden also takes files and directories whose name starts with ".",
+// which are left out by default.
+func WithHidden(hidden bool) Option {
+	return func(o *Options) error {
+		o.Hidden = hidden
+		return nil
+	}
+}
+
+// WithStrict makes GenerateCarFromDirResult fail at the first file it would
+// leave out, instead of listing it in the result.
+func WithStrict(strict bool) Option {
+	return func(o *Options) error {
+		o.Strict = strict
+		return nil
+	}
+}
+
+// WithSkipOversized leaves out the files bigger than the slice size, which
+// are split across consecutive CARs by default.
+func WithSkipOversized(skip bool) Option {
+	return func(o *Options) error {
+		o.SkipOversized = skip
+		return nil
+	}
+}
+
+// WithPacking packs the files into CARs that land just under a power of two
+// piece size, see PlanCars. All the files are scanned before the first CAR
+// is built.
+func WithPacking(pack bool) Option {
+	return func(o *Options) error {
+		o.Pack = pack
+		return nil
+	}
+}
+
+// WithDeterministic builds the files of a CAR one after the other in path
+// order instead of in parallel, so the blocks are always written in the same
+// order and the same tree and options give byte identical CARs. Files are
+// scanned in name order either way. Random UUIDs can not be reproduced, so
+// they are refused in this mode.
+func WithDeterministic(deterministic bool) Option {
+	return func(o *Options) error {
+		o.Deterministic = deterministic
+		return nil
+	}
+}
+
+// WithManifest writes a manifest of the CARs of a run in format to the
+// output directory, see ManifestPath.
+func WithManifest(format ManifestFormat) Option {
+	return func(o *Options) error {
+		o.Manifest = format
+		return nil
+	}
+}
+
+func defaultOptions() Options {
+	return presets[PresetMeta]
+}
+
+func newOptions(opts ...Option) (Options, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return Options{}, err
+		}
+	}
+	if err := o.validate(); err != nil {
+		return Options{}, err
+	}
+	return o, nil
+}
+
+func (o Options) validate() error {
+	if o.CidVersion != 0 && o.CidVersion != 1 {
+		return xerrors.Errorf("unsupported CID version %d", o.CidVersion)
+	}
+	code, ok := mh.Names[o.HashFunc]
+	if !ok {
+		return xerrors.Errorf("unknown hash function %q", o.HashFunc)
+	}
+	if o.CidVersion == 0 && code != mh.SHA2_256 {
+		return xerrors.Errorf("CIDv0 only supports sha2-256, use CIDv1 for %s", o.HashFunc)
+	}
+	if o.ChunkSize <= 0 {
+		return xerrors.Errorf("chunk size has to be greater than 0")
+	}
+	switch o.Chunker {
+	case ChunkerFixed:
+	case ChunkerRabin:
+		min, avg, max := o.rabinSizes()
+		if min < 16 || min >= avg || avg >= max {
+			return xerrors.Errorf("rabin chunk sizes need 16 <= min < avg < max, got %d, %d, %d", min, avg, max)
+		}
+		if max > int64(chunker.ChunkSizeLimit) {
+			return xerrors.Errorf("rabin max chunk size can not exceed %d", chunker.ChunkSizeLimit)
+		}
+	case ChunkerBuzhash:
+		if o.MinChunkSize != 0 || o.MaxChunkSize != 0 {
+			return xerrors.Errorf("the buzhash chunker has fixed chunk sizes")
+		}
+	default:
+		return xerrors.Errorf("unknown chunker %q", o.Chunker)
+	}
+	if o.MaxLinks < 2 {
+		return xerrors.Errorf("max links has to be at least 2")
+	}
+	if o.Layout != LayoutBalanced && o.Layout != LayoutTrickle {
+		return xerrors.Errorf("unknown layout %q", o.Layout)
+	}
+	if o.ShardSize < 0 {
+		return xerrors.Errorf("shard size can not be negative")
+	}
+	if err := o.scanOptions().Validate(); err != nil {
+		return err
+	}
+	if o.Manifest != "" {
+		if err := o.Manifest.validate(); err != nil {
+			return err
+		}
+	}
+	switch o.PathLayout {
+	case "", PathLayoutFull, PathLayoutRelative, PathLayoutFlat:
+	default:
+		return xerrors.Errorf("unknown path layout %q", o.PathLayout)
+	}
+	return nil
+}
+
+func (o Options) rabinSizes() (min, avg, max int64) {
+	min, avg, max = o.MinChunkSize, o.ChunkSize, o.MaxChunkSize
+	if min == 0 {
+		min = avg / 3
+	}
+	if max == 0 {
+		max = avg + avg/2
+	}
+	return
+}
+
+func (o Options) splitter(r io.Reader) chunker.Splitter {
+	switch o.Chunker {
+	case ChunkerRabin:
+		min, avg, max := o.rabinSizes()
+		return chunker.NewRabinMinMax(r, uint64(min), uint64(avg), uint64(max))
+	case ChunkerBuzhash:
+		return chunker.NewBuzhash(r)
+	default:
+		return chunker.NewSizeSplitter(r, o.ChunkSize)
+	}
+}
+
+func (o Options) scanOptions() util.ScanOptions {
+	return util.ScanOptions{
+		Symlinks: o.Symlinks,
+		Include:  o.Include,
+		Exclude:  o.Exclude,
+		Hidden:   o.Hidden,
+		// empty directories are kept in the CARs
+		EmptyDirs: true,
+	}
+}
+
+func (o Options) cidBuilder() (cid.Builder, error) {
+	prefix, err := merkledag.PrefixForCidVersion(o.CidVersion)
+	if err != nil {
+		return nil, err
+	}
+	prefix.MhType = mh.Names[o.HashFunc]
+	prefix.MhLength = -1
+	return &prefix, nil
+}
+
+// WithResume records every finished CAR of a run in a journal in the output
+// directory, see Journal. Run again with the same inputs after a failure,
+// the run keeps the CARs in the journal, removes the unfinished ones and
+// goes on with the next file. The failed run must have had WithResume too.
+func WithResume(resume bool) Option {
+	return func(o *Options) error {
+		o.Resume = resume
+		return nil
+	}
+}
+
+// WithJournal records every CAR BuildIpldGraph builds in journal, under its
+// graph name, before the CAR is moved into place.
+func WithJournal(journal *Journal) Option {
+	return func(o *Options) error {
+		o.journal = journal
+		return nil
+	}
+}
+
+// WithPathLayout sets how the source paths of the files become their paths
+// in the CARs: PathLayoutFull, PathLayoutRelative or PathLayoutFlat.
+func WithPathLayout(layout string) Option {
+	return func(o *Options) error {
+		o.PathLayout = layout
+		return nil
+	}
+}
+
+// WithStripPrefix cuts prefix from the source paths of the files below it,
+// in the full path layout.
+func WithStripPrefix(prefix string) Option {
+	return func(o *Options) error {
+		o.StripPrefix = prefix
+		return nil
+	}
+}
+
+// WithPathMap puts the files at the source paths of m, or below them, at the
+// paths in the CARs they map to, whatever the path layout. The longest source
+// path a file is at or below wins, a destination of "" or "/" is the root
+// and ".." can not leave it.
+func WithPathMap(m map[string]string) Option {
+	return func(o *Options) error {
+		o.PathMap = make(map[string]string, len(m))
+		for src, dest := range m {
+			o.PathMap[src] = dest
+		}
+		return nil
+	}
+}
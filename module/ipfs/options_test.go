@@ -0,0 +1,138 @@
+package ipfs
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FogMeta/meta-lib/util"
+	"github.com/ipfs/go-cid"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	uio "github.com/ipfs/go-unixfs/io"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func buildTestFile(t *testing.T, data []byte, opts ...Option) cid.Cid {
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	o, err := newOptions(opts...)
+	require.NoError(t, err)
+	cidBuilder, err := o.cidBuilder()
+	require.NoError(t, err)
+	b := newCarBuilder(context.Background(), nil, o)
+	nd, err := b.buildFileNode(util.Finfo{Path: path, Name: info.Name(), Info: info}, mdtest.Mock(), cidBuilder)
+	require.NoError(t, err)
+	return nd.Cid()
+}
+
+func TestPresetIpfsAdd(t *testing.T) {
+	// `echo "hello world" | ipfs add`
+	c := buildTestFile(t, []byte("hello world\n"), WithPreset(PresetIpfsAdd))
+	require.Equal(t, "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o", c.String())
+}
+
+func TestPresetKeepsOptions(t *testing.T) {
+	o, err := newOptions(WithExclude("*.tmp"), WithStrict(true), WithPathLayout(PathLayoutRelative), WithChunkSize(1<<10), WithPreset(PresetLotus))
+	require.NoError(t, err)
+	require.Equal(t, []string{"*.tmp"}, o.Exclude)
+	require.True(t, o.Strict)
+	require.Equal(t, PathLayoutRelative, o.PathLayout)
+	// the DAG parameters are the ones of the preset
+	require.Equal(t, presets[PresetLotus].ChunkSize, o.ChunkSize)
+	require.Equal(t, 1, o.CidVersion)
+	require.True(t, o.RawLeaves)
+}
+
+func TestRawLeavesCidV1(t *testing.T) {
+	data := []byte("hello world\n")
+	c := buildTestFile(t, data, WithCidVersion(1), WithRawLeaves(true))
+	want, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.SHA2_256, MhLength: -1}.Sum(data)
+	require.NoError(t, err)
+	require.Equal(t, want, c)
+}
+
+func TestHashFunc(t *testing.T) {
+	for _, name := range []string{"sha2-256", "sha2-512", "blake2b-256"} {
+		c := buildTestFile(t, make([]byte, 3<<20), WithCidVersion(1), WithHashFunc(name), WithChunkSize(1<<20), WithMaxLinks(2))
+		require.Equal(t, mh.Names[name], c.Prefix().MhType, name)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	_, err := newOptions(WithHashFunc("sha2-512"))
+	require.Error(t, err)
+	_, err = newOptions(WithPreset("unknown"))
+	require.Error(t, err)
+	_, err = newOptions(WithCidVersion(1), WithHashFunc("md5-ish"))
+	require.Error(t, err)
+	_, err = newOptions(WithChunkSize(0))
+	require.Error(t, err)
+	_, err = GetGraphCount([]string{t.TempDir()}, 1<<20, WithChunker("rabin-oops"))
+	require.Error(t, err)
+}
+
+func TestTrickleLayout(t *testing.T) {
+	data := make([]byte, 5<<20)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	ds := mdtest.Mock()
+	var roots []cid.Cid
+	for _, layout := range []string{LayoutBalanced, LayoutTrickle} {
+		o, err := newOptions(WithLayout(layout), WithChunkSize(64<<10), WithMaxLinks(4))
+		require.NoError(t, err)
+		cidBuilder, err := o.cidBuilder()
+		require.NoError(t, err)
+		nd, err := newCarBuilder(context.Background(), nil, o).buildFileNode(util.Finfo{Path: path, Name: info.Name(), Info: info}, ds, cidBuilder)
+		require.NoError(t, err)
+
+		r, err := uio.NewDagReader(context.Background(), nd, ds)
+		require.NoError(t, err)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, got, layout)
+		roots = append(roots, nd.Cid())
+	}
+	require.NotEqual(t, roots[0], roots[1])
+}
+
+func TestRabinDedup(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 4<<20)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	shifted := append([]byte{0}, data...)
+	var fileList []util.Finfo
+	for name, content := range map[string][]byte{"a": data, "b": shifted} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, content, 0644))
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		fileList = append(fileList, util.Finfo{Path: path, Name: name, Info: info})
+	}
+
+	build := func(opts ...Option) CarInfo {
+		o, err := newOptions(opts...)
+		require.NoError(t, err)
+		_, carInfo, _, err := newCarBuilder(context.Background(), nil, o).buildCar(fileList, dir, t.TempDir(), 2)
+		require.NoError(t, err)
+		return carInfo
+	}
+	fixed := build(WithChunkSize(256 << 10))
+	require.Zero(t, fixed.DedupSize)
+	rabin := build(WithChunker(ChunkerRabin), WithRawLeaves(true))
+	require.Greater(t, rabin.DedupSize, int64(len(data)/2))
+	buzhash := build(WithChunker(ChunkerBuzhash), WithRawLeaves(true))
+	require.Greater(t, buzhash.DedupSize, int64(len(data)/2))
+}
@@ -0,0 +1,90 @@
+package ipfs
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/FogMeta/meta-lib/util"
+)
+
+// carPath returns the directories, from the root, and the name of item in
+// its CAR. A destination path of item goes first. parentPath is cut from the
+// source paths of the full layout. mirrored tells whether the directories are
+// the source directories of item, so that they can take their metadata.
+func (o Options) carPath(item util.Finfo, parentPath string) (dirs []string, name string, mirrored bool) {
+	if item.Dest != "" {
+		dirs, name = placePath(item, filepath.ToSlash(item.Dest))
+		return dirs, name, false
+	}
+	src := path.Clean(item.Path)
+	if dest, ok := o.mapPath(src); ok {
+		dirs, name = placePath(item, dest)
+		return dirs, name, false
+	}
+
+	switch o.PathLayout {
+	case PathLayoutFlat:
+		return nil, item.Name, true
+	case PathLayoutRelative:
+		if item.Rel == "" {
+			return nil, item.Name, true
+		}
+		return splitDirs(path.Dir(item.Rel)), item.Name, true
+	}
+
+	if prefix := path.Clean(o.StripPrefix); o.StripPrefix != "" && isBelow(src, prefix) {
+		parentPath = prefix
+	}
+	dirStr := path.Dir(item.Path)
+	parentPath = path.Clean(parentPath)
+	// when parent path equal target path, and the parent path is also a file path
+	if parentPath == src {
+		dirStr = ""
+	} else if parentPath != "" && strings.HasPrefix(dirStr, parentPath) {
+		dirStr = dirStr[len(parentPath):]
+	}
+	return splitDirs(dirStr), item.Name, true
+}
+
+// mapPath returns the destination of src after PathMap, with the longest
+// source path src is at or below.
+func (o Options) mapPath(src string) (string, bool) {
+	best, dest := "", ""
+	for from, to := range o.PathMap {
+		from = path.Clean(from)
+		if isBelow(src, from) && len(from) > len(best) {
+			best, dest = from, to
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	return path.Join(dest, strings.TrimPrefix(src, best)), true
+}
+
+// placePath returns the directories and the name in its CAR of item put at
+// the destination path dest.
+func placePath(item util.Finfo, dest string) ([]string, string) {
+	// a destination can not leave the root of the CAR
+	dest = strings.Trim(path.Clean("/"+dest), "/")
+	if dest == "" {
+		return nil, item.Name
+	}
+	// the name of a part keeps the number after the destination name
+	suffix := strings.TrimPrefix(item.Name, filepath.Base(item.Path))
+	return splitDirs(path.Dir(dest)), path.Base(dest) + suffix
+}
+
+// isBelow tells whether p is dir or a path below it, both clean.
+func isBelow(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+func splitDirs(dir string) []string {
+	dir = strings.Trim(dir, "/")
+	if dir == "" || dir == "." {
+		return []string{}
+	}
+	return strings.Split(dir, "/")
+}
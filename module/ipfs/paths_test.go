@@ -0,0 +1,70 @@
+package ipfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/FogMeta/meta-lib/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCarPath(t *testing.T) {
+	file := util.Finfo{Path: "/data/set/a/b.txt", Name: "b.txt", Rel: "a/b.txt"}
+	part := file
+	part.Name = "b.txt.00000001"
+	for _, tc := range []struct {
+		opts []Option
+		item util.Finfo
+		want string
+	}{
+		{nil, file, "data/set/a/b.txt"},
+		{[]Option{WithPathLayout(PathLayoutRelative)}, file, "a/b.txt"},
+		{[]Option{WithPathLayout(PathLayoutRelative)}, util.Finfo{Path: "/data/c", Name: "c"}, "c"},
+		{[]Option{WithPathLayout(PathLayoutFlat)}, file, "b.txt"},
+		{[]Option{WithStripPrefix("/data/")}, file, "set/a/b.txt"},
+		{[]Option{WithStripPrefix("/other")}, file, "data/set/a/b.txt"},
+		{[]Option{WithPathMap(map[string]string{"/data": "x", "/data/set/a": "/y/z"})}, file, "y/z/b.txt"},
+		{[]Option{WithPathMap(map[string]string{"/data/set/a/b.txt": "c.txt"})}, part, "c.txt.00000001"},
+		{[]Option{WithPathMap(map[string]string{"/data/set": "../.."}), WithPathLayout(PathLayoutFlat)}, file, "a/b.txt"},
+		{[]Option{WithPathMap(map[string]string{"/other": "x"}), WithPathLayout(PathLayoutFlat)}, file, "b.txt"},
+	} {
+		o, err := newOptions(tc.opts...)
+		require.NoError(t, err)
+		dirs, name, _ := o.carPath(tc.item, "/")
+		require.Equal(t, tc.want, path.Join(append(dirs, name)...))
+	}
+
+	_, err := newOptions(WithPathLayout("tree"))
+	require.Error(t, err)
+}
+
+func TestPathLayout(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "dir", "sub"), 0755))
+	writeRandomFiles(t, src, map[string]int{"a": 10, "dir/b": 10, "dir/sub/c": 10, "dir/sub/a": 10})
+
+	paths := func(opts ...Option) []string {
+		result, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 1<<20, false, nil, opts...)
+		require.NoError(t, err)
+		entries, err := ListCarEntries(result.Cars[0].CarFilePath)
+		require.NoError(t, err)
+		var files []string
+		for _, e := range entries {
+			if e.Type == CarEntryFile {
+				files = append(files, e.Path)
+			}
+		}
+		sort.Strings(files)
+		return files
+	}
+	require.Equal(t, []string{"a", "dir/b", "dir/sub/a", "dir/sub/c"}, paths(WithPathLayout(PathLayoutRelative)))
+	require.Equal(t, []string{"a", "data/a", "data/c", "dir/b"}, paths(WithPathLayout(PathLayoutRelative), WithPathMap(map[string]string{filepath.Join(src, "dir", "sub"): "data"})))
+
+	// two files can not end up at the same path
+	_, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 1<<20, false, nil, WithPathLayout(PathLayoutFlat), WithStrict(true))
+	require.Error(t, err)
+}
@@ -0,0 +1,268 @@
+package ipfs
+
+import (
+	"path"
+	"sort"
+
+	"github.com/FogMeta/meta-lib/util"
+)
+
+// CarPlan is the files planned into one CAR by PlanCars.
+type CarPlan struct {
+	Files []util.Finfo
+	// Size is the estimated size of the CAR file.
+	Size int64
+}
+
+// carHeaderSize is the room kept in every CAR for its header and root.
+const carHeaderSize = 1 << 10
+
+// PieceSize returns the smallest power of two piece size of at least size.
+func PieceSize(size int64) int64 {
+	piece := int64(128)
+	for piece < size {
+		piece <<= 1
+	}
+	return piece
+}
+
+// PieceCapacity returns the largest CAR that still fits a piece of pieceSize
+// after fr32 expansion, which turns every 127 bytes into 128.
+func PieceCapacity(pieceSize int64) int64 {
+	return pieceSize / 128 * 127
+}
+
+// MaxPieceSize returns the largest power of two piece size whose capacity,
+// see PieceCapacity, is at most size, and the smallest piece size when none
+// is.
+func MaxPieceSize(size int64) int64 {
+	piece := int64(128)
+	for PieceCapacity(piece<<1) <= size {
+		piece <<= 1
+	}
+	return piece
+}
+
+// PlanCars packs files into CARs that land just under the largest power of
+// two piece size whose CARs are at most sliceSize, see MaxPieceSize, with
+// first fit decreasing on the estimated CAR size of each file. A file that
+// does not fit a piece on its own is split, every part but the last gets a
+// CAR of its own and comes first, the last part is packed with the other
+// files. With WithSkipOversized such files are returned as skipped instead.
+func PlanCars(files []util.Finfo, sliceSize int64, opts ...Option) ([]CarPlan, []SkippedFile, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	plans, skipped := o.planCars(files, sliceSize)
+	return plans, skipped, nil
+}
+
+func (o Options) planCars(files []util.Finfo, sliceSize int64) ([]CarPlan, []SkippedFile) {
+	capacity := PieceCapacity(MaxPieceSize(sliceSize))
+	var plans []CarPlan
+	var skipped []SkippedFile
+	items := make([]util.Finfo, 0, len(files))
+	for _, item := range files {
+		dirs := o.dirCarSize(make(map[string]bool), item)
+		if carHeaderSize+dirs+o.carSize(item) <= capacity {
+			items = append(items, item)
+			continue
+		}
+		if o.SkipOversized {
+			skipped = append(skipped, SkippedFile{Path: item.Path, Size: item.Size(), Reason: SkipOversized})
+			continue
+		}
+		size := o.partSize(item, capacity-carHeaderSize-dirs)
+		parts := splitFile(item, size, size)
+		for _, part := range parts[:len(parts)-1] {
+			plans = append(plans, CarPlan{Files: []util.Finfo{part}, Size: carHeaderSize + dirs + o.carSize(part)})
+		}
+		items = append(items, parts[len(parts)-1])
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return o.carSize(items[i]) > o.carSize(items[j])
+	})
+	var packed []CarPlan
+	// the directories in each packed CAR, counted once per CAR
+	var packedDirs []map[string]bool
+	for _, item := range items {
+		size := o.carSize(item)
+		fit := false
+		for i := range packed {
+			if more := o.dirCarSize(packedDirs[i], item); packed[i].Size+more+size <= capacity {
+				packed[i].Files = append(packed[i].Files, item)
+				packed[i].Size += more + size
+				addDirs(packedDirs[i], item)
+				fit = true
+				break
+			}
+		}
+		if !fit {
+			dirs := make(map[string]bool)
+			packed = append(packed, CarPlan{Files: []util.Finfo{item}, Size: carHeaderSize + o.dirCarSize(dirs, item) + size})
+			addDirs(dirs, item)
+			packedDirs = append(packedDirs, dirs)
+		}
+	}
+	return append(plans, packed...), skipped
+}
+
+// partSize returns the bytes of item that fit in capacity bytes of a CAR,
+// cut at the subtree boundaries of its DAG when it can be split along it.
+func (o Options) partSize(item util.Finfo, capacity int64) int64 {
+	size := capacity
+	for size > 1 && o.dataCarSize(item, size) > capacity {
+		size -= o.dataCarSize(item, size) - capacity
+	}
+	if span, _ := o.splitSpan(size); span > 0 {
+		size = size / span * span
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// carSize estimates the bytes item, a file or a part of one, takes in a CAR.
+func (o Options) carSize(item util.Finfo) int64 {
+	if item.Parts > 0 {
+		return o.dataCarSize(item, item.SeekEnd-item.SeekStart+1)
+	}
+	return o.dataCarSize(item, item.Size())
+}
+
+// dataCarSize estimates the bytes size bytes of item take in a CAR: the
+// leaves with their CID and length, the nodes above them with a link and a
+// block size for every child, the link of item in its directory and its
+// entry in the UUID map. Every varint is counted at the length it has for
+// size, so the estimate stays above the real size.
+func (o Options) dataCarSize(item util.Finfo, size int64) int64 {
+	chunk := o.ChunkSize
+	switch o.Chunker {
+	case ChunkerRabin:
+		chunk, _, _ = o.rabinSizes()
+	case ChunkerBuzhash:
+		chunk = 128 << 10
+	}
+	nodeCid, leafCid := o.cidSizes()
+	leaf := chunk
+	if size < leaf {
+		leaf = size
+	}
+
+	blocks := (size + chunk - 1) / chunk
+	if blocks == 0 {
+		blocks = 1
+	}
+	total := size
+	// the Data field of a dag-pb leaf holds its type, data and file size
+	var wrap int64
+	if !o.RawLeaves {
+		wrap = 2 + varintSize(leaf) + 2 + 2*(1+varintSize(leaf))
+	}
+	total += blocks * (varintSize(leafCid+leaf+wrap) + leafCid + wrap)
+	links := int64(0)
+	for n := blocks; n > 1; {
+		n = (n + int64(o.MaxLinks) - 1) / int64(o.MaxLinks)
+		links += n
+		// length, CID and the Data field with type and file size
+		total += n * (3 + nodeCid + 2 + 3 + 2*(1+varintSize(size)))
+	}
+	// every block but the root is linked from its parent with its size
+	links += blocks - 1
+	if blocks > 1 {
+		total += links * (o.linkSize("", size) + 1 + varintSize(size))
+	}
+	total += o.linkSize(item.Name, size)
+	if meta := o.metadataSize(); meta > 0 {
+		total += meta
+		if o.RawLeaves && blocks == 1 {
+			// a raw leaf takes no metadata, it gets a node above it
+			total += 3 + nodeCid + 4 + 2*(1+varintSize(size)) + o.linkSize("", size)
+		}
+	}
+	if item.Uuid != "" {
+		// a CBOR map entry of the path and the UUID
+		total += int64(len(item.Path)+len(item.Uuid)) + 2*3
+	}
+	return total
+}
+
+// linkSize estimates the bytes of a link named name to a node of size bytes:
+// its Hash, Name and Tsize fields in a field of the parent node. The CID may
+// be that of a leaf.
+func (o Options) linkSize(name string, size int64) int64 {
+	nodeCid, leafCid := o.cidSizes()
+	if leafCid > nodeCid {
+		nodeCid = leafCid
+	}
+	fields := 2 + nodeCid + 1 + varintSize(int64(len(name))) + int64(len(name)) + 1 + varintSize(size)
+	return 1 + varintSize(fields) + fields
+}
+
+// dirCarSize estimates the bytes the directories of item not in dirs yet
+// take in a CAR. A directory node is counted with its metadata and its link
+// in the parent, the links to its entries are counted with them. dirs holds
+// the parents of every directory in it, see addDirs.
+func (o Options) dirCarSize(dirs map[string]bool, item util.Finfo) int64 {
+	nodeCid, _ := o.cidSizes()
+	// length, CID and the Data field with the type, mode and mtime
+	node := 3 + nodeCid + 4 + o.metadataSize()
+	var total int64
+	for dir := path.Dir(item.Path); dir != "/" && dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+		total += node + o.linkSize(path.Base(dir), 1<<32)
+	}
+	return total
+}
+
+// metadataSize returns the bytes of the UnixFS mode and mtime fields of a
+// node.
+func (o Options) metadataSize() int64 {
+	var size int64
+	if o.PreserveMode {
+		size += 4
+	}
+	if o.PreserveMtime {
+		size += 14
+	}
+	return size
+}
+
+// addDirs adds the directories of item to dirs.
+func addDirs(dirs map[string]bool, item util.Finfo) {
+	for dir := path.Dir(item.Path); dir != "/" && dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+		dirs[dir] = true
+	}
+}
+
+// cidSizes returns the byte lengths of the CIDs of nodes and of leaves.
+func (o Options) cidSizes() (node, leaf int64) {
+	builder, err := o.cidBuilder()
+	if err != nil {
+		return 64, 64
+	}
+	c, err := builder.Sum(nil)
+	if err != nil {
+		return 64, 64
+	}
+	node, leaf = int64(c.ByteLen()), int64(c.ByteLen())
+	if o.RawLeaves {
+		// raw leaves have CIDv1, a CIDv0 has no version and codec
+		if prefix := c.Prefix(); prefix.Version == 0 {
+			leaf += 2
+		}
+	}
+	return node, leaf
+}
+
+// varintSize returns the length of n as an unsigned varint.
+func varintSize(n int64) int64 {
+	size := int64(1)
+	for n >= 0x80 {
+		n >>= 7
+		size++
+	}
+	return size
+}
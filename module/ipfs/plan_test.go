@@ -0,0 +1,188 @@
+package ipfs
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/FogMeta/meta-lib/util"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRandomFiles(t *testing.T, dir string, sizes map[string]int) map[string][]byte {
+	contents := make(map[string][]byte)
+	for name, size := range sizes {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0644))
+		contents[name] = data
+	}
+	return contents
+}
+
+func carFileNames(result BuildResult) []string {
+	var names []string
+	for _, car := range result.Cars {
+		for _, d := range car.Details {
+			names = append(names, d.FileName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPieceSize(t *testing.T) {
+	require.Equal(t, int64(128), PieceSize(1))
+	require.Equal(t, int64(64<<10), PieceSize(64<<10))
+	require.Equal(t, int64(128<<10), PieceSize(64<<10+1))
+	require.Equal(t, int64(32<<30)/128*127, PieceCapacity(32<<30))
+	require.Equal(t, int64(64<<10), MaxPieceSize(64<<10))
+	require.Equal(t, int64(16<<30), MaxPieceSize(17<<30))
+	require.Equal(t, int64(32<<30), MaxPieceSize(PieceCapacity(32<<30)))
+	require.Equal(t, int64(128), MaxPieceSize(1))
+}
+
+func TestPackedCars(t *testing.T) {
+	src := t.TempDir()
+	sizes := map[string]int{"a": 10 << 10, "b": 40 << 10, "c": 20 << 10, "d": 30 << 10, "e": 20 << 10, "f": 1 << 10}
+	writeRandomFiles(t, src, sizes)
+
+	// filled in scan order the CARs would need three pieces
+	result, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 64<<10, false, nil, WithPacking(true))
+	require.NoError(t, err)
+	require.Empty(t, result.Skipped)
+	require.Len(t, result.Cars, 2)
+	for _, car := range result.Cars {
+		require.Equal(t, int64(64<<10), car.PieceSize)
+		info, err := os.Stat(car.CarFilePath)
+		require.NoError(t, err)
+		require.LessOrEqual(t, info.Size(), PieceCapacity(64<<10))
+	}
+	require.Equal(t, []string{"a", "b", "c", "d", "e", "f"}, carFileNames(result))
+
+	// a slice size between two piece sizes plans for the smaller one, so no
+	// CAR is bigger than the slice size
+	result, err = GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 100<<10, false, nil, WithPacking(true))
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 2)
+	for _, car := range result.Cars {
+		require.Equal(t, int64(64<<10), car.PieceSize)
+	}
+}
+
+func TestPackedSmallFiles(t *testing.T) {
+	for _, count := range []int{2000, 3000} {
+		src := t.TempDir()
+		sizes := make(map[string]int, count)
+		for i := 0; i < count; i++ {
+			sizes[fmt.Sprintf("file-%04d.txt", i)] = 325
+		}
+		writeRandomFiles(t, src, sizes)
+
+		result, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 1<<20, false, nil, WithPacking(true))
+		require.NoError(t, err)
+		var total int64
+		// the CAR of what is left over may take a smaller piece
+		require.Equal(t, MaxPieceSize(1<<20), result.Cars[0].PieceSize)
+		for _, car := range result.Cars {
+			require.LessOrEqual(t, car.PieceSize, MaxPieceSize(1<<20))
+			require.LessOrEqual(t, car.CarSize, PieceCapacity(car.PieceSize))
+			total += car.CarSize
+		}
+		// as few CARs as the data needs
+		require.Len(t, result.Cars, int((total+PieceCapacity(1<<20)-1)/PieceCapacity(1<<20)), count)
+	}
+}
+
+// TestCarSizeEstimate checks that the planned size of a CAR is never below
+// its real size, which would make its piece twice as big.
+func TestCarSizeEstimate(t *testing.T) {
+	src := t.TempDir()
+	sizes := map[string]int{"big": 100 << 10, "empty": 0}
+	for i := 0; i < 200; i++ {
+		sizes[fmt.Sprintf("d%03d/sub/f%d", i, i)] = 100
+	}
+	writeRandomFiles(t, src, sizes)
+
+	for _, opts := range [][]Option{
+		nil,
+		{WithRawLeaves(true)},
+		{WithCidVersion(1), WithRawLeaves(true), WithHashFunc("sha2-512")},
+		{WithChunkSize(1 << 10), WithMaxLinks(4)},
+		{WithChunker(ChunkerRabin)},
+		{WithPreserveMode(true), WithPreserveMtime(true), WithRawLeaves(true)},
+	} {
+		for _, withUUID := range []bool{false, true} {
+			o, err := newOptions(opts...)
+			require.NoError(t, err)
+			plans, _ := o.planCars(scanAll(t, src, withUUID, o), 16<<20)
+			require.Len(t, plans, 1)
+			result, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 16<<20, withUUID, nil, append(opts, WithPacking(true))...)
+			require.NoError(t, err)
+			require.Len(t, result.Cars, 1)
+			require.GreaterOrEqual(t, plans[0].Size, result.Cars[0].CarSize)
+		}
+	}
+}
+
+func scanAll(t *testing.T, src string, withUUID bool, o Options) []util.Finfo {
+	var files []util.Finfo
+	for item := range util.GetFileListAsyncOptions(context.Background(), []string{src}, withUUID, o.scanOptions()) {
+		files = append(files, item)
+	}
+	return files
+}
+
+func TestPackedSplit(t *testing.T) {
+	src := t.TempDir()
+	contents := writeRandomFiles(t, src, map[string]int{"big": 150 << 10, "small": 1 << 10})
+
+	opts := []Option{WithPacking(true), WithChunkSize(1 << 10), WithMaxLinks(4)}
+	carDir := t.TempDir()
+	result, err := GenerateCarFromDirResult(context.Background(), carDir, src, 64<<10, false, nil, opts...)
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 3)
+	var last *SplitInfo
+	for _, car := range result.Cars {
+		require.Equal(t, int64(64<<10), car.PieceSize)
+		for _, d := range car.Details {
+			if d.Split != nil && d.Split.Part == d.Split.Parts-1 {
+				last = d.Split
+			}
+		}
+	}
+	require.NotNil(t, last)
+	require.Equal(t, buildTestFile(t, contents["big"], opts...).String(), last.FileCid)
+
+	out := t.TempDir()
+	require.NoError(t, RestoreCar(out, carDir))
+	for name, data := range contents {
+		got, err := os.ReadFile(filepath.Join(out, src, name))
+		require.NoError(t, err)
+		require.Equal(t, data, got)
+	}
+
+	plans, skipped, err := PlanCars([]util.Finfo{}, 64<<10, WithSkipOversized(true))
+	require.NoError(t, err)
+	require.Empty(t, plans)
+	require.Empty(t, skipped)
+}
+
+func TestFileAfterFlushKept(t *testing.T) {
+	src := t.TempDir()
+	names := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		names[fmt.Sprintf("file-%d", i)] = 600
+	}
+	writeRandomFiles(t, src, names)
+	result, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 1000, false, nil)
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 5)
+	require.Equal(t, []string{"file-0", "file-1", "file-2", "file-3", "file-4"}, carFileNames(result))
+}
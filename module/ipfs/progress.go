@@ -0,0 +1,79 @@
+package ipfs
+
+import (
+	"context"
+	"io"
+)
+
+type ProgressType int
+
+const (
+	// ProgressFileScanned is sent for every source file found while scanning.
+	ProgressFileScanned ProgressType = iota
+	// ProgressBytesChunked is sent as source file data is read into the chunker.
+	ProgressBytesChunked
+	// ProgressBlockWritten is sent for every block written into a CAR.
+	ProgressBlockWritten
+	// ProgressCarFinished is sent when a CAR has been generated or restored.
+	ProgressCarFinished
+	// ProgressFileRestored is sent for every file written by restore or extract.
+	ProgressFileRestored
+)
+
+func (t ProgressType) String() string {
+	switch t {
+	case ProgressFileScanned:
+		return "file-scanned"
+	case ProgressBytesChunked:
+		return "bytes-chunked"
+	case ProgressBlockWritten:
+		return "block-written"
+	case ProgressCarFinished:
+		return "car-finished"
+	case ProgressFileRestored:
+		return "file-restored"
+	default:
+		return "unknown"
+	}
+}
+
+// ProgressEvent describes one step of a generation or restore run. Path is the
+// source or restored file for file and chunk events, and the CAR file for CAR
+// events. Block events only carry the block Cid. Bytes is the size of what the
+// event covers.
+type ProgressEvent struct {
+	Type  ProgressType `json:"type"`
+	Path  string       `json:"path"`
+	Cid   string       `json:"cid,omitempty"`
+	Bytes int64        `json:"bytes"`
+}
+
+// ProgressFunc receives progress events. It may be called from several
+// goroutines at once and should return quickly.
+type ProgressFunc func(ProgressEvent)
+
+func (f ProgressFunc) report(ev ProgressEvent) {
+	if f != nil {
+		f(ev)
+	}
+}
+
+// progressReader stops reading once ctx is done and reports every read as
+// chunked bytes.
+type progressReader struct {
+	ctx      context.Context
+	r        io.Reader
+	path     string
+	progress ProgressFunc
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.progress.report(ProgressEvent{Type: ProgressBytesChunked, Path: r.path, Bytes: int64(n)})
+	}
+	return n, err
+}
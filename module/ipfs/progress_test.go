@@ -0,0 +1,163 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ipld/go-car/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// progressRecorder collects the events of a run, cancel is called on the
+// first event stop returns true for.
+type progressRecorder struct {
+	lock   sync.Mutex
+	events []ProgressEvent
+	stop   func(ProgressEvent) bool
+	cancel context.CancelFunc
+}
+
+func (r *progressRecorder) report(ev ProgressEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, ev)
+	if r.stop != nil && r.stop(ev) {
+		r.cancel()
+		r.stop = nil
+	}
+}
+
+func (r *progressRecorder) of(typ ProgressType) []ProgressEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var events []ProgressEvent
+	for _, ev := range r.events {
+		if ev.Type == typ {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+func TestProgress(t *testing.T) {
+	src := t.TempDir()
+	sizes := map[string]int{"a": 3000, "b": 1000, "c": 10}
+	writeRandomFiles(t, src, sizes)
+
+	rec := &progressRecorder{}
+	carDir := t.TempDir()
+	result, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, rec.report, WithChunkSize(256))
+	require.NoError(t, err)
+
+	scanned := make(map[string]int64)
+	for _, ev := range rec.of(ProgressFileScanned) {
+		scanned[ev.Path] += ev.Bytes
+	}
+	chunked := make(map[string]int64)
+	for _, ev := range rec.of(ProgressBytesChunked) {
+		chunked[ev.Path] += ev.Bytes
+	}
+	for name, size := range sizes {
+		require.Equal(t, int64(size), scanned[filepath.Join(src, name)], name)
+		require.Equal(t, int64(size), chunked[filepath.Join(src, name)], name)
+	}
+	require.Len(t, scanned, len(sizes))
+
+	// every block in the CARs is reported once, with its size
+	var blocks, blockBytes int64
+	for _, ev := range rec.of(ProgressBlockWritten) {
+		blocks++
+		blockBytes += ev.Bytes
+	}
+	var carBlocks, carBlockBytes int64
+	finished := rec.of(ProgressCarFinished)
+	require.Len(t, finished, len(result.Cars))
+	for i, info := range result.Cars {
+		require.Equal(t, info.CarFilePath, finished[i].Path)
+		require.Equal(t, info.RootCid, finished[i].Cid)
+		require.Equal(t, info.CarSize, finished[i].Bytes)
+
+		f, err := os.Open(info.CarFilePath)
+		require.NoError(t, err)
+		br, err := car.NewBlockReader(f)
+		require.NoError(t, err)
+		for {
+			blk, err := br.Next()
+			if err != nil {
+				break
+			}
+			carBlocks++
+			carBlockBytes += int64(len(blk.RawData()))
+		}
+		require.NoError(t, f.Close())
+	}
+	require.Equal(t, carBlocks, blocks)
+	require.Equal(t, carBlockBytes, blockBytes)
+
+	rec = &progressRecorder{}
+	out := t.TempDir()
+	require.NoError(t, RestoreCarContext(context.Background(), out, carDir, rec.report))
+	require.Len(t, rec.of(ProgressCarFinished), len(result.Cars))
+	restored := make(map[string]int64)
+	for _, ev := range rec.of(ProgressFileRestored) {
+		restored[filepath.Base(ev.Path)] += ev.Bytes
+	}
+	// the parts of a split file are restored one by one
+	require.Equal(t, int64(sizes["b"]), restored["b"])
+	require.Equal(t, int64(sizes["c"]), restored["c"])
+	var parts int64
+	for name, n := range restored {
+		if filepath.Ext(name) != "" {
+			parts += n
+		}
+	}
+	require.Equal(t, int64(sizes["a"]), parts)
+}
+
+func TestCancel(t *testing.T) {
+	src := t.TempDir()
+	sizes := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		sizes[fmt.Sprintf("file-%02d", i)] = 1500
+	}
+	writeRandomFiles(t, src, sizes)
+
+	for _, stop := range []ProgressType{ProgressFileScanned, ProgressBytesChunked, ProgressBlockWritten, ProgressCarFinished} {
+		ctx, cancel := context.WithCancel(context.Background())
+		rec := &progressRecorder{cancel: cancel, stop: func(ev ProgressEvent) bool { return ev.Type == stop }}
+		carDir := t.TempDir()
+		result, err := GenerateCarFromDirResult(ctx, carDir, src, 2048, false, rec.report, WithChunkSize(256))
+		cancel()
+		require.True(t, errors.Is(err, context.Canceled), "%s: %v", stop, err)
+
+		tmps, err := filepath.Glob(filepath.Join(carDir, "*.car.tmp"))
+		require.NoError(t, err)
+		require.Empty(t, tmps, stop.String())
+		// the CARs left are the finished ones, and they are whole
+		cars, err := filepath.Glob(filepath.Join(carDir, "*.car"))
+		require.NoError(t, err)
+		require.Len(t, cars, len(result.Cars), stop.String())
+		require.Less(t, len(cars), len(sizes), stop.String())
+		for _, info := range result.Cars {
+			_, err := ListCarEntries(info.CarFilePath)
+			require.NoError(t, err, stop.String())
+		}
+	}
+
+	carDir := t.TempDir()
+	result, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, nil, WithChunkSize(256))
+	require.NoError(t, err)
+	require.Len(t, result.Cars, len(sizes))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rec := &progressRecorder{cancel: cancel, stop: func(ev ProgressEvent) bool { return ev.Type == ProgressFileRestored }}
+	err = RestoreCarContext(ctx, t.TempDir(), carDir, rec.report)
+	require.True(t, errors.Is(err, context.Canceled), "%v", err)
+	require.Less(t, len(rec.of(ProgressFileRestored)), len(sizes))
+}
@@ -0,0 +1,190 @@
+package ipfs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildResultSkipped(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "big"), make([]byte, 2048), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "small"), []byte("small"), 0644))
+	require.NoError(t, os.Symlink("missing", filepath.Join(src, "broken")))
+
+	result, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 1024, false, nil, WithSkipOversized(true))
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 1)
+	require.Len(t, result.Skipped, 2)
+	reasons := map[string]SkipReason{}
+	for _, f := range result.Skipped {
+		reasons[filepath.Base(f.Path)] = f.Reason
+	}
+	require.Equal(t, map[string]SkipReason{"big": SkipOversized, "broken": SkipUnreadable}, reasons)
+
+	_, err = GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 1024, false, nil, WithSkipOversized(true), WithStrict(true))
+	var skipErr *SkipError
+	require.True(t, errors.As(err, &skipErr))
+	require.Contains(t, []SkipReason{SkipOversized, SkipUnreadable}, skipErr.File.Reason)
+}
+
+func TestSplitOversized(t *testing.T) {
+	src := t.TempDir()
+	data := make([]byte, 5000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a-small"), []byte("small"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "b-big"), data, 0644))
+
+	carDir := t.TempDir()
+	result, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, nil)
+	require.NoError(t, err)
+	require.Empty(t, result.Skipped)
+	require.Len(t, result.Cars, 3)
+
+	var parts []*SplitInfo
+	for _, car := range result.Cars {
+		for _, d := range car.Details {
+			if d.Split != nil {
+				parts = append(parts, d.Split)
+			}
+		}
+	}
+	require.Len(t, parts, 3)
+	next := int64(0)
+	for i, part := range parts {
+		require.Equal(t, i, part.Part)
+		require.Equal(t, 3, part.Parts)
+		require.Equal(t, next, part.Start)
+		sum := sha256.Sum256(data[part.Start : part.End+1])
+		require.Equal(t, hex.EncodeToString(sum[:]), part.Sha256)
+		next = part.End + 1
+	}
+	require.Equal(t, int64(len(data)), next)
+	// the first part fills up the CAR of the small file
+	require.Equal(t, int64(2048-len("small")-1), parts[0].End)
+
+	out := t.TempDir()
+	require.NoError(t, RestoreCar(out, carDir))
+	got, err := os.ReadFile(filepath.Join(out, src, "b-big"))
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	result, err = GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 2048, false, nil, WithSkipOversized(true))
+	require.NoError(t, err)
+	require.Len(t, result.Skipped, 1)
+	require.Equal(t, SkipOversized, result.Skipped[0].Reason)
+
+	// a CAR filled up exactly by the file before gets no empty part
+	src = t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a-full"), data[:1000], 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "b-big"), data[:3000], 0644))
+	result, err = GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 1000, false, nil)
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 4)
+	require.Len(t, result.Cars[0].Details, 1)
+	for i, car := range result.Cars[1:] {
+		require.Len(t, car.Details, 1)
+		require.Equal(t, i, car.Details[0].Split.Part)
+		require.Equal(t, 3, car.Details[0].Split.Parts)
+		require.Equal(t, int64(i*1000), car.Details[0].Split.Start)
+		require.Equal(t, int64(i*1000+999), car.Details[0].Split.End)
+	}
+}
+
+func TestSplitAlongDag(t *testing.T) {
+	src := t.TempDir()
+	data := make([]byte, 5000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a-small"), []byte("small"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "b-big"), data, 0644))
+
+	for _, opts := range [][]Option{
+		{WithChunkSize(256), WithMaxLinks(4)},
+		{WithChunkSize(32), WithMaxLinks(4), WithCidVersion(1), WithRawLeaves(true)},
+	} {
+		carDir := t.TempDir()
+		result, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, nil, opts...)
+		require.NoError(t, err)
+		require.Empty(t, result.Skipped)
+
+		var parts []*SplitInfo
+		for _, car := range result.Cars {
+			for _, d := range car.Details {
+				if d.Split != nil {
+					parts = append(parts, d.Split)
+				}
+			}
+		}
+		require.Greater(t, len(parts), 2)
+		last := parts[len(parts)-1]
+		for _, part := range parts[:len(parts)-1] {
+			require.Empty(t, part.FileCid)
+		}
+		require.Equal(t, buildTestFile(t, data, opts...).String(), last.FileCid)
+
+		// the whole file can be read once all the CARs are loaded
+		bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		for _, car := range result.Cars {
+			_, err := Import(context.Background(), car.CarFilePath, bs)
+			require.NoError(t, err)
+		}
+		ds := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+		root, err := cid.Decode(last.FileCid)
+		require.NoError(t, err)
+		nd, err := ds.Get(context.Background(), root)
+		require.NoError(t, err)
+		r, err := uio.NewDagReader(context.Background(), nd, ds)
+		require.NoError(t, err)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, got)
+
+		out := t.TempDir()
+		require.NoError(t, RestoreCar(out, carDir))
+		got, err = os.ReadFile(filepath.Join(out, src, "b-big"))
+		require.NoError(t, err)
+		require.Equal(t, data, got)
+	}
+}
+
+func TestSplitAlongDagCarFails(t *testing.T) {
+	src := t.TempDir()
+	writeRandomFiles(t, src, map[string]int{"big": 6000})
+	opts := []Option{WithChunkSize(256), WithMaxLinks(4)}
+	full, err := GenerateCarFromDirResult(context.Background(), t.TempDir(), src, 2048, false, nil, opts...)
+	require.NoError(t, err)
+	require.Len(t, full.Cars, 3)
+
+	// the CAR of the second part can not be moved into place, so the file
+	// has no CID over all its parts
+	carDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(carDir, full.Cars[1].CarFileName, "in-the-way"), 0755))
+	result, err := GenerateCarFromDirResult(context.Background(), carDir, src, 2048, false, nil, opts...)
+	require.NoError(t, err)
+	require.Len(t, result.Skipped, 1)
+	require.Len(t, result.Cars, 2)
+	for _, car := range result.Cars {
+		for _, d := range car.Details {
+			require.Empty(t, d.Split.FileCid)
+		}
+	}
+	require.Equal(t, full.Cars[0].RootCid, result.Cars[0].RootCid)
+}
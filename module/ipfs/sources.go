@@ -0,0 +1,267 @@
+package ipfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/FogMeta/meta-lib/logs"
+	"github.com/FogMeta/meta-lib/util"
+	"golang.org/x/xerrors"
+)
+
+// SourceFile is a row of a source manifest, a file to put in the CARs.
+type SourceFile struct {
+	// Path is the file on disk.
+	Path string `json:"path"`
+	// Dest is the path of the file in its CAR, the path layout options
+	// place it when empty.
+	Dest string `json:"dest,omitempty"`
+	Uuid string `json:"uuid,omitempty"`
+	// Sha256 is the expected hex checksum of the file, a CAR whose file has
+	// another one fails.
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+// sourceColumns are the columns of a CSV source manifest, path is required.
+var sourceColumns = []string{"path", "dest", "uuid", "sha256"}
+
+// ReadSourceManifest reads the rows of the source manifest at path. A CSV
+// manifest names its columns, out of path, dest, uuid and sha256, in its
+// header line; JSON and NDJSON manifests have SourceFile objects.
+func ReadSourceManifest(path string, format ManifestFormat) ([]SourceFile, error) {
+	var files []SourceFile
+	err := readSourceManifest(path, format, func(f SourceFile) error {
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
+
+// readSourceManifest calls fn with the rows of the source manifest at path as
+// they are read, it stops at the first error of fn.
+func readSourceManifest(path string, format ManifestFormat, fn func(SourceFile) error) error {
+	if err := format.validate(); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	row := func(line int, sf SourceFile) error {
+		if sf.Path == "" {
+			return xerrors.Errorf("read source manifest %s: line %d has no path", path, line)
+		}
+		if sf.Sha256 != "" {
+			if sum, err := hex.DecodeString(sf.Sha256); err != nil || len(sum) != sha256.Size {
+				return xerrors.Errorf("read source manifest %s: line %d: %q is no sha256 checksum", path, line, sf.Sha256)
+			}
+		}
+		return fn(sf)
+	}
+	switch format {
+	case ManifestNDJSON:
+		dec := json.NewDecoder(f)
+		for line := 1; ; line++ {
+			var sf SourceFile
+			if err := dec.Decode(&sf); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return xerrors.Errorf("read source manifest %s: line %d: %w", path, line, err)
+			}
+			if err := row(line, sf); err != nil {
+				return err
+			}
+		}
+	case ManifestJSON:
+		// the array is decoded one row at a time, it may be large
+		dec := json.NewDecoder(f)
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			return xerrors.Errorf("read source manifest %s: not a JSON array", path)
+		}
+		for i := 1; dec.More(); i++ {
+			var sf SourceFile
+			if err := dec.Decode(&sf); err != nil {
+				return xerrors.Errorf("read source manifest %s: row %d: %w", path, i, err)
+			}
+			if err := row(i, sf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	r := csv.NewReader(f)
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil {
+		return xerrors.Errorf("read source manifest %s: %w", path, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["path"]; !ok {
+		return xerrors.Errorf("read source manifest %s: no path column in %v", path, header)
+	}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return xerrors.Errorf("read source manifest %s: %w", path, err)
+		}
+		line, _ := r.FieldPos(0)
+		var values [4]string
+		for i, name := range sourceColumns {
+			if c, ok := columns[name]; ok {
+				values[i] = strings.TrimSpace(record[c])
+			}
+		}
+		if err := row(line, SourceFile{Path: values[0], Dest: values[1], Uuid: values[2], Sha256: values[3]}); err != nil {
+			return err
+		}
+	}
+}
+
+// GenerateCarFromManifest is GenerateCarFromDirResult for the files of the
+// source manifest at manifestPath, in its order. The files keep the UUIDs of
+// the manifest and go to their destination paths in the CARs; files that
+// can not be read and directories are skipped as unreadable.
+func GenerateCarFromManifest(ctx context.Context, outputDir string, manifestPath string, format ManifestFormat, sliceSize int64, progress ProgressFunc, opts ...Option) (BuildResult, error) {
+	result := BuildResult{Cars: make([]CarInfo, 0)}
+	o, err := newOptions(opts...)
+	if err != nil {
+		return result, err
+	}
+	if err := format.validate(); err != nil {
+		return result, err
+	}
+	if !util.ExistDir(outputDir) {
+		return result, xerrors.Errorf("Unexpected! The path of output dir does not exist")
+	}
+	if _, err := os.Stat(manifestPath); err != nil {
+		return result, err
+	}
+
+	// a manifest that can not be read stops the run
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var lock sync.Mutex
+	var readErr error
+	run := struct {
+		Manifest  string         `json:"manifest"`
+		Format    ManifestFormat `json:"format"`
+		SliceSize int64          `json:"slice_size"`
+		Options   Options        `json:"options"`
+	}{manifestPath, format, sliceSize, o}
+	result, err = generateCars(ctx, outputDir, sliceSize, progress, o, run, fileSource{scan: func(ctx context.Context, onError func(string, error)) <-chan util.Finfo {
+		fichan := make(chan util.Finfo)
+		go func() {
+			defer close(fichan)
+			err := readSourceManifest(manifestPath, format, func(sf SourceFile) error {
+				info, err := os.Stat(sf.Path)
+				if err == nil && info.IsDir() {
+					err = xerrors.Errorf("%s is a directory", sf.Path)
+				}
+				if err != nil {
+					log.GetLog().Warn(err)
+					onError(sf.Path, err)
+					return nil
+				}
+				item := util.Finfo{
+					Path:   sf.Path,
+					Name:   info.Name(),
+					Uuid:   sf.Uuid,
+					Info:   info,
+					Dest:   sf.Dest,
+					Sha256: strings.ToLower(sf.Sha256),
+				}
+				select {
+				case fichan <- item:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if err != nil && ctx.Err() == nil {
+				lock.Lock()
+				readErr = err
+				lock.Unlock()
+				cancel()
+			}
+		}()
+		return fichan
+	}})
+	lock.Lock()
+	defer lock.Unlock()
+	if readErr != nil {
+		return result, readErr
+	}
+	return result, err
+}
+
+// fileSum is the running checksum of a file split across CARs.
+type fileSum struct {
+	h    hash.Hash
+	next int64
+}
+
+// sumHash returns the hash the data of item is written to for its expected
+// checksum, nil when it is not checked. The parts of a split file go to one
+// hash, so they must be built in order; a file whose first parts were built
+// by an earlier run is not checked.
+func (b *carBuilder) sumHash(item util.Finfo) hash.Hash {
+	if item.Sha256 == "" {
+		return nil
+	}
+	if item.Parts == 0 {
+		return sha256.New()
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if item.Part == 0 {
+		b.sums[item.Path] = &fileSum{h: sha256.New()}
+	}
+	s := b.sums[item.Path]
+	if s == nil || s.next != item.SeekStart {
+		delete(b.sums, item.Path)
+		log.GetLog().Warnf("the checksum of %s is not checked, its first parts were not read", item.Path)
+		return nil
+	}
+	s.next = item.SeekEnd + 1
+	return s.h
+}
+
+// checkSum compares the checksum in h of item with the expected one, once
+// the whole file is read.
+func (b *carBuilder) checkSum(item util.Finfo, h hash.Hash) error {
+	if h == nil {
+		return nil
+	}
+	if item.Parts > 0 {
+		if item.Part < item.Parts-1 {
+			return nil
+		}
+		b.dropSum(item.Path)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != item.Sha256 {
+		return xerrors.Errorf("%s has sha256 %s, %s is expected", item.Path, sum, item.Sha256)
+	}
+	return nil
+}
+
+func (b *carBuilder) dropSum(path string) {
+	b.lock.Lock()
+	delete(b.sums, path)
+	b.lock.Unlock()
+}
@@ -0,0 +1,62 @@
+package ipfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateCarFromManifest(t *testing.T) {
+	src := t.TempDir()
+	data := writeRandomFiles(t, src, map[string]int{"a": 100, "b": 5000, "c": 10})
+	sum := func(name string) string {
+		h := sha256.Sum256(data[name])
+		return hex.EncodeToString(h[:])
+	}
+	manifest := filepath.Join(t.TempDir(), "files.csv")
+	require.NoError(t, os.WriteFile(manifest, []byte(fmt.Sprintf(`sha256,path,dest,uuid
+%s,%s,x/renamed-a,u1
+%s,%s,big,
+,%s,,
+,%s,,
+`, sum("a"), filepath.Join(src, "a"), sum("b"), filepath.Join(src, "b"), filepath.Join(src, "c"), filepath.Join(src, "missing"))), 0644))
+
+	result, err := GenerateCarFromManifest(context.Background(), t.TempDir(), manifest, ManifestCSV, 2048, nil)
+	require.NoError(t, err)
+	require.Len(t, result.Skipped, 1)
+	require.Equal(t, SkipUnreadable, result.Skipped[0].Reason)
+	paths := make(map[string]CarEntry)
+	for _, car := range result.Cars {
+		entries, err := ListCarEntries(car.CarFilePath)
+		require.NoError(t, err)
+		for _, e := range entries {
+			paths[e.Path] = e
+		}
+	}
+	require.Equal(t, "u1", paths["x/renamed-a"].Uuid)
+	require.Equal(t, CarEntryFile, paths["big.00000001"].Type)
+	require.Equal(t, uint64(10), paths[filepath.Join(src, "c")[1:]].Size)
+
+	// a file with another checksum fails its CAR
+	bad := filepath.Join(t.TempDir(), "files.ndjson")
+	require.NoError(t, os.WriteFile(bad, []byte(fmt.Sprintf(`{"path":%q,"sha256":%q}`+"\n", filepath.Join(src, "b"), sum("a"))), 0644))
+	result, err = GenerateCarFromManifest(context.Background(), t.TempDir(), bad, ManifestNDJSON, 2048, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, result.Skipped)
+	require.Equal(t, SkipFailedCar, result.Skipped[len(result.Skipped)-1].Reason)
+	_, err = GenerateCarFromManifest(context.Background(), t.TempDir(), bad, ManifestNDJSON, 1<<20, nil, WithStrict(true))
+	require.Error(t, err)
+
+	// a row without a path stops the run at its line
+	require.NoError(t, os.WriteFile(bad, []byte(fmt.Sprintf(`{"path":%q}`+"\n"+`{"dest":"x"}`+"\n", filepath.Join(src, "a"))), 0644))
+	_, err = GenerateCarFromManifest(context.Background(), t.TempDir(), bad, ManifestNDJSON, 1<<20, nil)
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "line 2"), err.Error())
+}
@@ -0,0 +1,266 @@
+package ipfs
+
+import (
+	"io"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
+	"golang.org/x/xerrors"
+
+	"github.com/FogMeta/meta-lib/util"
+)
+
+// A file split along its DAG keeps the CID `ipfs add` gives it. Every part
+// holds whole subtrees of one depth of the balanced DAG of the file, tied
+// together by a part node that is listed in the CAR of the part. The nodes
+// above the subtrees are small and go to the CAR of the last part, so the
+// whole file can be retrieved by its CID once all the CARs are loaded.
+
+// splitMinSubtrees is the least number of subtrees a slice can hold, it
+// keeps CARs nearly full when the parts are cut at subtree boundaries.
+const splitMinSubtrees = 16
+
+// splitSpan returns the file bytes under one subtree of the parts of a file
+// split across CARs of sliceSize, and the depth of the subtrees. A span of 0
+// means the file DAG can not be split, the parts are then independent files.
+func (o Options) splitSpan(sliceSize int64) (span int64, depth int) {
+	if o.Chunker != ChunkerFixed || o.Layout != LayoutBalanced || o.ChunkSize > sliceSize {
+		return 0, 0
+	}
+	span = o.ChunkSize
+	for span <= sliceSize/splitMinSubtrees/int64(o.MaxLinks) {
+		span *= int64(o.MaxLinks)
+		depth++
+	}
+	return span, depth
+}
+
+// splitLink is a link to a node of a split file DAG.
+type splitLink struct {
+	cid      cid.Cid
+	size     uint64
+	fileSize uint64
+}
+
+// fileSplit is the state of a file split along its DAG, kept by the
+// carBuilder from the CAR of its first part to the one of its last.
+type fileSplit struct {
+	depth    int
+	parts    int
+	subtrees []splitLink
+	// pending is the part built into the CAR being built, taken into the
+	// state once that CAR is finished, see commitSplits
+	pending *splitPart
+}
+
+// splitPart is a built part of a file split along its DAG.
+type splitPart struct {
+	subtrees []splitLink
+	// root is the CID of the whole file, known after the last part
+	root cid.Cid
+}
+
+// startSplit makes the parts of the file at path be built as subtrees of
+// depth of its DAG.
+func (b *carBuilder) startSplit(path string, depth int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.splits[path] = &fileSplit{depth: depth}
+}
+
+// split returns the state of the file at path when it is split along its DAG.
+func (b *carBuilder) split(path string) *fileSplit {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.splits[path]
+}
+
+// fileCid returns the CID of the whole file that item is the last part of,
+// an empty string when its parts are independent files.
+func (b *carBuilder) fileCid(item util.Finfo) string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	sp, ok := b.splits[item.Path]
+	if !ok || item.Part != item.Parts-1 || sp.pending == nil || !sp.pending.root.Defined() {
+		return ""
+	}
+	return sp.pending.root.String()
+}
+
+// commitSplits takes the parts of fileList into the state of their splits,
+// once their CAR is finished. A split ends with its last part.
+func (b *carBuilder) commitSplits(fileList []util.Finfo) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, item := range fileList {
+		sp, ok := b.splits[item.Path]
+		if !ok || item.Parts == 0 || sp.pending == nil {
+			continue
+		}
+		sp.parts++
+		sp.subtrees = append(sp.subtrees, sp.pending.subtrees...)
+		sp.pending = nil
+		if item.Part == item.Parts-1 {
+			delete(b.splits, item.Path)
+		}
+	}
+}
+
+// dropSplits drops the splits of the parts in fileList when their CAR
+// failed, the parts after it are then built as independent files.
+func (b *carBuilder) dropSplits(fileList []util.Finfo) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, item := range fileList {
+		if item.Parts > 0 {
+			delete(b.splits, item.Path)
+		}
+	}
+}
+
+// buildSplitPart builds the subtrees of the part item of a split file from
+// r, the bytes of the part, and returns the part node over them. The last
+// part also builds the nodes above the subtrees. The part is left pending in
+// sp until its CAR is finished.
+func (b *carBuilder) buildSplitPart(item util.Finfo, sp *fileSplit, r io.Reader, ds ipld.DAGService, cidBuilder cid.Builder) (ipld.Node, error) {
+	if item.Part != sp.parts {
+		return nil, xerrors.Errorf("part %d of %s follows a missing part", item.Part, item.Path)
+	}
+	params := ihelper.DagBuilderParams{
+		Maxlinks:   b.opts.MaxLinks,
+		RawLeaves:  b.opts.RawLeaves,
+		CidBuilder: cidBuilder,
+		Dagserv:    ds,
+	}
+	db, err := params.New(b.opts.splitter(r))
+	if err != nil {
+		return nil, err
+	}
+	var subtrees []splitLink
+	for !db.Done() {
+		var nd ipld.Node
+		var fileSize uint64
+		if sp.depth == 0 {
+			nd, fileSize, err = db.NewLeafDataNode(unixfs.TFile)
+		} else {
+			nd, fileSize, err = fillSubtree(db, sp.depth)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Add(nd); err != nil {
+			return nil, err
+		}
+		size, err := nd.Size()
+		if err != nil {
+			return nil, err
+		}
+		subtrees = append(subtrees, splitLink{cid: nd.Cid(), size: size, fileSize: fileSize})
+	}
+
+	part, err := b.splitNode(subtrees, cidBuilder, item)
+	if err != nil {
+		return nil, err
+	}
+	if err := ds.Add(b.ctx, part); err != nil {
+		return nil, err
+	}
+	pending := &splitPart{subtrees: subtrees}
+	if item.Part < item.Parts-1 {
+		sp.pending = pending
+		return part, nil
+	}
+
+	// tie the subtrees together level by level, as the balanced layout does
+	links := append(append([]splitLink(nil), sp.subtrees...), subtrees...)
+	for len(links) > b.opts.MaxLinks {
+		var level []splitLink
+		for start := 0; start < len(links); start += b.opts.MaxLinks {
+			end := start + b.opts.MaxLinks
+			if end > len(links) {
+				end = len(links)
+			}
+			nd, err := b.splitNode(links[start:end], cidBuilder, util.Finfo{})
+			if err != nil {
+				return nil, err
+			}
+			if err := ds.Add(b.ctx, nd); err != nil {
+				return nil, err
+			}
+			size, err := nd.Size()
+			if err != nil {
+				return nil, err
+			}
+			level = append(level, splitLink{cid: nd.Cid(), size: size, fileSize: sumFileSize(links[start:end])})
+		}
+		links = level
+	}
+	root, err := b.splitNode(links, cidBuilder, item)
+	if err != nil {
+		return nil, err
+	}
+	if err := ds.Add(b.ctx, root); err != nil {
+		return nil, err
+	}
+	pending.root = root.Cid()
+	sp.pending = pending
+	return part, nil
+}
+
+func sumFileSize(links []splitLink) (size uint64) {
+	for _, l := range links {
+		size += l.fileSize
+	}
+	return size
+}
+
+// splitNode returns a file node linking to links, with the metadata of
+// item when it is to be preserved.
+func (b *carBuilder) splitNode(links []splitLink, cidBuilder cid.Builder, item util.Finfo) (*dag.ProtoNode, error) {
+	fsn := unixfs.NewFSNode(unixfs.TFile)
+	nd := new(dag.ProtoNode)
+	nd.SetCidBuilder(cidBuilder)
+	for _, l := range links {
+		if err := nd.AddRawLink("", &ipld.Link{Cid: l.cid, Size: l.size}); err != nil {
+			return nil, err
+		}
+		fsn.AddBlockSize(l.fileSize)
+	}
+	data, err := fsn.GetBytes()
+	if err != nil {
+		return nil, err
+	}
+	nd.SetData(data)
+	if item.Info == nil {
+		return nd, nil
+	}
+	return b.opts.withMetadata(nd, item.Info)
+}
+
+// fillSubtree builds a full subtree of depth from db, as the balanced
+// layout does below its root.
+func fillSubtree(db *ihelper.DagBuilderHelper, depth int) (ipld.Node, uint64, error) {
+	node := db.NewFSNodeOverDag(unixfs.TFile)
+	for node.NumChildren() < db.Maxlinks() && !db.Done() {
+		var child ipld.Node
+		var fileSize uint64
+		var err error
+		if depth == 1 {
+			child, fileSize, err = db.NewLeafDataNode(unixfs.TFile)
+		} else {
+			child, fileSize, err = fillSubtree(db, depth-1)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := node.AddChild(child, fileSize, db); err != nil {
+			return nil, 0, err
+		}
+	}
+	fileSize := node.FileSize()
+	nd, err := node.Commit()
+	return nd, fileSize, err
+}
@@ -0,0 +1,57 @@
+package ipfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/FogMeta/meta-lib/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSymlinkPolicy(t *testing.T) {
+	src := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "unrelated"), []byte("unrelated"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(src, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "dir", "file"), []byte("file"), 0644))
+	require.NoError(t, os.Symlink("file", filepath.Join(src, "dir", "link")))
+	require.NoError(t, os.Symlink("..", filepath.Join(src, "dir", "loop")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(src, "outside")))
+
+	scan := func(policy util.SymlinkPolicy) []string {
+		files, err := ScanFiles(context.Background(), []string{src}, false, WithSymlinks(policy))
+		require.NoError(t, err)
+		var names []string
+		for item := range files {
+			rel, err := filepath.Rel(src, item.Path)
+			require.NoError(t, err)
+			names = append(names, rel)
+		}
+		sort.Strings(names)
+		return names
+	}
+	require.Equal(t, []string{"dir/file", "dir/link", "outside/unrelated"}, scan(SymlinkFollow))
+	require.Equal(t, []string{"dir/file"}, scan(SymlinkSkip))
+	require.Equal(t, []string{"dir/file", "dir/link", "dir/loop", "outside"}, scan(SymlinkStore))
+
+	_, err := newOptions(WithSymlinks("sometimes"))
+	require.Error(t, err)
+
+	carDir := t.TempDir()
+	cars, err := GenerateCarFromDirEx(carDir, src, 1<<20, false, WithSymlinks(SymlinkStore))
+	require.NoError(t, err)
+	require.Len(t, cars, 1)
+	out := t.TempDir()
+	require.NoError(t, RestoreCar(out, cars[0].CarFilePath))
+	for link, target := range map[string]string{"dir/link": "file", "dir/loop": "..", "outside": outside} {
+		got, err := os.Readlink(filepath.Join(out, src, link))
+		require.NoError(t, err)
+		require.Equal(t, target, got)
+	}
+	data, err := os.ReadFile(filepath.Join(out, src, "dir", "file"))
+	require.NoError(t, err)
+	require.Equal(t, "file", string(data))
+}
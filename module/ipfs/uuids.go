@@ -0,0 +1,236 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/ipfs/go-unixfsnode/data"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	ipldprime "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/pborman/uuid"
+	"golang.org/x/xerrors"
+)
+
+// The UUIDs of the files of a CAR are kept in a DAG-CBOR map of the form
+// {"uuids": {"<path in the CAR>": "<uuid>"}}, linked from the root directory
+// of the CAR as UuidMapName. The UnixFS directory stays the only root of the
+// CAR; a link of that name is only taken for the map when it has its shape.
+
+// UuidMapName is the name of the link to the UUID map in the root directory
+// of a CAR.
+const UuidMapName = ".uuids"
+
+// uuidMapPrefix is the CID prefix of the UUID map of a CAR.
+var uuidMapPrefix = cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: mh.SHA2_256, MhLength: -1}
+
+const uuidMapKey = "uuids"
+
+type blockGetter interface {
+	Get(context.Context, cid.Cid) (blocks.Block, error)
+}
+
+// buildUuidMap encodes uuids, the UUIDs by path in the CAR, as a block.
+func buildUuidMap(uuids map[string]string) (blocks.Block, error) {
+	paths := make([]string, 0, len(uuids))
+	for p := range uuids {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	nb := basicnode.Prototype.Map.NewBuilder()
+	ma, err := nb.BeginMap(1)
+	if err != nil {
+		return nil, err
+	}
+	if err := ma.AssembleKey().AssignString(uuidMapKey); err != nil {
+		return nil, err
+	}
+	um, err := ma.AssembleValue().BeginMap(int64(len(paths)))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		if err := um.AssembleKey().AssignString(p); err != nil {
+			return nil, err
+		}
+		if err := um.AssembleValue().AssignString(uuids[p]); err != nil {
+			return nil, err
+		}
+	}
+	if err := um.Finish(); err != nil {
+		return nil, err
+	}
+	if err := ma.Finish(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(nb.Build(), &buf); err != nil {
+		return nil, err
+	}
+	c, err := uuidMapPrefix.Sum(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(buf.Bytes(), c)
+}
+
+// decodeUuidMap decodes the UUID map in raw, it returns false when raw does
+// not have the shape of one.
+func decodeUuidMap(raw []byte) (map[string]string, bool) {
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagcbor.Decode(nb, bytes.NewReader(raw)); err != nil {
+		return nil, false
+	}
+	n := nb.Build()
+	if n.Kind() != ipldprime.Kind_Map || n.Length() != 1 {
+		return nil, false
+	}
+	m, err := n.LookupByString(uuidMapKey)
+	if err != nil || m.Kind() != ipldprime.Kind_Map {
+		return nil, false
+	}
+	uuids := make(map[string]string, m.Length())
+	it := m.MapIterator()
+	for !it.Done() {
+		k, v, err := it.Next()
+		if err != nil {
+			return nil, false
+		}
+		p, err := k.AsString()
+		if err != nil {
+			return nil, false
+		}
+		id, err := v.AsString()
+		if err != nil {
+			return nil, false
+		}
+		uuids[p] = id
+	}
+	return uuids, true
+}
+
+// uuidMapLink returns the UUIDs of the link name to c of a root directory,
+// false when it is no UUID map.
+func uuidMapLink(ctx context.Context, bs blockGetter, name string, c cid.Cid) (map[string]string, bool, error) {
+	if name != UuidMapName || c.Type() != cid.DagCBOR {
+		return nil, false, nil
+	}
+	blk, err := bs.Get(ctx, c)
+	if err != nil {
+		return nil, false, err
+	}
+	uuids, ok := decodeUuidMap(blk.RawData())
+	return uuids, ok, nil
+}
+
+// ReadUuidMap returns the UUIDs by path in the CAR whose root is root and
+// the CID of their map, an empty map and cid.Undef when the root directory
+// links none.
+func ReadUuidMap(ctx context.Context, bs blockGetter, root cid.Cid) (map[string]string, cid.Cid, error) {
+	uuids := make(map[string]string)
+	if root.Type() != cid.DagProtobuf {
+		return uuids, cid.Undef, nil
+	}
+	ls := cidlink.DefaultLinkSystem()
+	ls.TrustedStorage = true
+	ls.StorageReadOpener = func(_ ipldprime.LinkContext, l ipldprime.Link) (io.Reader, error) {
+		cl, ok := l.(cidlink.Link)
+		if !ok {
+			return nil, xerrors.Errorf("not a cidlink")
+		}
+		blk, err := bs.Get(ctx, cl.Cid)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewBuffer(blk.RawData()), nil
+	}
+	pbn, err := ls.Load(ipldprime.LinkContext{}, cidlink.Link{Cid: root}, dagpb.Type.PBNode)
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	pbnode := pbn.(dagpb.PBNode)
+	if !pbnode.Data.Exists() {
+		return uuids, cid.Undef, nil
+	}
+	ufd, err := data.DecodeUnixFSData(pbnode.Data.Must().Bytes())
+	if err != nil || (ufd.FieldDataType().Int() != data.Data_Directory && ufd.FieldDataType().Int() != data.Data_HAMTShard) {
+		return uuids, cid.Undef, nil
+	}
+	mapCid := cid.Undef
+	_, err = forEachDirLink(pbnode, ufd, &ls, func(name string, l dagpb.PBLink) error {
+		cl, err := l.Hash.AsLink()
+		if err != nil {
+			return err
+		}
+		c := cl.(cidlink.Link).Cid
+		m, ok, err := uuidMapLink(ctx, bs, name, c)
+		if ok {
+			uuids, mapCid = m, c
+		}
+		return err
+	})
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	return uuids, mapCid, nil
+}
+
+// StripUuidMap returns the root directory nd without the link to its UUID
+// map, for exporting it as files. The shards of a HAMT directory are written
+// again to ds.
+func StripUuidMap(ctx context.Context, ds ipld.DAGService, nd ipld.Node) (ipld.Node, error) {
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nd, nil
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil || (fsn.Type() != unixfs.TDirectory && fsn.Type() != unixfs.THAMTShard) {
+		return nd, nil
+	}
+	dir, err := uio.NewDirectoryFromNode(ds, pn)
+	if err != nil {
+		return nil, err
+	}
+	m, err := dir.Find(ctx, UuidMapName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nd, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if m.Cid().Type() != cid.DagCBOR {
+		return nd, nil
+	}
+	if _, ok := decodeUuidMap(m.RawData()); !ok {
+		return nd, nil
+	}
+	if err := dir.RemoveChild(ctx, UuidMapName); err != nil {
+		return nil, err
+	}
+	return dir.GetNode()
+}
+
+// SplitLegacyUuid splits a name of an older CAR, where the UUID was appended
+// to the file name, into the name and the UUID. Names without a valid UUID
+// at the end are returned as they are.
+func SplitLegacyUuid(name string) (string, string) {
+	const uuidLen = 36
+	if len(name) <= uuidLen || uuid.Parse(name[len(name)-uuidLen:]) == nil {
+		return name, ""
+	}
+	return name[:len(name)-uuidLen], name[len(name)-uuidLen:]
+}
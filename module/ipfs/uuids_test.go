@@ -0,0 +1,93 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUuidMap(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(src, "dir"), 0755))
+	writeRandomFiles(t, src, map[string]int{"a": 10, "dir/a-much-longer-name-than-a-uuid-would-be.txt": 10})
+
+	carDir := t.TempDir()
+	result, err := GenerateCarFromDirResult(context.Background(), carDir, src, 1<<20, true, nil)
+	require.NoError(t, err)
+	require.Len(t, result.Cars, 1)
+	car := result.Cars[0]
+
+	root, err := GetCarRoot(car.CarFilePath)
+	require.NoError(t, err)
+	require.Equal(t, car.RootCid, root)
+	// the map is linked from the only root
+	bs, err := blockstore.OpenReadOnly(car.CarFilePath)
+	require.NoError(t, err)
+	roots, err := bs.Roots()
+	require.NoError(t, err)
+	require.Len(t, roots, 1)
+	uuids, uuidMap, err := ReadUuidMap(context.Background(), bs, roots[0])
+	require.NoError(t, err)
+	require.NoError(t, bs.Close())
+	require.True(t, uuidMap.Defined())
+	require.Len(t, uuids, 2)
+
+	list, err := ListCarFile(car.CarFilePath)
+	require.NoError(t, err)
+	for _, d := range car.Details {
+		require.NotEmpty(t, d.UUID)
+		name := strings.TrimPrefix(path.Join(d.FilePath), "/")
+		require.Contains(t, list, fmt.Sprintf("%s     CID:%s     UUID:%s     SIZE:%d\n", name, d.CID, d.UUID, d.FileSize))
+	}
+
+	require.NotContains(t, strings.Join(list, ""), UuidMapName)
+
+	out := t.TempDir()
+	require.NoError(t, RestoreCar(out, carDir))
+	for _, name := range []string{"a", "dir/a-much-longer-name-than-a-uuid-would-be.txt"} {
+		_, err := os.Stat(filepath.Join(out, src, name))
+		require.NoError(t, err)
+	}
+	_, err = os.Stat(filepath.Join(out, UuidMapName))
+	require.True(t, os.IsNotExist(err))
+
+	// a sharded root directory drops the map when restored too
+	carDir = t.TempDir()
+	_, err = GenerateCarFromDirResult(context.Background(), carDir, src, 1<<20, true, nil, WithPathLayout(PathLayoutRelative), WithShardSize(1))
+	require.NoError(t, err)
+	out = t.TempDir()
+	require.NoError(t, RestoreCar(out, carDir))
+	names, err := os.ReadDir(out)
+	require.NoError(t, err)
+	require.Len(t, names, 2)
+
+	// a file of the name of the map is a file
+	other := t.TempDir()
+	writeRandomFiles(t, other, map[string]int{UuidMapName: 10})
+	result, err = GenerateCarFromDirResult(context.Background(), t.TempDir(), other, 1<<20, false, nil, WithPathLayout(PathLayoutRelative), WithHidden(true))
+	require.NoError(t, err)
+	entries, err := ListCarEntries(result.Cars[0].CarFilePath)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, UuidMapName, entries[0].Path)
+	_, err = GenerateCarFromDirResult(context.Background(), t.TempDir(), other, 1<<20, true, nil, WithPathLayout(PathLayoutRelative), WithHidden(true), WithStrict(true))
+	require.Error(t, err)
+}
+
+func TestSplitLegacyUuid(t *testing.T) {
+	name, id := SplitLegacyUuid("file.txtce547c40-acf9-11e6-80f5-76304dec7eb7")
+	require.Equal(t, "file.txt", name)
+	require.Equal(t, "ce547c40-acf9-11e6-80f5-76304dec7eb7", id)
+	for _, name := range []string{"a", "a-much-longer-name-than-a-uuid-would-be.txt"} {
+		got, id := SplitLegacyUuid(name)
+		require.Equal(t, name, got)
+		require.Empty(t, id)
+	}
+}
@@ -0,0 +1,109 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// pattern is a compiled gitignore style pattern.
+type pattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// compilePatterns compiles gitignore style patterns. Empty lines and lines
+// starting with "#" are left out, so the lines of an ignore file can be
+// passed as they are.
+func compilePatterns(lines []string) ([]pattern, error) {
+	var patterns []pattern
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var p pattern
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// a pattern with a slash is anchored to the scanned directory, one
+		// without matches at any depth
+		expr := "^(.*/)?"
+		if strings.Contains(line, "/") {
+			expr = "^"
+			line = strings.TrimPrefix(line, "/")
+		}
+		glob, err := globToRegexp(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", line, err)
+		}
+		p.re, err = regexp.Compile(expr + glob + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", line, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func globToRegexp(glob string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				sb.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unclosed [")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				c = glob[i]
+			}
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String(), nil
+}
+
+// matchPatterns tells whether rel, a slash separated path, is matched by
+// patterns. The last pattern that matches decides, as in a gitignore file.
+func matchPatterns(patterns []pattern, rel string, isDir bool) bool {
+	matched := false
+	for _, p := range patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(rel) {
+			matched = !p.negate
+		}
+	}
+	return matched
+}
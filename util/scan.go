@@ -0,0 +1,378 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/FogMeta/meta-lib/logs"
+	"github.com/pborman/uuid"
+)
+
+// SymlinkPolicy says what scanning does with a symbolic link.
+type SymlinkPolicy string
+
+const (
+	// SymlinkFollow scans what a link points to in its place. A link back
+	// to a directory that is being scanned is skipped.
+	SymlinkFollow SymlinkPolicy = "follow"
+	// SymlinkSkip leaves links out.
+	SymlinkSkip SymlinkPolicy = "skip"
+	// SymlinkStore keeps links as they are, to be stored as symlinks.
+	SymlinkStore SymlinkPolicy = "store"
+)
+
+// ScanOptions set how a file tree is scanned. The zero value follows
+// symlinks, leaves out hidden names and takes everything else.
+type ScanOptions struct {
+	Symlinks SymlinkPolicy
+	// Include, when not empty, takes only the files that match one of these
+	// gitignore style patterns or are below a directory that does.
+	Include []string
+	// Exclude leaves out the files and directories that match these
+	// gitignore style patterns, a later "!pattern" takes a match back.
+	Exclude []string
+	// Hidden also takes the names that start with ".".
+	Hidden bool
+	// EmptyDirs also takes the empty directories below the arguments, as a
+	// Finfo whose Info is the directory. A directory whose entries are all
+	// left out by the filters is not empty.
+	EmptyDirs bool
+	// OnError, when set, is called with every path that is left out because
+	// it can not be read, broken links included.
+	OnError func(path string, err error)
+}
+
+// Validate checks the patterns of o.
+func (o ScanOptions) Validate() error {
+	_, err := newWalker(context.Background(), o)
+	return err
+}
+
+func GetFileListAsync(args []string, isUuid bool) chan Finfo {
+	return GetFileListAsyncContext(context.Background(), args, isUuid)
+}
+
+// GetFileListAsyncContext is like GetFileListAsync, but stops scanning and
+// closes the channel once ctx is done.
+func GetFileListAsyncContext(ctx context.Context, args []string, isUuid bool) chan Finfo {
+	return GetFileListAsyncOptions(ctx, args, isUuid, ScanOptions{})
+}
+
+// GetFileListAsyncFS is GetFileListAsyncOptions for the files of fsys, args
+// are slash separated paths in it and so are the paths of the files, whose
+// data is read with Open. Whether symlinks are followed is up to fsys,
+// os.DirFS follows them; a link fsys gives as a link can only be skipped, it
+// can not be read from fsys.
+func GetFileListAsyncFS(ctx context.Context, fsys fs.FS, args []string, isUuid bool, opts ScanOptions) chan Finfo {
+	return getFileListAsync(ctx, fsys, args, isUuid, opts)
+}
+
+// GetFileListAsyncOptions is GetFileListAsyncContext that scans as opts say.
+// Patterns are matched against the paths below each of args.
+func GetFileListAsyncOptions(ctx context.Context, args []string, isUuid bool, opts ScanOptions) chan Finfo {
+	return getFileListAsync(ctx, nil, args, isUuid, opts)
+}
+
+func getFileListAsync(ctx context.Context, fsys fs.FS, args []string, isUuid bool, opts ScanOptions) chan Finfo {
+	fichan := make(chan Finfo, 0)
+	go func() {
+		defer close(fichan)
+		w, err := newWalker(ctx, opts)
+		if err != nil {
+			log.GetLog().Warn(err)
+			return
+		}
+		w.fsys = fsys
+		w.onErr = func(path string, err error) error {
+			log.GetLog().Warn(err)
+			if opts.OnError != nil {
+				opts.OnError(path, err)
+			}
+			return nil
+		}
+		w.visit = func(item Finfo) bool {
+			if isUuid {
+				item.Uuid = uuid.New()
+			}
+			select {
+			case fichan <- item:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		w.walkArgs(args)
+	}()
+
+	return fichan
+}
+
+func GetFileList(args []string) (fileList []string, err error) {
+	return GetFileListOptions(args, ScanOptions{})
+}
+
+// GetFileListOptions is GetFileList that scans as opts say.
+func GetFileListOptions(args []string, opts ScanOptions) (fileList []string, err error) {
+	fileList, _, err = GetFileListExOptions(args, opts)
+	return
+}
+
+func GetFileListEx(args []string) (fileList []string, totalSize uint64, err error) {
+	return GetFileListExOptions(args, ScanOptions{})
+}
+
+// GetFileListExOptions is GetFileListEx that scans as opts say.
+func GetFileListExOptions(args []string, opts ScanOptions) (fileList []string, totalSize uint64, err error) {
+	w, err := newWalker(context.Background(), opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	fileList = make([]string, 0)
+	w.onErr = func(path string, err error) error {
+		return err
+	}
+	w.visit = func(item Finfo) bool {
+		totalSize += uint64(item.Size())
+		fileList = append(fileList, item.Path)
+		return true
+	}
+	if err := w.walkArgs(args); err != nil {
+		return nil, 0, err
+	}
+	return
+}
+
+// NewPathFilter returns a function that tells whether a scan with opts takes
+// the entry at the slash separated path rel of a tree, with its parent
+// directories checked as the walk would. It is for trees that are not on
+// disk, such as archives; symlinks are left to the caller.
+func NewPathFilter(opts ScanOptions) (func(rel string, isDir bool) bool, error) {
+	w, err := newWalker(context.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
+	return func(rel string, isDir bool) bool {
+		names := strings.Split(rel, "/")
+		included := len(w.include) == 0
+		for i, name := range names {
+			dir := i < len(names)-1 || isDir
+			p := strings.Join(names[:i+1], "/")
+			if !opts.Hidden && strings.HasPrefix(name, ".") {
+				return false
+			}
+			if matchPatterns(w.exclude, p, dir) {
+				return false
+			}
+			included = included || matchPatterns(w.include, p, dir)
+		}
+		return included
+	}, nil
+}
+
+// walker walks file trees for the scan functions. onErr decides whether an
+// error stops the walk or leaves out its path, visit gets every file, and
+// empty directory with EmptyDirs, and returns false to stop.
+type walker struct {
+	ctx     context.Context
+	opts    ScanOptions
+	include []pattern
+	exclude []pattern
+	onErr   func(path string, err error) error
+	visit   func(item Finfo) bool
+	// fsys is walked instead of the disk when set
+	fsys fs.FS
+}
+
+func newWalker(ctx context.Context, opts ScanOptions) (*walker, error) {
+	switch opts.Symlinks {
+	case "", SymlinkFollow, SymlinkSkip, SymlinkStore:
+	default:
+		return nil, fmt.Errorf("unknown symlink policy %q", opts.Symlinks)
+	}
+	include, err := compilePatterns(opts.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compilePatterns(opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	return &walker{ctx: ctx, opts: opts, include: include, exclude: exclude}, nil
+}
+
+func (w *walker) walkArgs(args []string) error {
+	_, err := w.walk(args, make([]string, len(args)), nil, false)
+	return err
+}
+
+// walk visits the files below paths. rels are the paths relative to the
+// scanned argument, empty for the arguments themselves, parents are the
+// directories being walked and included tells that one of them matched an
+// include pattern. It returns false once the walk has to stop.
+func (w *walker) walk(paths, rels []string, parents []os.FileInfo, included bool) (bool, error) {
+	for i, p := range paths {
+		if err := w.ctx.Err(); err != nil {
+			return false, nil
+		}
+		rel := rels[i]
+		finfo, link, err := w.stat(p)
+		if err != nil {
+			if err := w.onErr(p, err); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if finfo == nil {
+			continue
+		}
+		// the name of the root of a file system is "."
+		if !w.opts.Hidden && strings.HasPrefix(finfo.Name(), ".") && (rel != "" || finfo.Name() != ".") {
+			continue
+		}
+		isDir := finfo.IsDir()
+		if rel != "" && matchPatterns(w.exclude, rel, isDir) {
+			continue
+		}
+		in := included || len(w.include) == 0 || (rel != "" && matchPatterns(w.include, rel, isDir))
+		if isDir {
+			if isLoop(finfo, parents) {
+				log.GetLog().Warn(p, " links back to its parent directory, skip it")
+				continue
+			}
+			// sorted by name, so every scan of a tree is in the same order
+			names, err := w.readDir(p)
+			if err != nil {
+				if err := w.onErr(p, err); err != nil {
+					return false, err
+				}
+				continue
+			}
+			children := make([]string, 0, len(names))
+			childRels := make([]string, 0, len(names))
+			for _, name := range names {
+				if w.fsys != nil {
+					children = append(children, path.Join(p, name))
+				} else {
+					children = append(children, fmt.Sprintf("%s/%s", p, name))
+				}
+				childRels = append(childRels, path.Join(rel, name))
+			}
+			if ok, err := w.walk(children, childRels, append(parents, finfo), in); !ok {
+				return false, err
+			}
+			if !w.opts.EmptyDirs || len(names) > 0 || rel == "" || !in {
+				continue
+			}
+		}
+		// arguments are taken as given
+		if !in && rel != "" {
+			continue
+		}
+		item := Finfo{Path: p, Name: finfo.Name(), Info: finfo, Link: link, Rel: rel}
+		if w.fsys != nil && !isDir {
+			item.Open = openFS(w.fsys, p)
+		}
+		if !w.visit(item) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// stat returns the info of path after the symlink policy, nil for a skipped
+// link, and the target of a kept link.
+func (w *walker) stat(path string) (os.FileInfo, string, error) {
+	if w.fsys != nil {
+		finfo, err := fs.Stat(w.fsys, path)
+		if err != nil || finfo.Mode()&os.ModeSymlink == 0 {
+			return finfo, "", err
+		}
+		if w.opts.Symlinks == SymlinkSkip {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("symlink %s can not be read from %T", path, w.fsys)
+	}
+	finfo, err := os.Lstat(path)
+	if err != nil || finfo.Mode()&os.ModeSymlink == 0 {
+		return finfo, "", err
+	}
+	switch w.opts.Symlinks {
+	case SymlinkSkip:
+		return nil, "", nil
+	case SymlinkStore:
+		target, err := os.Readlink(path)
+		return finfo, target, err
+	default:
+		finfo, err = os.Stat(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("broken link: %w", err)
+		}
+		return finfo, "", nil
+	}
+}
+
+// readDir returns the names in the directory p, sorted.
+func (w *walker) readDir(p string) ([]string, error) {
+	var names []string
+	if w.fsys != nil {
+		entries, err := fs.ReadDir(w.fsys, p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names, nil
+	}
+	files, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names, nil
+}
+
+// openFS returns the Open of the file name in fsys, which seeks to the bytes
+// it reads when the file can.
+func openFS(fsys fs.FS, name string) func(start, size int64) (io.ReadCloser, error) {
+	return func(start, size int64) (io.ReadCloser, error) {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		var r io.Reader = f
+		switch rf := f.(type) {
+		case io.ReaderAt:
+			r = io.NewSectionReader(rf, start, size)
+		case io.Seeker:
+			_, err = rf.Seek(start, io.SeekStart)
+		default:
+			_, err = io.CopyN(io.Discard, f, start)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(r, size), f}, nil
+	}
+}
+
+func isLoop(dir os.FileInfo, parents []os.FileInfo) bool {
+	for _, p := range parents {
+		if os.SameFile(dir, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package util
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		patterns []string
+		rel      string
+		isDir    bool
+		want     bool
+	}{
+		{[]string{"*.tmp"}, "a.tmp", false, true},
+		{[]string{"*.tmp"}, "dir/sub/a.tmp", false, true},
+		{[]string{"*.tmp"}, "a.tmp.txt", false, false},
+		{[]string{"build/"}, "src/build", true, true},
+		{[]string{"build/"}, "src/build", false, false},
+		{[]string{"/build"}, "src/build", true, false},
+		{[]string{"/build"}, "build", true, true},
+		{[]string{"docs/*.md"}, "docs/a.md", false, true},
+		{[]string{"docs/*.md"}, "docs/sub/a.md", false, false},
+		{[]string{"docs/**/*.md"}, "docs/sub/deep/a.md", false, true},
+		{[]string{"**/node_modules"}, "a/b/node_modules", true, true},
+		{[]string{"file-[0-9]"}, "file-7", false, true},
+		{[]string{"file-[!0-9]"}, "file-7", false, false},
+		{[]string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{[]string{"*.log", "!keep.log"}, "drop.log", false, true},
+		{[]string{"# comment", "", "\\#hash"}, "#hash", false, true},
+	} {
+		patterns, err := compilePatterns(tc.patterns)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, matchPatterns(patterns, tc.rel, tc.isDir), "%v %s", tc.patterns, tc.rel)
+	}
+	_, err := compilePatterns([]string{"[abc"})
+	require.Error(t, err)
+}
+
+func TestScanFilters(t *testing.T) {
+	root := t.TempDir()
+	files := []string{
+		".config/settings",
+		"build/out.bin",
+		"docs/notes.txt",
+		"docs/readme.md",
+		"main.go",
+		"main.tmp",
+		"src/.hidden",
+		"src/build/keep.go",
+	}
+	for _, name := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(name), 0644))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(root, "empty"), 0755))
+
+	scan := func(opts ScanOptions) []string {
+		var names []string
+		for item := range GetFileListAsyncOptions(context.Background(), []string{root}, false, opts) {
+			rel, err := filepath.Rel(root, item.Path)
+			require.NoError(t, err)
+			names = append(names, rel)
+		}
+		sort.Strings(names)
+		list, err := GetFileListOptions([]string{root}, opts)
+		require.NoError(t, err)
+		require.Len(t, list, len(names))
+		// the filter for trees not on disk takes the same files
+		filter, err := NewPathFilter(opts)
+		require.NoError(t, err)
+		var filtered []string
+		for _, name := range files {
+			if filter(name, false) {
+				filtered = append(filtered, name)
+			}
+		}
+		if !opts.EmptyDirs {
+			require.Equal(t, names, filtered)
+		}
+		return names
+	}
+
+	require.Equal(t, []string{"build/out.bin", "docs/notes.txt", "docs/readme.md", "main.go", "main.tmp", "src/build/keep.go"}, scan(ScanOptions{}))
+	require.Equal(t, []string{".config/settings", "build/out.bin", "docs/notes.txt", "docs/readme.md", "main.go", "main.tmp", "src/.hidden", "src/build/keep.go"}, scan(ScanOptions{Hidden: true}))
+	require.Equal(t, []string{"docs/notes.txt", "docs/readme.md", "main.go", "src/build/keep.go"}, scan(ScanOptions{Exclude: []string{"*.tmp", "/build/"}}))
+	require.Equal(t, []string{"docs/readme.md", "main.go", "src/build/keep.go"}, scan(ScanOptions{Include: []string{"*.go", "*.md"}}))
+	require.Equal(t, []string{".config/settings", "docs/notes.txt", "docs/readme.md"}, scan(ScanOptions{Include: []string{"docs/", ".config"}, Hidden: true}))
+	// an empty directory is kept, not one whose files are all left out
+	require.Equal(t, []string{"docs/notes.txt", "docs/readme.md", "empty", "main.go", "main.tmp", "src/build/keep.go"}, scan(ScanOptions{Exclude: []string{"*.bin"}, EmptyDirs: true}))
+	require.Equal(t, []string{"build/out.bin", "empty", "main.go", "main.tmp", "src/build/keep.go"}, scan(ScanOptions{Exclude: []string{"*.txt", "*.md"}, EmptyDirs: true}))
+
+	_, err := GetFileListOptions([]string{root}, ScanOptions{Exclude: []string{"[oops"}})
+	require.Error(t, err)
+}
+
+// plainFS has files that can only be read from the start.
+type plainFS struct {
+	fstest.MapFS
+}
+
+func (p plainFS) Open(name string) (fs.File, error) {
+	f, err := p.MapFS.Open(name)
+	return struct{ fs.File }{f}, err
+}
+
+func TestScanFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"data/a.txt":   {Data: []byte("0123456789")},
+		"data/.hidden": {Data: []byte("hidden")},
+		"data/empty":   {Mode: fs.ModeDir},
+		"other":        {Data: []byte("other")},
+	}
+
+	for _, fsys := range []fs.FS{fsys, plainFS{fsys}} {
+		var paths []string
+		var a Finfo
+		for item := range GetFileListAsyncFS(context.Background(), fsys, []string{"data"}, false, ScanOptions{EmptyDirs: true}) {
+			paths = append(paths, item.Path)
+			if item.Path == "data/a.txt" {
+				a = item
+			}
+		}
+		require.Equal(t, []string{"data/a.txt", "data/empty"}, paths)
+		require.Equal(t, "a.txt", a.Rel)
+		require.NotNil(t, a.Open)
+		r, err := a.Open(3, 4)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, "3456", string(data))
+	}
+}
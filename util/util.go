@@ -6,12 +6,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	log "github.com/FogMeta/meta-lib/logs"
-	"github.com/pborman/uuid"
 	"io"
-	"io/ioutil"
 	"os"
-	"strings"
 
 	cid "github.com/ipfs/go-cid"
 	mh "github.com/multiformats/go-multihash"
@@ -155,125 +151,29 @@ type Finfo struct {
 	Info      os.FileInfo
 	SeekStart int64
 	SeekEnd   int64
+	// Part and Parts number the parts of a file split across CARs, Parts is
+	// 0 for a whole file.
+	Part  int
+	Parts int
+	// Link is the target of a symlink kept by SymlinkStore, Info is then the
+	// link itself.
+	Link string
+	// Rel is the slash separated path below the scanned argument the file
+	// was found in, empty for an argument that is a file itself.
+	Rel string
+	// Dest is the path of the file in its CAR given by a source manifest,
+	// Sha256 its expected checksum.
+	Dest   string
+	Sha256 string
+	// Open, when set, reads size bytes of the file from byte start on, for
+	// a file that is not on disk at Path, e.g. an entry of an archive.
+	Open func(start, size int64) (io.ReadCloser, error)
 }
 
-func GetFileListAsync(args []string, isUuid bool) chan Finfo {
-	fichan := make(chan Finfo, 0)
-	go func() {
-		defer close(fichan)
-		for _, path := range args {
-			finfo, err := os.Stat(path)
-			if err != nil {
-				log.GetLog().Warn(err)
-				return
-			}
-			//Ignore hidden directories
-			if strings.HasPrefix(finfo.Name(), ".") {
-				continue
-			}
-			if finfo.IsDir() {
-				files, err := ioutil.ReadDir(path)
-				if err != nil {
-					log.GetLog().Warn(err)
-					return
-				}
-				templist := make([]string, 0)
-				for _, n := range files {
-					templist = append(templist, fmt.Sprintf("%s/%s", path, n.Name()))
-				}
-				embededChan := GetFileListAsync(templist, isUuid)
-				if err != nil {
-					log.GetLog().Warn(err)
-					return
-				}
-
-				for item := range embededChan {
-					fichan <- item
-				}
-			} else {
-
-				uuidStr := ""
-				if isUuid {
-					uuidStr = uuid.New()
-				}
-
-				fichan <- Finfo{
-					Path: path,
-					Name: finfo.Name(),
-					Uuid: uuidStr,
-					Info: finfo,
-				}
-			}
-		}
-	}()
-
-	return fichan
-}
-
-func GetFileList(args []string) (fileList []string, err error) {
-	fileList = make([]string, 0)
-	for _, path := range args {
-		finfo, err := os.Stat(path)
-		if err != nil {
-			return nil, err
-		}
-		if strings.HasPrefix(finfo.Name(), ".") {
-			continue
-		}
-		if finfo.IsDir() {
-			files, err := ioutil.ReadDir(path)
-			if err != nil {
-				return nil, err
-			}
-			templist := make([]string, 0)
-			for _, n := range files {
-				templist = append(templist, fmt.Sprintf("%s/%s", path, n.Name()))
-			}
-			list, err := GetFileList(templist)
-			if err != nil {
-				return nil, err
-			}
-			fileList = append(fileList, list...)
-		} else {
-			fileList = append(fileList, path)
-		}
+// Size is the size of the data of the file, 0 for a directory.
+func (f Finfo) Size() int64 {
+	if f.Info.IsDir() {
+		return 0
 	}
-
-	return
-}
-
-func GetFileListEx(args []string) (fileList []string, totalSize uint64, err error) {
-	fileList = make([]string, 0)
-	totalSize = 0
-	for _, path := range args {
-		finfo, err := os.Stat(path)
-		if err != nil {
-			return nil, uint64(0), err
-		}
-		if strings.HasPrefix(finfo.Name(), ".") {
-			continue
-		}
-		if finfo.IsDir() {
-			files, err := ioutil.ReadDir(path)
-			if err != nil {
-				return nil, uint64(0), err
-			}
-			templist := make([]string, 0)
-			for _, n := range files {
-				templist = append(templist, fmt.Sprintf("%s/%s", path, n.Name()))
-			}
-			list, dirSize, err := GetFileListEx(templist)
-			if err != nil {
-				return nil, uint64(0), err
-			}
-			totalSize += dirSize
-			fileList = append(fileList, list...)
-		} else {
-
-			totalSize += uint64(finfo.Size())
-			fileList = append(fileList, path)
-		}
-	}
-
-	return
+	return f.Info.Size()
 }